@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/asg017/sqlite-http/internal/vtab"
+	"go.riyazali.net/sqlite"
+)
+
+// Maximum number of concurrent requests in flight at once, the rest wait their
+// turn. Configurable with http_concurrency_set
+var DoConcurrency = newConcurrencyLimit(64)
+
+// A semaphore whose size can change while requests hold it
+type concurrencyLimit struct {
+	limit  int
+	active int
+	cond   *sync.Cond
+	mu     sync.Mutex
+}
+
+func newConcurrencyLimit(limit int) *concurrencyLimit {
+	l := &concurrencyLimit{limit: limit}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// Wait for a free slot and take it, unless ctx is done first
+func (l *concurrencyLimit) acquireContext(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.cond.Broadcast()
+	})
+	defer stop()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.active >= l.limit && ctx.Err() == nil {
+		l.cond.Wait()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	l.active += 1
+	return nil
+}
+
+func (l *concurrencyLimit) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active -= 1
+	l.cond.Broadcast()
+}
+
+// Change the number of slots. Requests already holding one keep it, so more
+// than limit can be in flight until enough of them finish.
+func (l *concurrencyLimit) set(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	l.cond.Broadcast()
+}
+
+// Requests started with http_request_async on a connection, by handle
+type asyncRegistry struct {
+	requests map[int64]*asyncRequest
+	nextId   int64
+	// cancelled when the connection closes, to stop its requests
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.Mutex
+}
+
+func newAsyncRegistry(connection *connection) *asyncRegistry {
+	ctx, cancel := context.WithCancel(context.Background())
+	registry := &asyncRegistry{requests: map[int64]*asyncRequest{}, ctx: ctx, cancel: cancel}
+	connection.onClose(registry.cancel)
+	return registry
+}
+
+// A request running in the background, and its outcome once done is closed
+type asyncRequest struct {
+	handle    int64
+	method    string
+	url       string
+	startedAt time.Time
+	done      chan struct{}
+
+	// set before done is closed
+	finishedAt      time.Time
+	responseStatus  string
+	responseCode    int
+	responseHeaders string
+	responseBody    []byte
+	err             error
+}
+
+// Make the request, unless ctx is cancelled first
+func (r *asyncRequest) run(ctx context.Context, params *PrepareRequestParams) {
+	defer close(r.done)
+	defer func() { r.finishedAt = time.Now() }()
+	if r.err = DoConcurrency.acquireContext(ctx); r.err != nil {
+		return
+	}
+	defer DoConcurrency.release()
+
+	client, request, err := prepareRequest(params)
+	if err != nil {
+		r.err = err
+		return
+	}
+	response, err := client.Do(request.WithContext(ctx))
+	if err != nil {
+		r.err = err
+		return
+	}
+	defer response.Body.Close()
+	headers := new(bytes.Buffer)
+	response.Header.Write(headers)
+	r.responseStatus, r.responseCode, r.responseHeaders = response.Status, response.StatusCode, headers.String()
+	r.responseBody, r.err = io.ReadAll(response.Body)
+}
+
+func (r *asyncRequest) finished() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+/* http_request_async(method, url, [headers], [body])
+* Start a request in the background, and return its handle right away.
+* Collect the response with http_await(handle), or the http_results table.
+ */
+type HttpRequestAsyncFunc struct {
+	noNetwork  bool
+	connection *connection
+	requests   *asyncRegistry
+}
+
+func (*HttpRequestAsyncFunc) Deterministic() bool { return false }
+func (*HttpRequestAsyncFunc) Args() int           { return -1 }
+func (f *HttpRequestAsyncFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	if len(values) < 2 || len(values) > 4 {
+		c.ResultError(fmt.Errorf("usage: http_request_async(method, url, [headers], [body])"))
+		return
+	}
+	params := &PrepareRequestParams{
+		method:     values[0].Text(),
+		url:        values[1].Text(),
+		noNetwork:  f.noNetwork,
+		connection: f.connection,
+		background: true,
+	}
+	if len(values) > 2 {
+		params.headers = values[2].Text()
+	}
+	if len(values) > 3 {
+		params.body = values[3].Blob()
+	}
+
+	f.requests.mu.Lock()
+	f.requests.nextId += 1
+	request := &asyncRequest{
+		handle:    f.requests.nextId,
+		method:    params.method,
+		url:       params.url,
+		startedAt: time.Now(),
+		done:      make(chan struct{}),
+	}
+	f.requests.requests[request.handle] = request
+	f.requests.mu.Unlock()
+
+	go request.run(f.requests.ctx, params)
+	c.ResultInt64(request.handle)
+}
+
+/* http_await(handle, [keep], [timeout_ms])
+* Wait for the request with the given handle to finish, and return its
+* response body, or raise its error. The request is then forgotten, unless
+* keep is 1 to leave it in http_results. Waits at most timeout_ms, or the
+* http_timeout_set timeout, after which the request can be awaited again.
+ */
+type HttpAwaitFunc struct {
+	requests *asyncRegistry
+}
+
+func (*HttpAwaitFunc) Deterministic() bool { return false }
+func (*HttpAwaitFunc) Args() int           { return -1 }
+func (f *HttpAwaitFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	if len(values) < 1 || len(values) > 3 {
+		c.ResultError(fmt.Errorf("usage: http_await(handle, [keep], [timeout_ms])"))
+		return
+	}
+	handle := values[0].Int64()
+	keep := len(values) > 1 && values[1].Int() != 0
+	timeout := DoTimeout
+	if len(values) > 2 && values[2].Type() != sqlite.SQLITE_NULL {
+		timeout = time.Duration(values[2].Int64()) * time.Millisecond
+	}
+	f.requests.mu.Lock()
+	request, ok := f.requests.requests[handle]
+	f.requests.mu.Unlock()
+	if !ok {
+		c.ResultError(fmt.Errorf("no request with handle %d", handle))
+		return
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-request.done:
+	case <-timer.C:
+		c.ResultError(fmt.Errorf("request with handle %d still running after %s", handle, timeout))
+		return
+	}
+	if !keep {
+		f.requests.mu.Lock()
+		delete(f.requests.requests, handle)
+		f.requests.mu.Unlock()
+	}
+	if request.err != nil {
+		c.ResultError(request.err)
+		return
+	}
+	c.ResultBlob(request.responseBody)
+}
+
+/* http_results_clear()
+* Forget every finished request, returning how many were forgotten.
+ */
+type HttpResultsClearFunc struct {
+	requests *asyncRegistry
+}
+
+func (*HttpResultsClearFunc) Deterministic() bool { return false }
+func (*HttpResultsClearFunc) Args() int           { return 0 }
+func (f *HttpResultsClearFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	f.requests.mu.Lock()
+	defer f.requests.mu.Unlock()
+	cleared := 0
+	for handle, request := range f.requests.requests {
+		if request.finished() {
+			delete(f.requests.requests, handle)
+			cleared += 1
+		}
+	}
+	c.ResultInt(cleared)
+}
+
+/* http_concurrency_set(n)
+* Set how many requests made by http_request_async can be in flight at once,
+* 64 by default. Returns the new setting.
+ */
+type HttpConcurrencySet struct{}
+
+func (*HttpConcurrencySet) Deterministic() bool { return false }
+func (*HttpConcurrencySet) Args() int           { return 1 }
+func (*HttpConcurrencySet) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	n := values[0].Int()
+	if n < 1 {
+		c.ResultError(fmt.Errorf("http_concurrency_set() expects a positive number of requests"))
+		return
+	}
+	DoConcurrency.set(n)
+	c.ResultInt(n)
+}
+
+/** select * from http_results
+ * A table of every request started with http_request_async on the connection, by handle. Requests
+ * still running have a 'pending' status and NULL response columns.
+ */
+var ResultsColumns = []vtab.Column{
+	{Name: "handle", Type: sqlite.SQLITE_INTEGER.String()},
+	{Name: "request_method", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "request_url", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "status", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "response_status", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "response_status_code", Type: sqlite.SQLITE_INTEGER.String()},
+	{Name: "response_headers", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "response_body", Type: sqlite.SQLITE_BLOB.String()},
+	{Name: "error", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "started_at", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "finished_at", Type: sqlite.SQLITE_TEXT.String()},
+}
+
+type ResultsCursor struct {
+	requests []*asyncRequest
+	// whether each request had finished when the cursor was opened
+	finished []bool
+	current  int
+}
+
+func (cur *ResultsCursor) Column(ctx vtab.Context, c int) error {
+	col := ResultsColumns[c]
+	request := cur.requests[cur.current]
+	finished := cur.finished[cur.current]
+
+	switch col.Name {
+	case "handle":
+		ctx.ResultInt64(request.handle)
+		return nil
+	case "request_method":
+		ctx.ResultText(request.method)
+		return nil
+	case "request_url":
+		ctx.ResultText(request.url)
+		return nil
+	case "status":
+		if !finished {
+			ctx.ResultText("pending")
+		} else if request.err != nil {
+			ctx.ResultText("error")
+		} else {
+			ctx.ResultText("done")
+		}
+		return nil
+	case "started_at":
+		ctx.ResultText(*formatSqliteDatetime(&request.startedAt))
+		return nil
+	}
+
+	if !finished {
+		ctx.ResultNull()
+		return nil
+	}
+	switch col.Name {
+	case "response_status":
+		if request.responseStatus == "" {
+			ctx.ResultNull()
+		} else {
+			ctx.ResultText(request.responseStatus)
+		}
+	case "response_status_code":
+		if request.responseCode == 0 {
+			ctx.ResultNull()
+		} else {
+			ctx.ResultInt(request.responseCode)
+		}
+	case "response_headers":
+		if request.responseStatus == "" {
+			ctx.ResultNull()
+		} else {
+			ctx.ResultText(request.responseHeaders)
+		}
+	case "response_body":
+		if request.responseBody == nil {
+			ctx.ResultNull()
+		} else {
+			ctx.ResultBlob(request.responseBody)
+		}
+	case "error":
+		if request.err == nil {
+			ctx.ResultNull()
+		} else {
+			ctx.ResultText(request.err.Error())
+		}
+	case "finished_at":
+		ctx.ResultText(*formatSqliteDatetime(&request.finishedAt))
+	}
+	return nil
+}
+
+func (cur *ResultsCursor) Next() (vtab.Row, error) {
+	cur.current += 1
+	if cur.current >= len(cur.requests) {
+		return nil, io.EOF
+	}
+	return cur, nil
+}
+
+func ResultsIterator(registry *asyncRegistry, constraints []*vtab.Constraint, order []*sqlite.OrderBy) (vtab.Iterator, error) {
+	registry.mu.Lock()
+	requests := make([]*asyncRequest, 0, len(registry.requests))
+	for _, request := range registry.requests {
+		requests = append(requests, request)
+	}
+	registry.mu.Unlock()
+	sort.Slice(requests, func(i, j int) bool { return requests[i].handle < requests[j].handle })
+
+	finished := make([]bool, len(requests))
+	for i, request := range requests {
+		finished[i] = request.finished()
+	}
+	return &ResultsCursor{requests: requests, finished: finished, current: -1}, nil
+}
+
+func RegisterAsync(api *sqlite.ExtensionApi, connection *connection, noNetwork bool) error {
+	requests := newAsyncRegistry(connection)
+	iterator := func(constraints []*vtab.Constraint, order []*sqlite.OrderBy) (vtab.Iterator, error) {
+		return ResultsIterator(requests, constraints, order)
+	}
+	if err := api.CreateModule("http_results", vtab.NewTableFunc("http_results", ResultsColumns, iterator)); err != nil {
+		return err
+	}
+	if err := api.CreateFunction("http_request_async", &HttpRequestAsyncFunc{noNetwork: noNetwork, connection: connection, requests: requests}); err != nil {
+		return err
+	}
+	if err := api.CreateFunction("http_await", &HttpAwaitFunc{requests: requests}); err != nil {
+		return err
+	}
+	if err := api.CreateFunction("http_results_clear", &HttpResultsClearFunc{requests: requests}); err != nil {
+		return err
+	}
+	if err := api.CreateFunction("http_concurrency_set", &HttpConcurrencySet{}); err != nil {
+		return err
+	}
+	return nil
+}
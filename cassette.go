@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"go.riyazali.net/sqlite"
+)
+
+// Cassette that HTTP requests are recorded into or replayed from, nil when disabled.
+// Configurable with http_cassette
+var DoCassette *cassette
+
+const (
+	// send every request to the network, and save each response in the cassette
+	cassetteRecord = "record"
+	// serve every request from the cassette, never using the network
+	cassetteReplay = "replay"
+	// serve matching requests from the cassette, and send the rest to the network without saving them
+	cassettePassthrough = "passthrough"
+)
+
+// A single recorded request and its response, one JSON object per line in a cassette file
+type cassetteInteraction struct {
+	Method             string `json:"method"`
+	URL                string `json:"url"`
+	RequestHeaders     string `json:"request_headers"`
+	RequestBody        []byte `json:"request_body"`
+	ResponseStatus     string `json:"response_status"`
+	ResponseStatusCode int    `json:"response_status_code"`
+	ResponseHeaders    string `json:"response_headers"`
+	ResponseBody       []byte `json:"response_body"`
+
+	// true once served, so repeated requests are replayed in recorded order
+	used bool
+}
+
+type cassette struct {
+	path string
+	mode string
+
+	matchMethod  bool
+	matchUrl     bool
+	matchBody    bool
+	matchHeaders []string
+
+	interactions []*cassetteInteraction
+	mu           sync.Mutex
+}
+
+// Parse a comma separated list of request fields to match recorded interactions on,
+// like 'method,url,body,header:Authorization'
+func (c *cassette) parseMatch(match string) error {
+	for _, field := range strings.Split(match, ",") {
+		field = strings.TrimSpace(field)
+		switch {
+		case field == "":
+		case field == "method":
+			c.matchMethod = true
+		case field == "url":
+			c.matchUrl = true
+		case field == "body":
+			c.matchBody = true
+		case strings.HasPrefix(field, "header:"):
+			c.matchHeaders = append(c.matchHeaders, strings.TrimPrefix(field, "header:"))
+		default:
+			return fmt.Errorf("unknown cassette match field: %s", field)
+		}
+	}
+	return nil
+}
+
+// Read all interactions of the cassette file, which must exist
+func (c *cassette) load() error {
+	file, err := os.Open(c.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 256*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		interaction := &cassetteInteraction{}
+		if err := json.Unmarshal(scanner.Bytes(), interaction); err != nil {
+			return fmt.Errorf("invalid interaction on line %d: %s", line, err)
+		}
+		c.interactions = append(c.interactions, interaction)
+	}
+	return scanner.Err()
+}
+
+// Append the given interaction to the cassette file
+func (c *cassette) save(interaction *cassetteInteraction) error {
+	line, err := json.Marshal(interaction)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	file, err := os.OpenFile(c.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+func (c *cassette) matches(interaction *cassetteInteraction, request *http.Request, body []byte) bool {
+	if c.matchMethod && interaction.Method != request.Method {
+		return false
+	}
+	if c.matchUrl && interaction.URL != request.URL.String() {
+		return false
+	}
+	if c.matchBody && !bytes.Equal(interaction.RequestBody, body) {
+		return false
+	}
+	if len(c.matchHeaders) > 0 {
+		recorded := readHeader(interaction.RequestHeaders)
+		for _, name := range c.matchHeaders {
+			if strings.Join(recorded.Values(name), ", ") != strings.Join(request.Header.Values(name), ", ") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Returns the first unused interaction matching the request, or the last
+// matching one if they've all been used. nil if none match.
+func (c *cassette) find(request *http.Request, body []byte) *cassetteInteraction {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var last *cassetteInteraction
+	for _, interaction := range c.interactions {
+		if !c.matches(interaction, request, body) {
+			continue
+		}
+		if !interaction.used {
+			interaction.used = true
+			return interaction
+		}
+		last = interaction
+	}
+	return last
+}
+
+// Returns the entire body of the given request, without consuming it
+func readRequestBody(request *http.Request) ([]byte, error) {
+	if request.GetBody == nil {
+		return nil, nil
+	}
+	body, err := request.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// A http.RoundTripper that records responses into, or replays responses from, a cassette
+type cassetteTransport struct {
+	base     http.RoundTripper
+	cassette *cassette
+}
+
+func (t *cassetteTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.cassette.mode != cassetteRecord {
+		if interaction := t.cassette.find(request, body); interaction != nil {
+			return &http.Response{
+				Status:        interaction.ResponseStatus,
+				StatusCode:    interaction.ResponseStatusCode,
+				Proto:         "HTTP/1.1",
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				Header:        http.Header(readHeader(interaction.ResponseHeaders)),
+				Body:          io.NopCloser(bytes.NewReader(interaction.ResponseBody)),
+				ContentLength: int64(len(interaction.ResponseBody)),
+				Request:       request,
+			}, nil
+		}
+		if t.cassette.mode == cassetteReplay {
+			return nil, fmt.Errorf("no interaction in cassette %s matches %s %s", t.cassette.path, request.Method, request.URL)
+		}
+		return t.base.RoundTrip(request)
+	}
+
+	response, err := t.base.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	requestHeaders := new(bytes.Buffer)
+	request.Header.Write(requestHeaders)
+	responseHeaders := new(bytes.Buffer)
+	response.Header.Write(responseHeaders)
+	response.Body = &cassetteBody{
+		body:     response.Body,
+		cassette: t.cassette,
+		interaction: &cassetteInteraction{
+			Method:             request.Method,
+			URL:                request.URL.String(),
+			RequestHeaders:     requestHeaders.String(),
+			RequestBody:        body,
+			ResponseStatus:     response.Status,
+			ResponseStatusCode: response.StatusCode,
+			ResponseHeaders:    responseHeaders.String(),
+		},
+	}
+	return response, nil
+}
+
+// A response body that keeps everything read, then saves the interaction into
+// the cassette once fully read or closed. Streams closed early are saved with
+// the part that was read.
+type cassetteBody struct {
+	body        io.ReadCloser
+	cassette    *cassette
+	interaction *cassetteInteraction
+
+	buf  bytes.Buffer
+	done bool
+}
+
+func (b *cassetteBody) finish() error {
+	if b.done {
+		return nil
+	}
+	b.done = true
+	b.interaction.ResponseBody = b.buf.Bytes()
+	if err := b.cassette.save(b.interaction); err != nil {
+		return fmt.Errorf("error saving to cassette %s: %s", b.cassette.path, err)
+	}
+	return nil
+}
+
+func (b *cassetteBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		if saveErr := b.finish(); saveErr != nil {
+			return n, saveErr
+		}
+	}
+	return n, err
+}
+
+func (b *cassetteBody) Close() error {
+	err := b.body.Close()
+	if saveErr := b.finish(); saveErr != nil {
+		return saveErr
+	}
+	return err
+}
+
+/* http_cassette(path, mode, [match])
+* Record HTTP requests into, or replay them from, the cassette file at path.
+* mode is 'record', 'replay', or 'passthrough'. match is a comma separated list of
+* request fields that must be equal to replay a recorded response, 'method,url'
+* by default. NULL disables the cassette.
+ */
+type HttpCassette struct{}
+
+func (*HttpCassette) Deterministic() bool { return false }
+func (*HttpCassette) Args() int           { return -1 }
+func (*HttpCassette) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	if len(values) < 1 || len(values) > 3 {
+		c.ResultError(fmt.Errorf("http_cassette() expects 1 to 3 arguments, got %d", len(values)))
+		return
+	}
+	if values[0].Type() == sqlite.SQLITE_NULL || values[0].Text() == "" {
+		DoCassette = nil
+		c.ResultNull()
+		return
+	}
+
+	cassette := &cassette{path: values[0].Text(), mode: cassetteReplay}
+	if len(values) > 1 && values[1].Text() != "" {
+		cassette.mode = values[1].Text()
+	}
+	match := "method,url"
+	if len(values) > 2 && values[2].Type() != sqlite.SQLITE_NULL {
+		match = values[2].Text()
+	}
+	if err := cassette.parseMatch(match); err != nil {
+		c.ResultError(err)
+		return
+	}
+
+	switch cassette.mode {
+	case cassetteRecord:
+		// re-recording starts from an empty cassette
+		if err := os.WriteFile(cassette.path, nil, 0644); err != nil {
+			c.ResultError(fmt.Errorf("error creating cassette: %s", err))
+			return
+		}
+	case cassetteReplay, cassettePassthrough:
+		if err := cassette.load(); err != nil {
+			c.ResultError(fmt.Errorf("error loading cassette %s: %s", cassette.path, err))
+			return
+		}
+	default:
+		c.ResultError(fmt.Errorf("unknown cassette mode %q, expected 'record', 'replay', or 'passthrough'", cassette.mode))
+		return
+	}
+
+	DoCassette = cassette
+	c.ResultText(cassette.mode)
+}
+
+func RegisterCassette(api *sqlite.ExtensionApi) error {
+	if err := api.CreateFunction("http_cassette", &HttpCassette{}); err != nil {
+		return err
+	}
+	return nil
+}
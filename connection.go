@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"go.riyazali.net/sqlite"
+)
+
+// State kept for each connection the extension is loaded into, until it closes
+type connection struct {
+	conn *sqlite.Conn
+
+	// table requests made from this connection are logged into, nil when
+	// disabled. Configurable with http_log_to
+	log *requestLog
+	// called after every commit and rollback, see addTransactionHooks. Guarded by hooksMu
+	hooks *connHooks
+
+	closed     bool
+	nextId     int64
+	closeHooks map[int64]func()
+	mu         sync.Mutex
+}
+
+// The request log of the connection, nil if not logging
+func (c *connection) requestLog() *requestLog {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.log
+}
+
+// Replace the request log of the connection, closing the previous one
+func (c *connection) setRequestLog(log *requestLog) {
+	c.mu.Lock()
+	previous := c.log
+	c.log = log
+	if c.closed {
+		c.log = nil
+	}
+	c.mu.Unlock()
+	if previous != nil {
+		previous.close()
+	}
+}
+
+// Call fn once the connection closes, or right away if it already has.
+// Returns a function that removes fn.
+func (c *connection) onClose(fn func()) func() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		fn()
+		return func() {}
+	}
+	c.nextId += 1
+	id := c.nextId
+	c.closeHooks[id] = fn
+	c.mu.Unlock()
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.closeHooks, id)
+	}
+}
+
+func (c *connection) close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	log := c.log
+	c.log = nil
+	hooks := c.closeHooks
+	c.closeHooks = nil
+	c.mu.Unlock()
+
+	if log != nil {
+		log.close()
+	}
+	for _, fn := range hooks {
+		fn()
+	}
+}
+
+/* select * from http_connection
+* Used internally to tell when the connection closes, always empty. SQLite only
+* disconnects an eponymous virtual table when its connection closes, so the
+* one connected when the extension is loaded is disconnected then.
+ */
+type connectionModule struct {
+	connection *connection
+}
+
+func (m *connectionModule) Connect(_ *sqlite.Conn, _ []string, declare func(string) error) (sqlite.VirtualTable, error) {
+	if err := declare(`CREATE TABLE x(closed INT)`); err != nil {
+		return nil, err
+	}
+	return &connectionTable{connection: m.connection}, nil
+}
+
+type connectionTable struct {
+	connection *connection
+}
+
+func (t *connectionTable) BestIndex(input *sqlite.IndexInfoInput) (*sqlite.IndexInfoOutput, error) {
+	usage := make([]*sqlite.ConstraintUsage, len(input.Constraints))
+	for i := range usage {
+		usage[i] = &sqlite.ConstraintUsage{}
+	}
+	return &sqlite.IndexInfoOutput{ConstraintUsage: usage, EstimatedCost: 1}, nil
+}
+
+func (t *connectionTable) Open() (sqlite.VirtualCursor, error) {
+	return &connectionCursor{}, nil
+}
+
+func (t *connectionTable) Disconnect() error {
+	t.connection.close()
+	return nil
+}
+
+func (t *connectionTable) Destroy() error {
+	return t.Disconnect()
+}
+
+type connectionCursor struct{}
+
+func (*connectionCursor) Filter(int, string, ...sqlite.Value) error     { return nil }
+func (*connectionCursor) Next() error                                   { return nil }
+func (*connectionCursor) Rowid() (int64, error)                         { return 0, nil }
+func (*connectionCursor) Column(*sqlite.VirtualTableContext, int) error { return nil }
+func (*connectionCursor) Eof() bool                                     { return true }
+func (*connectionCursor) Close() error                                  { return nil }
+
+// Start tracking the connection the extension is being loaded into, returning
+// its state that the rest of the extension is registered with
+func RegisterConnection(api *sqlite.ExtensionApi) (*connection, error) {
+	c := &connection{conn: api.Connection(), closeHooks: map[int64]func(){}}
+	if err := api.CreateModule("http_connection", &connectionModule{connection: c}, sqlite.EponymousOnly(true), sqlite.ReadOnly(true)); err != nil {
+		return nil, err
+	}
+	// connect the table now, for it to be disconnected once the connection closes
+	if err := c.conn.Exec(`SELECT * FROM http_connection`, nil); err != nil {
+		return nil, fmt.Errorf("error connecting http_connection: %s", err)
+	}
+	return c, nil
+}
@@ -0,0 +1,345 @@
+package main
+
+/*
+#include <stdlib.h>
+#include "sqlite3ext.h"
+
+SQLITE_EXTENSION_INIT3
+
+// the extension API is a table of function pointers, which cgo can't call directly
+
+static int database_open(const char *filename, sqlite3 **db, int flags) {
+	return sqlite3_open_v2(filename, db, flags, NULL);
+}
+static int database_close(sqlite3 *db) { return sqlite3_close_v2(db); }
+static int database_busy_timeout(sqlite3 *db, int ms) { return sqlite3_busy_timeout(db, ms); }
+static const char *database_errmsg(sqlite3 *db) { return sqlite3_errmsg(db); }
+static int database_errcode(sqlite3 *db) { return sqlite3_errcode(db); }
+static int database_changes(sqlite3 *db) { return sqlite3_changes(db); }
+
+static int database_prepare(sqlite3 *db, const char *sql, sqlite3_stmt **stmt) {
+	return sqlite3_prepare_v2(db, sql, -1, stmt, NULL);
+}
+static int database_finalize(sqlite3_stmt *stmt) { return sqlite3_finalize(stmt); }
+static int database_reset(sqlite3_stmt *stmt) {
+	sqlite3_clear_bindings(stmt);
+	return sqlite3_reset(stmt);
+}
+static int database_step(sqlite3_stmt *stmt) { return sqlite3_step(stmt); }
+static int database_stmt_readonly(sqlite3_stmt *stmt) { return sqlite3_stmt_readonly(stmt); }
+
+static int database_bind_parameter_count(sqlite3_stmt *stmt) { return sqlite3_bind_parameter_count(stmt); }
+static const char *database_bind_parameter_name(sqlite3_stmt *stmt, int i) { return sqlite3_bind_parameter_name(stmt, i); }
+static int database_bind_null(sqlite3_stmt *stmt, int i) { return sqlite3_bind_null(stmt, i); }
+static int database_bind_int64(sqlite3_stmt *stmt, int i, sqlite3_int64 v) { return sqlite3_bind_int64(stmt, i, v); }
+static int database_bind_double(sqlite3_stmt *stmt, int i, double v) { return sqlite3_bind_double(stmt, i, v); }
+static int database_bind_text(sqlite3_stmt *stmt, int i, const char *v, int n) {
+	return sqlite3_bind_text(stmt, i, v, n, SQLITE_TRANSIENT);
+}
+static int database_bind_blob(sqlite3_stmt *stmt, int i, const void *v, int n) {
+	return sqlite3_bind_blob(stmt, i, v, n, SQLITE_TRANSIENT);
+}
+
+static int database_column_count(sqlite3_stmt *stmt) { return sqlite3_column_count(stmt); }
+static const char *database_column_name(sqlite3_stmt *stmt, int i) { return sqlite3_column_name(stmt, i); }
+static int database_column_type(sqlite3_stmt *stmt, int i) { return sqlite3_column_type(stmt, i); }
+static sqlite3_int64 database_column_int64(sqlite3_stmt *stmt, int i) { return sqlite3_column_int64(stmt, i); }
+static double database_column_double(sqlite3_stmt *stmt, int i) { return sqlite3_column_double(stmt, i); }
+static const void *database_column_blob(sqlite3_stmt *stmt, int i) { return sqlite3_column_blob(stmt, i); }
+static const unsigned char *database_column_text(sqlite3_stmt *stmt, int i) { return sqlite3_column_text(stmt, i); }
+static int database_column_bytes(sqlite3_stmt *stmt, int i) { return sqlite3_column_bytes(stmt, i); }
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"unsafe"
+
+	"go.riyazali.net/sqlite"
+)
+
+// How long a separate connection waits for another one to release its lock
+const databaseBusyTimeout = 5 * time.Second
+
+var (
+	errDatabaseClosed = errors.New("database connection is closed")
+	errNoDatabaseFile = errors.New("needs a database file, not an in-memory or temporary database")
+	// returned once the busy timeout runs out while another connection holds a lock
+	errDatabaseBusy = errors.New("database is locked")
+)
+
+// A connection of our own to the database file of the connection the extension
+// is loaded into. Goroutines of the extension use it, so they never touch the
+// user's connection outside of SQLite's calls into the extension, and only ever
+// see and write committed data instead of joining the user's open transaction.
+type database struct {
+	db *C.sqlite3
+	mu sync.Mutex
+}
+
+// Path of the main database file of the given connection, or "" for an
+// in-memory or temporary database
+func databasePath(conn *sqlite.Conn) (string, error) {
+	var path string
+	err := conn.Exec(`SELECT file FROM pragma_database_list WHERE name = 'main'`, func(stmt *sqlite.Stmt) error {
+		path = stmt.ColumnText(0)
+		return nil
+	})
+	return path, err
+}
+
+// Open a separate connection to the main database file of the given connection,
+// read-only if asked. In-memory and temporary databases can't be shared between
+// connections, so they error.
+func openDatabase(conn *sqlite.Conn, readOnly bool) (*database, error) {
+	path, err := databasePath(conn)
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return nil, errNoDatabaseFile
+	}
+
+	flags := C.SQLITE_OPEN_READWRITE
+	if readOnly {
+		flags = C.SQLITE_OPEN_READONLY
+	}
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+	var db *C.sqlite3
+	if rc := C.database_open(cpath, &db, C.int(flags|C.SQLITE_OPEN_FULLMUTEX)); rc != C.SQLITE_OK {
+		err := fmt.Errorf("error opening %s: %s", path, C.GoString(C.database_errmsg(db)))
+		C.database_close(db)
+		return nil, err
+	}
+	C.database_busy_timeout(db, C.int(databaseBusyTimeout/time.Millisecond))
+	return &database{db: db}, nil
+}
+
+func (d *database) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.db != nil {
+		C.database_close(d.db)
+		d.db = nil
+	}
+}
+
+func (d *database) error() error {
+	if C.database_errcode(d.db) == C.SQLITE_BUSY {
+		return errDatabaseBusy
+	}
+	return errors.New(C.GoString(C.database_errmsg(d.db)))
+}
+
+// Prepare the given statement, which stays usable until the database is closed
+func (d *database) prepare(sql string) (*databaseStmt, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.db == nil {
+		return nil, errDatabaseClosed
+	}
+	csql := C.CString(sql)
+	defer C.free(unsafe.Pointer(csql))
+	var stmt *C.sqlite3_stmt
+	if rc := C.database_prepare(d.db, csql, &stmt); rc != C.SQLITE_OK {
+		return nil, d.error()
+	}
+	if stmt == nil {
+		return nil, errors.New("empty statement")
+	}
+	return &databaseStmt{database: d, stmt: stmt}, nil
+}
+
+// Run the given SQL with the given arguments bound in order, calling fn with
+// every row, like sqlite.Conn.Exec
+func (d *database) exec(sql string, fn func(*databaseStmt) error, args ...interface{}) error {
+	stmt, err := d.prepare(sql)
+	if err != nil {
+		return err
+	}
+	defer stmt.finalize()
+	for i, arg := range args {
+		if err := stmt.bind(i+1, arg); err != nil {
+			return err
+		}
+	}
+	return stmt.run(fn)
+}
+
+// Run the given INSERT, UPDATE, or DELETE with the given arguments bound in
+// order, returning the number of rows it changed
+func (d *database) update(sql string, args ...interface{}) (int, error) {
+	stmt, err := d.prepare(sql)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.finalize()
+	for i, arg := range args {
+		if err := stmt.bind(i+1, arg); err != nil {
+			return 0, err
+		}
+	}
+	err = stmt.run(nil)
+	return stmt.changes, err
+}
+
+// A statement prepared on a separate database connection
+type databaseStmt struct {
+	database *database
+	stmt     *C.sqlite3_stmt
+	// rows changed by the last run, read while it still holds the connection
+	changes int
+}
+
+func (s *databaseStmt) finalize() {
+	s.database.mu.Lock()
+	defer s.database.mu.Unlock()
+	// statements outlive a connection closed with sqlite3_close_v2, until finalized
+	if s.stmt != nil {
+		C.database_finalize(s.stmt)
+	}
+	s.stmt = nil
+}
+
+// Whether the statement doesn't write to the database
+func (s *databaseStmt) readOnly() bool {
+	return C.database_stmt_readonly(s.stmt) != 0
+}
+
+// Names of the statement's parameters, by index starting at 1, "" for nameless ones
+func (s *databaseStmt) parameters() []string {
+	names := make([]string, C.database_bind_parameter_count(s.stmt))
+	for i := range names {
+		if name := C.database_bind_parameter_name(s.stmt, C.int(i+1)); name != nil {
+			names[i] = C.GoString(name)
+		}
+	}
+	return names
+}
+
+// Bind the given value to the parameter at index i, starting at 1
+func (s *databaseStmt) bind(i int, value interface{}) error {
+	s.database.mu.Lock()
+	defer s.database.mu.Unlock()
+	if s.database.db == nil {
+		return errDatabaseClosed
+	}
+	var rc C.int
+	switch v := value.(type) {
+	case nil:
+		rc = C.database_bind_null(s.stmt, C.int(i))
+	case int:
+		rc = C.database_bind_int64(s.stmt, C.int(i), C.sqlite3_int64(v))
+	case int64:
+		rc = C.database_bind_int64(s.stmt, C.int(i), C.sqlite3_int64(v))
+	case float64:
+		rc = C.database_bind_double(s.stmt, C.int(i), C.double(v))
+	case bool:
+		var n int64
+		if v {
+			n = 1
+		}
+		rc = C.database_bind_int64(s.stmt, C.int(i), C.sqlite3_int64(n))
+	case string:
+		cv := C.CString(v)
+		defer C.free(unsafe.Pointer(cv))
+		rc = C.database_bind_text(s.stmt, C.int(i), cv, C.int(len(v)))
+	case []byte:
+		var p unsafe.Pointer
+		if len(v) > 0 {
+			p = C.CBytes(v)
+			defer C.free(p)
+		}
+		rc = C.database_bind_blob(s.stmt, C.int(i), p, C.int(len(v)))
+	default:
+		return fmt.Errorf("can't bind a %T", value)
+	}
+	if rc != C.SQLITE_OK {
+		return s.database.error()
+	}
+	return nil
+}
+
+// Step through every row, calling fn with each, then reset the statement and
+// its bindings so it can be run again
+func (s *databaseStmt) run(fn func(*databaseStmt) error) error {
+	s.database.mu.Lock()
+	defer s.database.mu.Unlock()
+	if s.database.db == nil {
+		return errDatabaseClosed
+	}
+	defer C.database_reset(s.stmt)
+	for {
+		switch rc := C.database_step(s.stmt); rc {
+		case C.SQLITE_ROW:
+			if fn != nil {
+				if err := fn(s); err != nil {
+					return err
+				}
+			}
+		case C.SQLITE_DONE:
+			s.changes = int(C.database_changes(s.database.db))
+			return nil
+		default:
+			return s.database.error()
+		}
+	}
+}
+
+func (s *databaseStmt) columnCount() int {
+	return int(C.database_column_count(s.stmt))
+}
+
+func (s *databaseStmt) columnName(i int) string {
+	return C.GoString(C.database_column_name(s.stmt, C.int(i)))
+}
+
+// The value of the column at index i, starting at 0, as nil, int64, float64, string, or []byte
+func (s *databaseStmt) column(i int) interface{} {
+	switch C.database_column_type(s.stmt, C.int(i)) {
+	case C.SQLITE_INTEGER:
+		return int64(C.database_column_int64(s.stmt, C.int(i)))
+	case C.SQLITE_FLOAT:
+		return float64(C.database_column_double(s.stmt, C.int(i)))
+	case C.SQLITE_TEXT:
+		n := C.database_column_bytes(s.stmt, C.int(i))
+		return C.GoStringN((*C.char)(unsafe.Pointer(C.database_column_text(s.stmt, C.int(i)))), n)
+	case C.SQLITE_BLOB:
+		n := C.database_column_bytes(s.stmt, C.int(i))
+		return C.GoBytes(C.database_column_blob(s.stmt, C.int(i)), n)
+	default:
+		return nil
+	}
+}
+
+func (s *databaseStmt) columnText(i int) string {
+	switch v := s.column(i).(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (s *databaseStmt) columnInt64(i int) int64 {
+	return int64(C.database_column_int64(s.stmt, C.int(i)))
+}
+
+func (s *databaseStmt) columnBlob(i int) []byte {
+	switch v := s.column(i).(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	default:
+		return nil
+	}
+}
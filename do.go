@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -14,7 +15,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/augmentable-dev/vtab"
+	"github.com/asg017/sqlite-http/internal/vtab"
 	"go.riyazali.net/sqlite"
 )
 
@@ -36,6 +37,8 @@ func resultResponseBody(client *http.Client, request *http.Request, ctx *sqlite.
 		return
 	}
 
+	defer response.Body.Close()
+
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
 		ctx.ResultError(err)
@@ -52,238 +55,128 @@ func resultResponseHeaders(client *http.Client, request *http.Request, ctx *sqli
 		ctx.ResultError(err)
 		return
 	}
+	// the body is never read, so close it right away
+	response.Body.Close()
 	buf := new(bytes.Buffer)
 	response.Header.Write(buf)
 	ctx.ResultText(buf.String())
 }
 
-/* http_do_body(method, url, headers, body, cookies)
-* Perform a HTTP request with the given method, URL, headers,
-* body, and cookies. Returns the HTTP body as a BLOB, errors if fails.
- */
-type HttpDoBodyFunc struct{}
-
-func (*HttpDoBodyFunc) Deterministic() bool { return true }
-func (*HttpDoBodyFunc) Args() int           { return -1 }
-func (*HttpDoBodyFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
-
-	if len(values) < 2 || len(values) > 5 {
-		c.ResultError(errors.New("usage: http_do_body(method, url, headers, body, cookies)"))
-		return
-	}
-
-	method := values[0].Text()
-	url := values[1].Text()
-	var headers string
-	var cookies string
-	var body []byte
-
-	if len(values) >= 3 {
-		headers = values[2].Text()
-	}
-
-	if len(values) >= 4 {
-		body = values[3].Blob()
-	}
-	if len(values) >= 5 {
-		cookies = values[4].Text()
-	}
-
-	client, request, err := prepareRequest(&PrepareRequestParams{method: method, url: url, headers: headers, body: body, cookies: cookies})
+// Give the result of the given HTTP request as a SQLite response, the body decoded
+// into UTF-8 text using the response's charset, or the given charset if not empty
+func resultResponseText(client *http.Client, request *http.Request, ctx *sqlite.Context, charset string) {
+	response, err := client.Do(request)
 
 	if err != nil {
-		c.ResultError(err)
-		return
-	}
-
-	resultResponseBody(client, request, c)
-
-}
-
-/* http_post_body(url, headers, body, cookies)
-* Perform a POST request with the given URL, headers,
-* body, and cookies. Returns the HTTP body as a BLOB, errors if fails.
- */
-type HttpPostBodyFunc struct{}
-
-func (*HttpPostBodyFunc) Deterministic() bool { return true }
-func (*HttpPostBodyFunc) Args() int           { return -1 }
-func (*HttpPostBodyFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
-
-	if len(values) < 1 || len(values) > 4 {
-		c.ResultError(errors.New("usage: http_post_body(url, headers, body, cookies)"))
+		ctx.ResultError(err)
 		return
 	}
 
-	url := values[0].Text()
-	var headers string
-	var cookies string
-	var body []byte
-
-	if len(values) >= 2 {
-		headers = values[1].Text()
-	}
-
-	if len(values) >= 3 {
-		body = values[2].Blob()
-	}
-	if len(values) >= 4 {
-		cookies = values[3].Text()
-	}
+	defer response.Body.Close()
 
-	client, request, err := prepareRequest(&PrepareRequestParams{method: "POST", url: url, headers: headers, body: body, cookies: cookies})
+	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		c.ResultError(err)
-		return
-	}
-
-	resultResponseBody(client, request, c)
-}
-
-/* http_get_body(url, headers, cookies)
-* Perform a HTTP request with the given URL, headers, and cookies.
-* Returns the HTTP body as a BLOB, errors if fails.
- */
-type HttpGetBodyFunc struct{}
-
-func (*HttpGetBodyFunc) Deterministic() bool { return true }
-func (*HttpGetBodyFunc) Args() int           { return -1 }
-func (*HttpGetBodyFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
-
-	if len(values) < 1 || len(values) > 3 {
-		c.ResultError(errors.New("usage: http_get_body(url, headers, cookies)"))
+		ctx.ResultError(err)
 		return
 	}
-
-	url := values[0].Text()
-	var headers string
-	var cookies string
-
-	if len(values) >= 2 {
-		headers = values[1].Text()
-	}
-
-	if len(values) >= 3 {
-		cookies = values[2].Text()
-	}
-
-	client, request, err := prepareRequest(&PrepareRequestParams{method: "GET", url: url, headers: headers, body: nil, cookies: cookies})
+	text, err := decodeText(body, response.Header.Get("Content-Type"), charset)
 	if err != nil {
-		c.ResultError(err)
+		ctx.ResultError(err)
 		return
 	}
-
-	resultResponseBody(client, request, c)
+	ctx.ResultText(text)
 }
 
-/* http_get_headers(url, headers, body, cookies)
-* Perform a GET request on the given URL, headers, body, and cookies.
-* Returns the HTTP response headers in wire format, errors if fails.
- */
-type HttpGetHeadersFunc struct{}
-
-func (*HttpGetHeadersFunc) Deterministic() bool { return true }
-func (*HttpGetHeadersFunc) Args() int           { return -1 }
-func (*HttpGetHeadersFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
+// What a request function returns from the response
+type requestResult int
 
-	if len(values) < 1 || len(values) > 3 {
-		c.ResultError(errors.New("usage: http_get_headers(url, headers, cookies)"))
-		return
-	}
-
-	url := values[0].Text()
-	var headers string
-	var cookies string
-
-	if len(values) >= 2 {
-		headers = values[1].Text()
-	}
-
-	if len(values) >= 3 {
-		cookies = values[2].Text()
-	}
+const (
+	// the body as a BLOB
+	resultBody requestResult = iota
+	// the body decoded into UTF-8 TEXT
+	resultText
+	// the headers in wire format, without reading the body
+	resultHeaders
+)
 
-	client, request, err := prepareRequest(&PrepareRequestParams{method: "GET", url: url, headers: headers, body: nil, cookies: cookies})
-	if err != nil {
-		c.ResultError(err)
-		return
-	}
+// Arguments of the request functions, in the order they're taken
+var (
+	doArgs      = []string{"method", "url", "headers", "body", "cookies"}
+	doTextArgs  = []string{"method", "url", "headers", "body", "cookies", "charset"}
+	bodyArgs    = []string{"url", "headers", "body", "cookies"}
+	noBodyArgs  = []string{"url", "headers", "cookies"}
+	getTextArgs = []string{"url", "headers", "cookies", "charset"}
+)
 
-	resultResponseHeaders(client, request, c)
+/* http_get_body(url, [headers], [cookies]), http_post_body(url, [headers], [body], [cookies]), etc.
+* Perform a HTTP request with the given arguments, every one after url optional.
+* Returns the response body, text, or headers, errors if fails.
+ */
+type HttpRequestFunc struct {
+	name string
+	// method of every request, or "" to take it from the "method" argument
+	method string
+	args   []string
+	result requestResult
+	// true for the http_no_network entrypoint, which only mocks can answer
+	noNetwork  bool
+	connection *connection
 }
 
-// http_post_headers(url, headers, body, cookies)
-type HttpPostHeadersFunc struct{}
-
-func (*HttpPostHeadersFunc) Deterministic() bool { return true }
-func (*HttpPostHeadersFunc) Args() int           { return -1 }
-func (*HttpPostHeadersFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
-
-	if len(values) < 1 || len(values) > 4 {
-		c.ResultError(errors.New("usage: http_post_headers(url, headers, body, cookies)"))
-		return
+func (*HttpRequestFunc) Deterministic() bool { return false }
+func (*HttpRequestFunc) Args() int           { return -1 }
+func (f *HttpRequestFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	required := 0
+	for i, arg := range f.args {
+		if arg == "url" {
+			required = i + 1
+		}
 	}
-
-	url := values[0].Text()
-	var headers string
-	var cookies string
-	var body []byte
-
-	if len(values) >= 2 {
-		headers = values[1].Text()
+	if len(values) < required || len(values) > len(f.args) {
+		usage := make([]string, len(f.args))
+		for i, arg := range f.args {
+			usage[i] = arg
+			if i >= required {
+				usage[i] = "[" + arg + "]"
+			}
+		}
+		c.ResultError(fmt.Errorf("usage: %s(%s)", f.name, strings.Join(usage, ", ")))
+		return
 	}
 
-	if len(values) >= 3 {
-		body = values[2].Blob()
-	}
-	if len(values) >= 3 {
-		cookies = values[3].Text()
+	params := &PrepareRequestParams{method: f.method, noNetwork: f.noNetwork, connection: f.connection}
+	var charset string
+	for i, value := range values {
+		switch f.args[i] {
+		case "method":
+			params.method = value.Text()
+		case "url":
+			params.url = value.Text()
+		case "headers":
+			params.headers = value.Text()
+		case "body":
+			params.body = value.Blob()
+		case "cookies":
+			params.cookies = value.Text()
+		case "charset":
+			charset = value.Text()
+		}
 	}
 
-	client, request, err := prepareRequest(&PrepareRequestParams{method: "POST", url: url, headers: headers, body: body, cookies: cookies})
+	client, request, err := prepareRequest(params)
 	if err != nil {
 		c.ResultError(err)
-	}
-
-	resultResponseHeaders(client, request, c)
-}
-
-// http_do_headers(method, url, headers, body, cookies)
-type HttpDoHeadersFunc struct{}
-
-func (*HttpDoHeadersFunc) Deterministic() bool { return true }
-func (*HttpDoHeadersFunc) Args() int           { return -1 }
-func (*HttpDoHeadersFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
-
-	if len(values) < 2 || len(values) > 5 {
-		c.ResultError(errors.New("usage: http_do_headers(method, url, headers, body, cookies)"))
 		return
 	}
 
-	method := values[0].Text()
-	url := values[1].Text()
-	var headers string
-	var cookies string
-	var body []byte
-
-	if len(values) >= 3 {
-		headers = values[2].Text()
-	}
-
-	if len(values) >= 4 {
-		body = values[3].Blob()
-	}
-	if len(values) >= 5 {
-		cookies = values[4].Text()
-	}
-
-	client, request, err := prepareRequest(&PrepareRequestParams{method: method, url: url, headers: headers, body: body, cookies: cookies})
-
-	if err != nil {
-		c.ResultError(err)
+	switch f.result {
+	case resultBody:
+		resultResponseBody(client, request, c)
+	case resultText:
+		resultResponseText(client, request, c, charset)
+	case resultHeaders:
+		resultResponseHeaders(client, request, c)
 	}
-
-	resultResponseHeaders(client, request, c)
 }
 
 var SharedDoTableColumns = []vtab.Column{
@@ -299,31 +192,34 @@ var SharedDoTableColumns = []vtab.Column{
 	{Name: "response_headers", Type: sqlite.SQLITE_TEXT.String()},
 	{Name: "response_cookies", Type: sqlite.SQLITE_TEXT.String()},
 	{Name: "response_body", Type: sqlite.SQLITE_BLOB.String()},
+	{Name: "response_text", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "response_body_raw", Type: sqlite.SQLITE_BLOB.String()},
 	{Name: "remote_address", Type: sqlite.SQLITE_TEXT.String()},
 	{Name: "timings", Type: sqlite.SQLITE_TEXT.String()},
 	{Name: "meta", Type: sqlite.SQLITE_TEXT.String()},
 }
 
-var GetTableColumns = append([]vtab.Column{
-	{Name: "url", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
-	{Name: "headers", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
-	{Name: "cookies", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
-}, SharedDoTableColumns...)
-
-var PostTableColumns = append([]vtab.Column{
-	{Name: "url", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
-	{Name: "headers", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
-	{Name: "body", Type: sqlite.SQLITE_BLOB.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
-	{Name: "cookies", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
-}, SharedDoTableColumns...)
+// Columns of a request table function, with a hidden column for each of the
+// given arguments, then a hidden "charset" column to decode response_text
+// with. Only equality constraints are pushed down. IN constraints
+// are split into one Filter call per value, since the sqlite bindings don't
+// expose sqlite3_vtab_in
+func requestTableColumns(args []string) []vtab.Column {
+	args = append(args[:len(args):len(args)], "charset")
+	columns := make([]vtab.Column, 0, len(args)+len(SharedDoTableColumns))
+	for _, arg := range args {
+		columnType := sqlite.SQLITE_TEXT.String()
+		if arg == "body" {
+			columnType = sqlite.SQLITE_BLOB.String()
+		}
+		columns = append(columns, vtab.Column{Name: arg, Type: columnType, NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}})
+	}
+	return append(columns, SharedDoTableColumns...)
+}
 
-var DoTableColumns = append([]vtab.Column{
-	{Name: "method", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ,  OmitCheck: true}}},
-	{Name: "url", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ,  OmitCheck: true}}},
-	{Name: "headers", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ,  OmitCheck: true}}},
-	{Name: "body", Type: sqlite.SQLITE_BLOB.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ,  OmitCheck: true}}},
-	{Name: "cookies", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ,  OmitCheck: true}}},
-}, SharedDoTableColumns...)
+var GetTableColumns = requestTableColumns(noBodyArgs)
+var PostTableColumns = requestTableColumns(bodyArgs)
+var DoTableColumns = requestTableColumns(doArgs)
 
 type Timings struct {
 	Started           *time.Time
@@ -404,11 +300,35 @@ type PrepareRequestParams struct {
 	headers string
 	body    []byte
 	cookies string
+	// true for requests made from the http_no_network entrypoint, which only mocks can answer
+	noNetwork bool
+	// the connection the request is made from, whose log it goes into. nil for none
+	connection *connection
+	// true for requests made by a goroutine of their own, outside of SQLite's calls into the extension
+	background bool
+	// transport the request is finally sent with instead of http.DefaultTransport, if not nil
+	base http.RoundTripper
+	// true for responses read as a stream, for as long as it takes. The timeout
+	// then only applies to the response headers, and to each wait for more of the body
+	streaming bool
+	// true for streams that can stay quiet for any amount of time, like event
+	// streams, so the timeout only applies to the response headers
+	quiet bool
 }
 
 // helper functions around http.NewRequest, takes  headers/body in sqlite-http formats
 func prepareRequest(params *PrepareRequestParams) (*http.Client, *http.Request, error) {
-	bodyReader := bytes.NewReader(params.body)
+	body := params.body
+	var bodyEncoding string
+	if DoBodyCompression != "" && len(body) > 0 && (params.headers == "" || readHeader(params.headers).Get("Content-Encoding") == "") {
+		encoded, err := encodeBytes(body, []string{DoBodyCompression})
+		if err != nil {
+			return nil, nil, err
+		}
+		body = encoded
+		bodyEncoding = DoBodyCompression
+	}
+	bodyReader := bytes.NewReader(body)
 
 	request, err := http.NewRequest(params.method, params.url, bodyReader)
 	if err != nil {
@@ -431,6 +351,9 @@ func prepareRequest(params *PrepareRequestParams) (*http.Client, *http.Request,
 		}
 
 	}
+	if bodyEncoding != "" {
+		request.Header.Set("Content-Encoding", bodyEncoding)
+	}
 	if params.cookies != "" {
 		var parsed map[string]string
 		err := json.Unmarshal([]byte(params.cookies), &parsed)
@@ -448,12 +371,117 @@ func prepareRequest(params *PrepareRequestParams) (*http.Client, *http.Request,
 	client := &http.Client{
 		Timeout: DoTimeout,
 	}
+	// archived responses are as received, logged responses are as returned to SQLite
+	var transport http.RoundTripper = http.DefaultTransport
+	if params.base != nil {
+		transport = params.base
+	}
+	if params.noNetwork {
+		transport = noNetworkTransport{}
+	}
+	if DoCassette != nil {
+		transport = &cassetteTransport{base: transport, cassette: DoCassette}
+	}
+	if params.noNetwork || DoMocks.active() {
+		transport = &mockTransport{base: transport, registry: DoMocks}
+	}
+	if DoFaults.active() {
+		transport = &faultTransport{base: transport, registry: DoFaults}
+	}
+	if warc := warcWriterInUse(); warc != nil {
+		transport = &warcTransport{base: transport, writer: warc, streaming: params.streaming}
+	}
+	if DoDecompress {
+		transport = &decompressTransport{base: transport}
+	}
+	// requests made in the background are logged through a separate connection, if the database has a file
+	if log := params.connection.requestLog(); log != nil && (!params.background || log.background != nil) {
+		transport = &loggingTransport{base: transport, log: log, background: params.background}
+	}
+	// while memoizing, identical requests share a single response. Streamed
+	// responses are read as they arrive, so they can't be
+	memoized := !params.streaming && DoMemo.active()
+	if memoized {
+		transport = &memoTransport{base: transport, registry: DoMemo}
+	}
+	if params.streaming {
+		client.Timeout = 0
+		transport = &streamTimeoutTransport{base: transport, timeout: DoTimeout, headersOnly: params.quiet}
+	}
+	client.Transport = transport
 
-	// block to rate limit properly
-	<-DoTicker.C
+	// block to rate limit properly. Memoized requests wait when they're made
+	// instead, unless answered by an identical request
+	if !memoized {
+		<-DoTicker.C
+	}
 	return client, request, nil
 }
 
+var errStreamTimeout = errors.New("timed out waiting for the response")
+
+// A http.RoundTripper for responses streamed for as long as it takes, where
+// the timeout applies to waiting for the response headers, and to each read
+// of the body instead of the whole response
+type streamTimeoutTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+	// true to only apply the timeout to the response headers
+	headersOnly bool
+}
+
+func (t *streamTimeoutTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if t.timeout <= 0 {
+		return t.base.RoundTrip(request)
+	}
+	ctx, cancel := context.WithCancelCause(request.Context())
+	timer := time.AfterFunc(t.timeout, func() { cancel(errStreamTimeout) })
+	response, err := t.base.RoundTrip(request.WithContext(ctx))
+	timer.Stop()
+	if err != nil {
+		cancel(nil)
+		if context.Cause(ctx) == errStreamTimeout {
+			return nil, errStreamTimeout
+		}
+		return nil, err
+	}
+	body := &streamTimeoutBody{ReadCloser: response.Body, ctx: ctx, cancel: cancel, timer: timer}
+	if !t.headersOnly {
+		body.timeout = t.timeout
+	}
+	response.Body = body
+	return response, nil
+}
+
+type streamTimeoutBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	timer  *time.Timer
+	// how long each read may wait, 0 for as long as it takes
+	timeout time.Duration
+}
+
+func (b *streamTimeoutBody) Read(p []byte) (int, error) {
+	if b.timeout <= 0 {
+		return b.ReadCloser.Read(p)
+	}
+	b.timer.Reset(b.timeout)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	if err != nil && context.Cause(b.ctx) == errStreamTimeout {
+		return n, errStreamTimeout
+	}
+	return n, err
+}
+
+func (b *streamTimeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.ReadCloser.Close()
+	b.cancel(nil)
+	return err
+}
+
 type HttpDoCursor struct {
 	current int
 
@@ -467,6 +495,10 @@ type HttpDoCursor struct {
 	RemoteAddr string
 
 	response_body []byte
+	// the response body before decompression, for response_body_raw
+	raw rawBody
+	// charset to decode response_text with instead of the response's, if not empty
+	charset string
 
 	columns []vtab.Column
 }
@@ -486,6 +518,8 @@ func (cur *HttpDoCursor) Column(ctx vtab.Context, c int) error {
 		ctx.ResultText("")
 	case "cookies":
 		ctx.ResultText("")
+	case "charset":
+		ctx.ResultText("")
 
 	case "request_url":
 		ctx.ResultText(cur.request.URL.String())
@@ -533,24 +567,34 @@ func (cur *HttpDoCursor) Column(ctx vtab.Context, c int) error {
 			ctx.ResultText(string(buf))
 		}
 	case "response_body":
-		if cur.response_body == nil {
-			start := time.Now()
-			cur.timing.BodyStart = &start
-
-			body, err := ioutil.ReadAll(cur.response.Body)
-			end := time.Now()
-			cur.timing.BodyEnd = &end
-
-			if err != nil {
-				ctx.ResultError(err)
-			} else {
-				ctx.ResultBlob(body)
-				cur.response_body = body
-			}
+		body, err := cur.readBody()
+		if err != nil {
+			ctx.ResultError(err)
 		} else {
-			ctx.ResultBlob(cur.response_body)
+			ctx.ResultBlob(body)
 		}
 
+	case "response_text":
+		body, err := cur.readBody()
+		if err != nil {
+			ctx.ResultError(err)
+			return nil
+		}
+		text, err := decodeText(body, cur.response.Header.Get("Content-Type"), cur.charset)
+		if err != nil {
+			ctx.ResultError(err)
+		} else {
+			ctx.ResultText(text)
+		}
+	case "response_body_raw":
+		body, err := cur.readBody()
+		if err != nil {
+			ctx.ResultError(err)
+		} else if cur.raw.decoded {
+			ctx.ResultBlob(cur.raw.bytes.Bytes())
+		} else {
+			ctx.ResultBlob(body)
+		}
 	case "remote_address":
 		ctx.ResultText(cur.RemoteAddr)
 	case "timings":
@@ -566,6 +610,25 @@ func (cur *HttpDoCursor) Column(ctx vtab.Context, c int) error {
 	return nil
 }
 
+// Read the entire response body into memory on first access, recording timings
+func (cur *HttpDoCursor) readBody() ([]byte, error) {
+	if cur.response_body != nil {
+		return cur.response_body, nil
+	}
+	start := time.Now()
+	cur.timing.BodyStart = &start
+
+	body, err := ioutil.ReadAll(cur.response.Body)
+	end := time.Now()
+	cur.timing.BodyEnd = &end
+
+	if err != nil {
+		return nil, err
+	}
+	cur.response_body = body
+	return body, nil
+}
+
 // one row for now
 func (cur *HttpDoCursor) Next() (vtab.Row, error) {
 	cur.current += 1
@@ -575,137 +638,60 @@ func (cur *HttpDoCursor) Next() (vtab.Row, error) {
 	return cur, nil
 }
 
-func GetTableIterator(constraints []*vtab.Constraint, order []*sqlite.OrderBy) (vtab.Iterator, error) {
-	var headers string
-	var cookies string
-	url := ""
-
-	for _, constraint := range constraints {
-		if constraint.Op == sqlite.INDEX_CONSTRAINT_EQ {
-			column := GetTableColumns[constraint.ColIndex]
-			switch column.Name {
-			case "url":
-				url = constraint.Value.Text()
-			case "headers":
-				headers = constraint.Value.Text()
-			case "cookies":
-				cookies = constraint.Value.Text()
-			}
-		}
-	}
-
-	cursor := HttpDoCursor{
-		columns: GetTableColumns,
-	}
-	client, request, err := prepareRequest(&PrepareRequestParams{method: "GET", url: url, headers: headers, body: nil, cookies: cookies})
-	if err != nil {
-		return nil, sqlite.SQLITE_ERROR
-	}
-
-	request = traceAndInclude(request, &cursor)
-
-	started := time.Now()
-	cursor.timing.Started = &started
-
-	response, err := client.Do(request)
-	if err != nil {
-		return nil, sqlite.SQLITE_ERROR
-	}
-
-	cursor.current = -1
-	cursor.request = request
-	cursor.response = response
-
-	return &cursor, nil
+// Close the response body, which is left unread unless a column needs it
+func (cur *HttpDoCursor) Close() error {
+	return cur.response.Body.Close()
 }
 
-func PostTableIterator(constraints []*vtab.Constraint, order []*sqlite.OrderBy) (vtab.Iterator, error) {
-	var headers string
-	var cookies string
-	var body []byte
-	url := ""
+// Make a request with the given method, or the "method" column if "", from the
+// hidden columns constrained in a request table function
+func RequestTableIterator(connection *connection, method string, columns []vtab.Column, constraints []*vtab.Constraint, noNetwork bool) (vtab.Iterator, error) {
+	params := &PrepareRequestParams{method: method, noNetwork: noNetwork, connection: connection}
+	var charset string
 
 	for _, constraint := range constraints {
 		if constraint.Op == sqlite.INDEX_CONSTRAINT_EQ {
-			column := PostTableColumns[constraint.ColIndex]
+			column := columns[constraint.ColIndex]
 			switch column.Name {
+			case "method":
+				params.method = constraint.Value.Text()
 			case "url":
-				url = constraint.Value.Text()
+				params.url = constraint.Value.Text()
 			case "headers":
-				headers = constraint.Value.Text()
+				params.headers = constraint.Value.Text()
 			case "body":
-				body = constraint.Value.Blob()
+				params.body = constraint.Value.Blob()
 			case "cookies":
-				cookies = constraint.Value.Text()
+				params.cookies = constraint.Value.Text()
+			case "charset":
+				charset = constraint.Value.Text()
 			}
 		}
 	}
 
-	cursor := HttpDoCursor{
-		columns: PostTableColumns,
-	}
-	client, request, err := prepareRequest(&PrepareRequestParams{method: "POST", url: url, headers: headers, body: body, cookies: cookies})
+	cursor, err := newHttpDoCursor(params, columns)
 	if err != nil {
-		return nil, fmt.Errorf("error preparing request: %s", err)
+		return nil, err
 	}
-
-	request = traceAndInclude(request, &cursor)
-
-	started := time.Now()
-	cursor.timing.Started = &started
-
-	response, err := client.Do(request)
-
-	// TODO make this configurable. I don't want it to always error
-	// if there's some connection error, but maybe other want that
-	if err != nil {
-		return nil, fmt.Errorf("error on client.Do: %s", err)
-	}
-
-	cursor.current = -1
-	cursor.request = request
-	cursor.response = response
-
-	return &cursor, nil
+	cursor.charset = charset
+	return cursor, nil
 }
 
-func DoTableIterator(constraints []*vtab.Constraint, order []*sqlite.OrderBy) (vtab.Iterator, error) {
-	var method string
-	var headers string
-	var cookies string
-	var body []byte
-	url := ""
-
-	for _, constraint := range constraints {
-		if constraint.Op == sqlite.INDEX_CONSTRAINT_EQ {
-			column := DoTableColumns[constraint.ColIndex]
-			switch column.Name {
-			case "method":
-				method = constraint.Value.Text()
-			case "url":
-				url = constraint.Value.Text()
-			case "headers":
-				headers = constraint.Value.Text()
-			case "body":
-				body = constraint.Value.Blob()
-			case "cookies":
-				cookies = constraint.Value.Text()
-			}
-		}
-	}
-
+// Prepare and perform a HTTP request with the given params, returning a cursor
+// for a single row of the given columns on the request and response.
+func newHttpDoCursor(params *PrepareRequestParams, columns []vtab.Column) (*HttpDoCursor, error) {
 	cursor := HttpDoCursor{
-		columns: DoTableColumns,
+		columns: columns,
 	}
-	client, request, err := prepareRequest(&PrepareRequestParams{method: method, url: url, headers: headers, body: body, cookies: cookies})
+	client, request, err := prepareRequest(params)
 	if err != nil {
 		return nil, fmt.Errorf("error preparing request: %s", err)
 	}
 
-	request = traceAndInclude(request, &cursor)
+	request = withRawBody(traceAndInclude(request, &cursor), &cursor.raw)
 
-	t := time.Now()
-	cursor.timing.Started = &t
+	started := time.Now()
+	cursor.timing.Started = &started
 
 	response, err := client.Do(request)
 	if err != nil {
@@ -722,55 +708,59 @@ func DoTableIterator(constraints []*vtab.Constraint, order []*sqlite.OrderBy) (v
 // For the given HTTP request, write all timing info to the given
 // cursor's "timing" object, so we can surface as a column later
 func traceAndInclude(request *http.Request, cursor *HttpDoCursor) *http.Request {
+	trace := newTimingTrace(&cursor.timing, &cursor.RemoteAddr)
+	return request.WithContext(httptrace.WithClientTrace(request.Context(), trace))
+}
 
-	trace := &httptrace.ClientTrace{
+// A httptrace.ClientTrace that records the time of lower-level events into
+// timing, and the remote network address into remoteAddr
+func newTimingTrace(timing *Timings, remoteAddr *string) *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
 		GotFirstResponseByte: func() {
 			t := time.Now()
-			cursor.timing.FirstResponseByte = &t
+			timing.FirstResponseByte = &t
 		},
 
 		DNSStart: func(i httptrace.DNSStartInfo) {
 			t := time.Now()
-			cursor.timing.DNSStart = &t
+			timing.DNSStart = &t
 		},
 
 		DNSDone: func(i httptrace.DNSDoneInfo) {
 			t := time.Now()
-			cursor.timing.DNSDone = &t
+			timing.DNSDone = &t
 		},
 
 		ConnectStart: func(network string, addr string) {
 			t := time.Now()
-			cursor.timing.ConnectStart = &t
+			timing.ConnectStart = &t
 		},
 
 		ConnectDone: func(network, addr string, err error) {
 			t := time.Now()
-			cursor.timing.ConnectDone = &t
+			timing.ConnectDone = &t
 		},
 
 		GotConn: func(g httptrace.GotConnInfo) {
 			t := time.Now()
-			cursor.timing.GotConn = &t
-			cursor.RemoteAddr = g.Conn.RemoteAddr().String()
+			timing.GotConn = &t
+			*remoteAddr = g.Conn.RemoteAddr().String()
 		},
 		TLSHandshakeStart: func() {
 			t := time.Now()
-			cursor.timing.TLSHandshakeStart = &t
+			timing.TLSHandshakeStart = &t
 		},
 
 		TLSHandshakeDone: func(c tls.ConnectionState, e error) {
 			t := time.Now()
-			cursor.timing.TLSHandshakeDone = &t
+			timing.TLSHandshakeDone = &t
 		},
 
 		WroteHeaders: func() {
 			t := time.Now()
-			cursor.timing.WroteHeaders = &t
+			timing.WroteHeaders = &t
 		},
 	}
-	return request.WithContext(httptrace.WithClientTrace(request.Context(), trace))
-
 }
 
 // http_post_form_url_encoded(name1, value1, ...)
@@ -799,30 +789,73 @@ func (*HttpPostFormUrlEncoded) Apply(c *sqlite.Context, values ...sqlite.Value)
 
 // TODO HttpPostMultipartForm
 
-var DoModules = map[string]sqlite.Module{
-	"http_get":  vtab.NewTableFunc("http_get", GetTableColumns, GetTableIterator),
-	"http_post": vtab.NewTableFunc("http_post", PostTableColumns, PostTableIterator),
-	"http_do":   vtab.NewTableFunc("http_do", DoTableColumns, DoTableIterator),
-}
-var DoFunctions = map[string]sqlite.Function{
-	"http_get_body":             &HttpGetBodyFunc{},
-	"http_post_body":            &HttpPostBodyFunc{},
-	"http_do_body":              &HttpDoBodyFunc{},
-	"http_get_headers":          &HttpGetHeadersFunc{},
-	"http_post_headers":         &HttpPostHeadersFunc{},
-	"http_do_headers":           &HttpDoHeadersFunc{},
-	"http_post_form_urlencoded": &HttpPostFormUrlEncoded{},
-	"http_rate_limit":           &HttpRateLimit{},
-	"http_timeout_set":          &HttpTimeoutSet{},
-}
-
-func RegisterDo(api *sqlite.ExtensionApi) error {
-	for name, module := range DoModules {
+// Methods with their own request functions and table function, and whether they send a body
+var requestMethods = []struct {
+	method  string
+	hasBody bool
+}{
+	{"GET", false},
+	{"HEAD", false},
+	{"POST", true},
+	{"PUT", true},
+	{"PATCH", true},
+	{"DELETE", true},
+	{"OPTIONS", false},
+}
+
+// Table functions for making requests, answered only by mocks when noNetwork is true
+func doModules(connection *connection, noNetwork bool) map[string]sqlite.Module {
+	requestTable := func(name string, method string, args []string) sqlite.Module {
+		columns := requestTableColumns(args)
+		return vtab.NewTableFunc(name, columns, func(constraints []*vtab.Constraint, order []*sqlite.OrderBy) (vtab.Iterator, error) {
+			return RequestTableIterator(connection, method, columns, constraints, noNetwork)
+		})
+	}
+	modules := map[string]sqlite.Module{
+		"http_do": requestTable("http_do", "", doArgs),
+	}
+	for _, m := range requestMethods {
+		name := "http_" + strings.ToLower(m.method)
+		if m.hasBody {
+			modules[name] = requestTable(name, m.method, bodyArgs)
+		} else {
+			modules[name] = requestTable(name, m.method, noBodyArgs)
+		}
+	}
+	return modules
+}
+
+// Scalar functions for making requests, answered only by mocks when noNetwork is true
+func doFunctions(connection *connection, noNetwork bool) map[string]sqlite.Function {
+	functions := map[string]sqlite.Function{
+		"http_get_body":             &HttpRequestFunc{name: "http_get_body", method: "GET", args: noBodyArgs, result: resultBody, noNetwork: noNetwork, connection: connection},
+		"http_get_text":             &HttpRequestFunc{name: "http_get_text", method: "GET", args: getTextArgs, result: resultText, noNetwork: noNetwork, connection: connection},
+		"http_get_headers":          &HttpRequestFunc{name: "http_get_headers", method: "GET", args: noBodyArgs, result: resultHeaders, noNetwork: noNetwork, connection: connection},
+		"http_head":                 &HttpRequestFunc{name: "http_head", method: "HEAD", args: noBodyArgs, result: resultHeaders, noNetwork: noNetwork, connection: connection},
+		"http_options":              &HttpRequestFunc{name: "http_options", method: "OPTIONS", args: noBodyArgs, result: resultHeaders, noNetwork: noNetwork, connection: connection},
+		"http_do_body":              &HttpRequestFunc{name: "http_do_body", args: doArgs, result: resultBody, noNetwork: noNetwork, connection: connection},
+		"http_do_text":              &HttpRequestFunc{name: "http_do_text", args: doTextArgs, result: resultText, noNetwork: noNetwork, connection: connection},
+		"http_do_headers":           &HttpRequestFunc{name: "http_do_headers", args: doArgs, result: resultHeaders, noNetwork: noNetwork, connection: connection},
+		"http_post_form_urlencoded": &HttpPostFormUrlEncoded{},
+	}
+	for _, m := range requestMethods {
+		if !m.hasBody {
+			continue
+		}
+		name := "http_" + strings.ToLower(m.method)
+		functions[name+"_body"] = &HttpRequestFunc{name: name + "_body", method: m.method, args: bodyArgs, result: resultBody, noNetwork: noNetwork, connection: connection}
+		functions[name+"_headers"] = &HttpRequestFunc{name: name + "_headers", method: m.method, args: bodyArgs, result: resultHeaders, noNetwork: noNetwork, connection: connection}
+	}
+	return functions
+}
+
+func RegisterDo(api *sqlite.ExtensionApi, connection *connection, noNetwork bool) error {
+	for name, module := range doModules(connection, noNetwork) {
 		if err := api.CreateModule(name, module); err != nil {
 			return err
 		}
 	}
-	for name, function := range DoFunctions {
+	for name, function := range doFunctions(connection, noNetwork) {
 		if err := api.CreateFunction(name, function); err != nil {
 			return err
 		}
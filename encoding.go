@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"go.riyazali.net/sqlite"
+)
+
+// Split a Content-Encoding (or Accept-Encoding) header value into each
+// lowercased encoding, in the order they were applied. "identity" is dropped.
+func parseContentEncodings(value string) []string {
+	encodings := []string{}
+	for _, encoding := range strings.Split(value, ",") {
+		encoding = strings.ToLower(strings.TrimSpace(encoding))
+		if i := strings.IndexByte(encoding, ';'); i >= 0 {
+			encoding = strings.TrimSpace(encoding[:i])
+		}
+		if encoding == "" || encoding == "identity" {
+			continue
+		}
+		encodings = append(encodings, encoding)
+	}
+	return encodings
+}
+
+// Returns true if every given encoding can be decoded by sqlite-http
+func supportedEncodings(encodings []string) bool {
+	for _, encoding := range encodings {
+		switch encoding {
+		case "gzip", "x-gzip", "deflate", "br", "zstd":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Wrap the given reader with a decoder for a single encoding
+func newDecodingReader(r io.Reader, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		// "deflate" should be zlib-wrapped, but some servers send raw DEFLATE data
+		buffered := bufio.NewReader(r)
+		header, err := buffered.Peek(2)
+		if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			return zlib.NewReader(buffered)
+		}
+		return flate.NewReader(buffered), nil
+	case "br":
+		return io.NopCloser(brotli.NewReader(r)), nil
+	case "zstd":
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding: %s", encoding)
+}
+
+// A body that decodes the given encodings of the underlying body on first read
+type decodingBody struct {
+	body      io.ReadCloser
+	encodings []string
+	// receives a copy of the bytes of body before decoding, if not nil
+	raw io.Writer
+
+	reader  io.Reader
+	closers []io.Closer
+	err     error
+}
+
+func (d *decodingBody) Read(p []byte) (int, error) {
+	if d.reader == nil && d.err == nil {
+		var source io.Reader = d.body
+		if d.raw != nil {
+			source = io.TeeReader(d.body, d.raw)
+		}
+		d.reader, d.closers, d.err = decodeReader(source, d.encodings)
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	n, err := d.reader.Read(p)
+	// decoders can stop before the end of the underlying body, like a trailer
+	if err == io.EOF && d.raw != nil {
+		if _, err := io.Copy(d.raw, d.body); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+func (d *decodingBody) Close() error {
+	for _, closer := range d.closers {
+		closer.Close()
+	}
+	return d.body.Close()
+}
+
+// Decode the given reader with the given encodings, undoing them in reverse order
+func decodeReader(r io.Reader, encodings []string) (io.Reader, []io.Closer, error) {
+	closers := []io.Closer{}
+	for i := len(encodings) - 1; i >= 0; i-- {
+		decoder, err := newDecodingReader(r, encodings[i])
+		if err != nil {
+			for _, closer := range closers {
+				closer.Close()
+			}
+			return nil, nil, err
+		}
+		closers = append(closers, decoder)
+		r = decoder
+	}
+	return r, closers, nil
+}
+
+// Default limit on the size of data decoded by http_decompress, so small
+// "decompression bombs" can't exhaust memory
+const decompressDefaultLimit = 64 * 1024 * 1024
+
+// Decode the given data with the given encodings, in the order they were
+// applied. Fails if the decoded data is larger than limit bytes.
+func decodeBytes(data []byte, encodings []string, limit int64) ([]byte, error) {
+	reader, closers, err := decodeReader(bytes.NewReader(data), encodings)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, closer := range closers {
+			closer.Close()
+		}
+	}()
+	decoded, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(decoded)) > limit {
+		return nil, fmt.Errorf("decompressed data is larger than %d bytes", limit)
+	}
+	return decoded, nil
+}
+
+// Encode the given data with the given encodings, applied in order
+func encodeBytes(data []byte, encodings []string) ([]byte, error) {
+	for _, encoding := range encodings {
+		buf := new(bytes.Buffer)
+		var writer io.WriteCloser
+		var err error
+		switch encoding {
+		case "gzip", "x-gzip":
+			writer = gzip.NewWriter(buf)
+		case "deflate":
+			writer = zlib.NewWriter(buf)
+		case "br":
+			writer = brotli.NewWriter(buf)
+		case "zstd":
+			writer, err = zstd.NewWriter(buf)
+		default:
+			err = fmt.Errorf("unsupported content encoding: %s", encoding)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	}
+	return data, nil
+}
+
+// The bytes of a response body as received, before decompression, for the
+// response_body_raw column. Set on a request with withRawBody.
+type rawBody struct {
+	// true if the response was decompressed, so the bytes differ
+	decoded bool
+	bytes   bytes.Buffer
+}
+
+type rawBodyKey struct{}
+
+// Returns a copy of request that keeps the bytes of a decompressed response body in raw
+func withRawBody(request *http.Request, raw *rawBody) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), rawBodyKey{}, raw))
+}
+
+// A http.RoundTripper that decodes compressed responses when the request
+// sets its own Accept-Encoding header, which Go's transport won't do.
+type decompressTransport struct {
+	base http.RoundTripper
+}
+
+func (t *decompressTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := t.base.RoundTrip(request)
+	if err != nil || request.Header.Get("Accept-Encoding") == "" || request.Method == "HEAD" {
+		return response, err
+	}
+	encodings := parseContentEncodings(response.Header.Get("Content-Encoding"))
+	if len(encodings) == 0 || !supportedEncodings(encodings) {
+		return response, nil
+	}
+	body := &decodingBody{body: response.Body, encodings: encodings}
+	if raw, ok := request.Context().Value(rawBodyKey{}).(*rawBody); ok {
+		raw.decoded = true
+		body.raw = &raw.bytes
+	}
+	response.Body = body
+	response.Header.Del("Content-Encoding")
+	response.Header.Del("Content-Length")
+	response.ContentLength = -1
+	response.Uncompressed = true
+	return response, nil
+}
+
+/* http_decompress(data, encoding, [max_bytes])
+ * Decode the given BLOB with the given Content-Encoding header value, like
+ * 'gzip' or 'gzip, br'. Chained encodings are undone in reverse order.
+ * Fails if the decoded BLOB is larger than max_bytes, 64 MiB by default.
+ */
+type DecompressFunc struct{}
+
+func (*DecompressFunc) Deterministic() bool { return true }
+func (*DecompressFunc) Args() int           { return -1 }
+func (*DecompressFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	if len(values) < 2 || len(values) > 3 {
+		c.ResultError(fmt.Errorf("http_decompress() expects 2 or 3 arguments, got %d", len(values)))
+		return
+	}
+	if values[0].Type() == sqlite.SQLITE_NULL {
+		c.ResultNull()
+		return
+	}
+	limit := int64(decompressDefaultLimit)
+	if len(values) > 2 && values[2].Type() != sqlite.SQLITE_NULL {
+		limit = values[2].Int64()
+		if limit < 0 {
+			c.ResultError(fmt.Errorf("http_decompress() max_bytes must not be negative, got %d", limit))
+			return
+		}
+	}
+	data, err := decodeBytes(values[0].Blob(), parseContentEncodings(values[1].Text()), limit)
+	if err != nil {
+		c.ResultError(err)
+		return
+	}
+	c.ResultBlob(data)
+}
+
+/* http_compress(data, encoding)
+ * Encode the given BLOB with the given Content-Encoding header value, like
+ * 'gzip' or 'gzip, br'. Chained encodings are applied in order.
+ */
+type CompressFunc struct{}
+
+func (*CompressFunc) Deterministic() bool { return true }
+func (*CompressFunc) Args() int           { return 2 }
+func (*CompressFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	if values[0].Type() == sqlite.SQLITE_NULL {
+		c.ResultNull()
+		return
+	}
+	data, err := encodeBytes(values[0].Blob(), parseContentEncodings(values[1].Text()))
+	if err != nil {
+		c.ResultError(err)
+		return
+	}
+	c.ResultBlob(data)
+}
+
+func RegisterEncoding(api *sqlite.ExtensionApi) error {
+	if err := api.CreateFunction("http_decompress", &DecompressFunc{}); err != nil {
+		return err
+	}
+	if err := api.CreateFunction("http_compress", &CompressFunc{}); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.riyazali.net/sqlite"
+)
+
+// Fault injection rules applied to every request. Configurable with
+// http_fault_inject and http_fault_reset
+var DoFaults = &faultRegistry{}
+
+const (
+	// fail to connect with "connection refused"
+	faultRefused = "refused"
+	// never respond, until the request times out
+	faultTimeout = "timeout"
+	// wait value milliseconds before sending the request
+	faultLatency = "latency"
+	// fail reading the response body after value bytes
+	faultTruncate = "truncate"
+	// respond with the status code value, without sending the request
+	faultStatus = "status"
+)
+
+// Inject a fault into requests to hosts matching hostPattern, with the given probability
+type faultRule struct {
+	id          int64
+	hostPattern *regexp.Regexp
+	fault       string
+	rate        float64
+	value       int64
+}
+
+type faultRegistry struct {
+	rules  []*faultRule
+	nextId int64
+	mu     sync.Mutex
+}
+
+func (r *faultRegistry) active() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.rules) > 0
+}
+
+// Roll each rule matching the given request, returning the ones that should be injected
+func (r *faultRegistry) roll(request *http.Request) []*faultRule {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	injected := []*faultRule{}
+	for _, rule := range r.rules {
+		if rule.hostPattern.MatchString(request.URL.Hostname()) && rand.Float64() < rule.rate {
+			injected = append(injected, rule)
+		}
+	}
+	return injected
+}
+
+// A response body that fails with io.ErrUnexpectedEOF after limit bytes
+type truncatedBody struct {
+	body  io.ReadCloser
+	limit int64
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.limit <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > b.limit {
+		p = p[:b.limit]
+	}
+	n, err := b.body.Read(p)
+	b.limit -= int64(n)
+	return n, err
+}
+
+func (b *truncatedBody) Close() error {
+	return b.body.Close()
+}
+
+// A http.RoundTripper that injects faults into requests before they reach base,
+// which could be the network or mocks
+type faultTransport struct {
+	base     http.RoundTripper
+	registry *faultRegistry
+}
+
+func (t *faultTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	rules := t.registry.roll(request)
+
+	// latency applies before any other fault
+	for _, rule := range rules {
+		if rule.fault == faultLatency {
+			select {
+			case <-time.After(time.Duration(rule.value) * time.Millisecond):
+			case <-request.Context().Done():
+				return nil, request.Context().Err()
+			}
+		}
+	}
+
+	var truncate *faultRule
+	for _, rule := range rules {
+		switch rule.fault {
+		case faultRefused:
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+		case faultTimeout:
+			if _, ok := request.Context().Deadline(); !ok {
+				return nil, fmt.Errorf("injected timeout, but requests have no timeout")
+			}
+			<-request.Context().Done()
+			return nil, request.Context().Err()
+		case faultStatus:
+			status := int(rule.value)
+			body := []byte(http.StatusText(status))
+			return &http.Response{
+				Status:        strings.TrimSpace(fmt.Sprintf("%d %s", status, http.StatusText(status))),
+				StatusCode:    status,
+				Proto:         "HTTP/1.1",
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+				Body:          io.NopCloser(bytes.NewReader(body)),
+				ContentLength: int64(len(body)),
+				Request:       request,
+			}, nil
+		case faultTruncate:
+			truncate = rule
+		}
+	}
+
+	response, err := t.base.RoundTrip(request)
+	if err != nil || truncate == nil {
+		return response, err
+	}
+	response.Body = &truncatedBody{body: response.Body, limit: truncate.value}
+	return response, nil
+}
+
+/* http_fault_inject(host_pattern, fault, rate, [value])
+* Inject a fault into requests to hosts matching host_pattern, a glob like
+* '*.example.com', with the given probability between 0 and 1. fault is one of
+* 'refused', 'timeout', 'latency', 'truncate', or 'status'. Returns the rule ID.
+ */
+type HttpFaultInjectFunc struct{}
+
+func (*HttpFaultInjectFunc) Deterministic() bool { return false }
+func (*HttpFaultInjectFunc) Args() int           { return -1 }
+func (*HttpFaultInjectFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	if len(values) < 3 || len(values) > 4 {
+		c.ResultError(fmt.Errorf("usage: http_fault_inject(host_pattern, fault, rate, [value])"))
+		return
+	}
+	hostPattern, err := compileUrlPattern(values[0].Text())
+	if err != nil {
+		c.ResultError(err)
+		return
+	}
+	rule := &faultRule{
+		hostPattern: hostPattern,
+		fault:       values[1].Text(),
+		rate:        values[2].Float(),
+	}
+	if len(values) > 3 {
+		rule.value = values[3].Int64()
+	}
+
+	switch rule.fault {
+	case faultRefused, faultTimeout, faultTruncate:
+	case faultLatency:
+		if rule.value <= 0 {
+			c.ResultError(fmt.Errorf("the latency fault requires a delay in milliseconds"))
+			return
+		}
+	case faultStatus:
+		if rule.value < 100 || rule.value > 999 {
+			c.ResultError(fmt.Errorf("the status fault requires a status code, got %d", rule.value))
+			return
+		}
+	default:
+		c.ResultError(fmt.Errorf("unknown fault %q, expected 'refused', 'timeout', 'latency', 'truncate', or 'status'", rule.fault))
+		return
+	}
+	if rule.rate < 0 || rule.rate > 1 {
+		c.ResultError(fmt.Errorf("fault rate must be between 0 and 1, got %v", rule.rate))
+		return
+	}
+
+	DoFaults.mu.Lock()
+	DoFaults.nextId += 1
+	rule.id = DoFaults.nextId
+	DoFaults.rules = append(DoFaults.rules, rule)
+	DoFaults.mu.Unlock()
+
+	c.ResultInt64(rule.id)
+}
+
+/* http_fault_reset()
+* Remove all fault injection rules.
+ */
+type HttpFaultResetFunc struct{}
+
+func (*HttpFaultResetFunc) Deterministic() bool { return false }
+func (*HttpFaultResetFunc) Args() int           { return 0 }
+func (*HttpFaultResetFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	DoFaults.mu.Lock()
+	DoFaults.rules = nil
+	DoFaults.mu.Unlock()
+	c.ResultInt(1)
+}
+
+func RegisterFault(api *sqlite.ExtensionApi) error {
+	if err := api.CreateFunction("http_fault_inject", &HttpFaultInjectFunc{}); err != nil {
+		return err
+	}
+	if err := api.CreateFunction("http_fault_reset", &HttpFaultResetFunc{}); err != nil {
+		return err
+	}
+	return nil
+}
@@ -1,12 +1,14 @@
 module github.com/asg017/sqlite-http
 
-go 1.17
+go 1.22
 
 require (
-	github.com/augmentable-dev/vtab v0.0.0-20221005151137-0ff49e3f5413
+	github.com/andybalholm/brotli v1.1.1
+	github.com/gorilla/websocket v1.5.3
+	github.com/klauspost/compress v1.18.0
 	go.riyazali.net/sqlite v0.0.0-20230320080028-80a51d3944c0
+	golang.org/x/text v0.14.0
 
 )
 
 require github.com/mattn/go-pointer v0.0.1 // indirect
-replace github.com/augmentable-dev/vtab => github.com/asg017/vtab v0.0.0-20230324232018-972462994f23
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/asg017/sqlite-http/internal/vtab"
+	"go.riyazali.net/sqlite"
+)
+
+// HAR 1.2 document types, see http://www.softwareishard.com/blog/har-12-spec/
+type harDocument struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// Durations in milliseconds, -1 if the phase doesn't apply
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// Parse a timings column value back into Timings, the inverse of Timings.MarshalJSON
+func parseTimings(text string) (Timings, error) {
+	timing := Timings{}
+	if text == "" {
+		return timing, nil
+	}
+	tj := TimingJSON{}
+	if err := json.Unmarshal([]byte(text), &tj); err != nil {
+		return timing, fmt.Errorf("invalid timings: %s", err)
+	}
+	parse := func(s *string) *time.Time {
+		if s == nil {
+			return nil
+		}
+		t, err := time.Parse(sqliteDatetimeFormat, *s)
+		if err != nil {
+			return nil
+		}
+		return &t
+	}
+	timing.Started = parse(tj.Started)
+	timing.FirstResponseByte = parse(tj.FirstResponseByte)
+	timing.GotConn = parse(tj.GotConn)
+	timing.WroteHeaders = parse(tj.WroteHeaders)
+	timing.DNSStart = parse(tj.DNSStart)
+	timing.DNSDone = parse(tj.DNSDone)
+	timing.ConnectStart = parse(tj.ConnectStart)
+	timing.ConnectDone = parse(tj.ConnectDone)
+	timing.TLSHandshakeStart = parse(tj.TLSHandshakeStart)
+	timing.TLSHandshakeDone = parse(tj.TLSHandshakeDone)
+	timing.BodyStart = parse(tj.BodyStart)
+	timing.BodyEnd = parse(tj.BodyEnd)
+	return timing, nil
+}
+
+// Milliseconds between the given times, or -1 if either is missing
+func harDuration(from, to *time.Time) float64 {
+	if from == nil || to == nil {
+		return -1
+	}
+	ms := float64(to.Sub(*from).Microseconds()) / 1000
+	if ms < 0 {
+		return 0
+	}
+	return ms
+}
+
+// Returns the first of the given times that isn't nil
+func firstTime(times ...*time.Time) *time.Time {
+	for _, t := range times {
+		if t != nil {
+			return t
+		}
+	}
+	return nil
+}
+
+// Convert sqlite-http timings into HAR timings, and the total time of the request
+func harTimingsOf(timing Timings) (harTimings, float64) {
+	connectEnd := timing.ConnectDone
+	if timing.TLSHandshakeDone != nil {
+		connectEnd = timing.TLSHandshakeDone
+	}
+	t := harTimings{
+		Blocked: harDuration(timing.Started, firstTime(timing.DNSStart, timing.ConnectStart, timing.GotConn)),
+		DNS:     harDuration(timing.DNSStart, timing.DNSDone),
+		Connect: harDuration(timing.ConnectStart, connectEnd),
+		SSL:     harDuration(timing.TLSHandshakeStart, timing.TLSHandshakeDone),
+		Send:    harDuration(timing.GotConn, timing.WroteHeaders),
+		Wait:    harDuration(timing.WroteHeaders, timing.FirstResponseByte),
+		Receive: harDuration(timing.FirstResponseByte, timing.BodyEnd),
+	}
+	// send, wait, and receive are required to be non-negative
+	if t.Send < 0 {
+		t.Send = 0
+	}
+	if t.Wait < 0 {
+		t.Wait = 0
+	}
+	if t.Receive < 0 {
+		t.Receive = 0
+	}
+	total := 0.0
+	for _, ms := range []float64{t.Blocked, t.DNS, t.Connect, t.Send, t.Wait, t.Receive} {
+		if ms > 0 {
+			total += ms
+		}
+	}
+	return t, total
+}
+
+// Convert headers in wire format to HAR name/value pairs, sorted by name
+func harHeaders(rawHeader string) []harNameValue {
+	header := readHeader(rawHeader)
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := []harNameValue{}
+	for _, name := range names {
+		for _, value := range header[name] {
+			pairs = append(pairs, harNameValue{Name: name, Value: value})
+		}
+	}
+	return pairs
+}
+
+// Convert HAR name/value pairs to headers in wire format. HTTP/2 pseudo-headers
+// like ":authority" can't be sent as-is, so they're dropped.
+func wireHeaders(pairs []harNameValue) string {
+	header := http.Header{}
+	for _, pair := range pairs {
+		if strings.HasPrefix(pair.Name, ":") {
+			continue
+		}
+		header.Add(pair.Name, pair.Value)
+	}
+	buf := new(bytes.Buffer)
+	header.Write(buf)
+	return buf.String()
+}
+
+func harCookies(cookies []*http.Cookie) []harNameValue {
+	pairs := []harNameValue{}
+	for _, cookie := range cookies {
+		pairs = append(pairs, harNameValue{Name: cookie.Name, Value: cookie.Value})
+	}
+	return pairs
+}
+
+// Build a HAR entry from http_do-style column values
+func newHarEntry(method, rawUrl, requestHeaders string, requestBody []byte, status int, responseHeaders string, responseBody []byte, timings string, remoteAddr string) (harEntry, error) {
+	timing, err := parseTimings(timings)
+	if err != nil {
+		return harEntry{}, err
+	}
+	started := time.Now()
+	if timing.Started != nil {
+		started = *timing.Started
+	}
+	t, total := harTimingsOf(timing)
+
+	requestHeader := http.Header(readHeader(requestHeaders))
+	responseHeader := http.Header(readHeader(responseHeaders))
+
+	queryString := []harNameValue{}
+	if parsed, err := url.Parse(rawUrl); err == nil {
+		query := parsed.Query()
+		keys := make([]string, 0, len(query))
+		for key := range query {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			for _, value := range query[key] {
+				queryString = append(queryString, harNameValue{Name: key, Value: value})
+			}
+		}
+	}
+
+	entry := harEntry{
+		StartedDateTime: started.UTC().Format(time.RFC3339Nano),
+		Time:            total,
+		Request: harRequest{
+			Method:      method,
+			URL:         rawUrl,
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     harCookies((&http.Request{Header: requestHeader}).Cookies()),
+			Headers:     harHeaders(requestHeaders),
+			QueryString: queryString,
+			HeadersSize: -1,
+			BodySize:    len(requestBody),
+		},
+		Response: harResponse{
+			Status:      status,
+			StatusText:  http.StatusText(status),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     harCookies((&http.Response{Header: responseHeader}).Cookies()),
+			Headers:     harHeaders(responseHeaders),
+			Content: harContent{
+				Size:     len(responseBody),
+				MimeType: responseHeader.Get("Content-Type"),
+			},
+			RedirectURL: responseHeader.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    len(responseBody),
+		},
+		Timings: t,
+	}
+	if len(requestBody) > 0 {
+		entry.Request.PostData = &harPostData{
+			MimeType: requestHeader.Get("Content-Type"),
+			Text:     strings.ToValidUTF8(string(requestBody), "�"),
+		}
+	}
+	if utf8.Valid(responseBody) {
+		entry.Response.Content.Text = string(responseBody)
+	} else {
+		entry.Response.Content.Text = base64.StdEncoding.EncodeToString(responseBody)
+		entry.Response.Content.Encoding = "base64"
+	}
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		entry.ServerIPAddress = host
+	}
+	return entry, nil
+}
+
+/* http_har_export(request_method, request_url, request_headers, request_body, response_status_code, response_headers, response_body, timings, [remote_address])
+* An aggregate function that builds a HAR 1.2 document with one entry per row,
+* from the columns of http_do (or a http_log_to table).
+ */
+type HarExportFunc struct{}
+
+func (*HarExportFunc) Deterministic() bool { return true }
+func (*HarExportFunc) Args() int           { return -1 }
+func (*HarExportFunc) Step(c *sqlite.AggregateContext, values ...sqlite.Value) {
+	if len(values) < 8 || len(values) > 9 {
+		c.ResultError(fmt.Errorf("http_har_export() expects 8 or 9 arguments, got %d", len(values)))
+		return
+	}
+	if c.Data == nil {
+		c.Data = &harDocument{Log: harLog{
+			Version: "1.2",
+			Creator: harCreator{Name: "sqlite-http", Version: Version},
+			Entries: []harEntry{},
+		}}
+	}
+	document := c.Data.(*harDocument)
+
+	var remoteAddr string
+	if len(values) > 8 {
+		remoteAddr = values[8].Text()
+	}
+	entry, err := newHarEntry(
+		values[0].Text(),
+		values[1].Text(),
+		values[2].Text(),
+		values[3].Blob(),
+		values[4].Int(),
+		values[5].Text(),
+		values[6].Blob(),
+		values[7].Text(),
+		remoteAddr,
+	)
+	if err != nil {
+		c.ResultError(err)
+		return
+	}
+	document.Log.Entries = append(document.Log.Entries, entry)
+}
+func (*HarExportFunc) Final(c *sqlite.AggregateContext) {
+	document, ok := c.Data.(*harDocument)
+	if !ok {
+		c.ResultNull()
+		return
+	}
+	buf, err := json.Marshal(document)
+	if err != nil {
+		c.ResultError(err)
+		return
+	}
+	c.ResultText(string(buf))
+}
+
+/** select * from http_har_entries(har)
+ * A table function that yields one row per entry of a HAR document, like one
+ * exported from browser devtools, with columns named like http_do.
+ */
+var HarEntriesColumns = []vtab.Column{
+	{Name: "har", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "started_at", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "time", Type: sqlite.SQLITE_FLOAT.String()},
+	{Name: "request_method", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "request_url", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "request_http_version", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "request_headers", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "request_body", Type: sqlite.SQLITE_BLOB.String()},
+	{Name: "response_status", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "response_status_code", Type: sqlite.SQLITE_INTEGER.String()},
+	{Name: "response_headers", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "response_body", Type: sqlite.SQLITE_BLOB.String()},
+	{Name: "response_mime_type", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "remote_address", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "har_timings", Type: sqlite.SQLITE_TEXT.String()},
+}
+
+type HarEntriesCursor struct {
+	entries []harEntry
+	current int
+}
+
+func (cur *HarEntriesCursor) Column(ctx vtab.Context, c int) error {
+	col := HarEntriesColumns[c]
+	entry := cur.entries[cur.current]
+
+	switch col.Name {
+	case "started_at":
+		started, err := time.Parse(time.RFC3339Nano, entry.StartedDateTime)
+		if err != nil {
+			ctx.ResultText(entry.StartedDateTime)
+		} else {
+			ctx.ResultText(*formatSqliteDatetime(&started))
+		}
+	case "time":
+		ctx.ResultFloat(entry.Time)
+	case "request_method":
+		ctx.ResultText(entry.Request.Method)
+	case "request_url":
+		ctx.ResultText(entry.Request.URL)
+	case "request_http_version":
+		ctx.ResultText(entry.Request.HTTPVersion)
+	case "request_headers":
+		ctx.ResultText(wireHeaders(entry.Request.Headers))
+	case "request_body":
+		if entry.Request.PostData == nil {
+			ctx.ResultNull()
+		} else {
+			ctx.ResultBlob([]byte(entry.Request.PostData.Text))
+		}
+	case "response_status":
+		ctx.ResultText(strings.TrimSpace(fmt.Sprintf("%d %s", entry.Response.Status, entry.Response.StatusText)))
+	case "response_status_code":
+		ctx.ResultInt(entry.Response.Status)
+	case "response_headers":
+		ctx.ResultText(wireHeaders(entry.Response.Headers))
+	case "response_body":
+		content := entry.Response.Content
+		if content.Encoding == "base64" {
+			body, err := base64.StdEncoding.DecodeString(content.Text)
+			if err != nil {
+				return err
+			}
+			ctx.ResultBlob(body)
+		} else {
+			ctx.ResultBlob([]byte(content.Text))
+		}
+	case "response_mime_type":
+		mediaType, _, err := mime.ParseMediaType(entry.Response.Content.MimeType)
+		if err != nil {
+			ctx.ResultText(entry.Response.Content.MimeType)
+		} else {
+			ctx.ResultText(mediaType)
+		}
+	case "remote_address":
+		if entry.ServerIPAddress == "" {
+			ctx.ResultNull()
+		} else {
+			ctx.ResultText(entry.ServerIPAddress)
+		}
+	case "har_timings":
+		buf, err := json.Marshal(entry.Timings)
+		if err != nil {
+			return err
+		}
+		ctx.ResultText(string(buf))
+	}
+	return nil
+}
+
+func (cur *HarEntriesCursor) Next() (vtab.Row, error) {
+	cur.current += 1
+	if cur.current >= len(cur.entries) {
+		return nil, io.EOF
+	}
+	return cur, nil
+}
+
+func HarEntriesIterator(constraints []*vtab.Constraint, order []*sqlite.OrderBy) (vtab.Iterator, error) {
+	var har string
+	for _, constraint := range constraints {
+		if constraint.Op == sqlite.INDEX_CONSTRAINT_EQ {
+			column := HarEntriesColumns[constraint.ColIndex]
+			switch column.Name {
+			case "har":
+				har = constraint.Value.Text()
+			}
+		}
+	}
+
+	document := harDocument{}
+	if err := json.Unmarshal([]byte(har), &document); err != nil {
+		return nil, fmt.Errorf("invalid HAR document: %s", err)
+	}
+	return &HarEntriesCursor{entries: document.Log.Entries, current: -1}, nil
+}
+
+func RegisterHar(api *sqlite.ExtensionApi) error {
+	if err := api.CreateModule("http_har_entries", vtab.NewTableFunc("http_har_entries", HarEntriesColumns, HarEntriesIterator)); err != nil {
+		return err
+	}
+	if err := api.CreateFunction("http_har_export", &HarExportFunc{}); err != nil {
+		return err
+	}
+	return nil
+}
@@ -10,7 +10,7 @@ import (
 	"net/textproto"
 	"strings"
 
-	"github.com/augmentable-dev/vtab"
+	"github.com/asg017/sqlite-http/internal/vtab"
 	"go.riyazali.net/sqlite"
 )
 
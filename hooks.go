@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+)
+
+// SQLite only keeps a single commit hook and a single rollback hook per
+// connection, so everything that needs one registers here instead. Kept on
+// the connection, so they go away with it.
+type connHooks struct {
+	nextId   int64
+	commit   map[int64]func()
+	rollback map[int64]func()
+}
+
+var hooksMu sync.Mutex
+
+func hooksOf(c *connection) *connHooks {
+	if c.hooks != nil {
+		return c.hooks
+	}
+	hooks := &connHooks{commit: map[int64]func(){}, rollback: map[int64]func(){}}
+	c.hooks = hooks
+	c.conn.CommitHook(func() int {
+		hooksMu.Lock()
+		fns := make([]func(), 0, len(hooks.commit))
+		for _, fn := range hooks.commit {
+			fns = append(fns, fn)
+		}
+		hooksMu.Unlock()
+		for _, fn := range fns {
+			fn()
+		}
+		// 0 lets the commit go through
+		return 0
+	})
+	c.conn.RollbackHook(func() {
+		hooksMu.Lock()
+		fns := make([]func(), 0, len(hooks.rollback))
+		for _, fn := range hooks.rollback {
+			fns = append(fns, fn)
+		}
+		hooksMu.Unlock()
+		for _, fn := range fns {
+			fn()
+		}
+	})
+	return hooks
+}
+
+// Call onCommit after every commit on the given connection, and onRollback
+// after every rollback, either can be nil. Returns a function that removes both.
+func addTransactionHooks(c *connection, onCommit func(), onRollback func()) func() {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	hooks := hooksOf(c)
+	hooks.nextId += 1
+	id := hooks.nextId
+	if onCommit != nil {
+		hooks.commit[id] = onCommit
+	}
+	if onRollback != nil {
+		hooks.rollback[id] = onRollback
+	}
+	return func() {
+		hooksMu.Lock()
+		defer hooksMu.Unlock()
+		delete(hooks.commit, id)
+		delete(hooks.rollback, id)
+	}
+}
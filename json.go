@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/asg017/sqlite-http/internal/vtab"
+	"go.riyazali.net/sqlite"
+)
+
+// A single step in a JSON path like '$.data[0].items'. Either an object key
+// or an array index.
+type jsonPathStep struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// Parse a subset of SQLite's JSON path syntax: '$', '.key', '."quoted key"', and '[N]'
+func parseJsonPath(path string) ([]jsonPathStep, error) {
+	if path == "" {
+		path = "$"
+	}
+	if path[0] != '$' {
+		return nil, fmt.Errorf("JSON path must start with '$': %s", path)
+	}
+	steps := []jsonPathStep{}
+	i := 1
+	for i < len(path) {
+		switch path[i] {
+		case '.':
+			i++
+			if i < len(path) && path[i] == '"' {
+				end := strings.IndexByte(path[i+1:], '"')
+				if end < 0 {
+					return nil, fmt.Errorf("unterminated quoted key in JSON path: %s", path)
+				}
+				steps = append(steps, jsonPathStep{key: path[i+1 : i+1+end]})
+				i += end + 2
+				continue
+			}
+			start := i
+			for i < len(path) && path[i] != '.' && path[i] != '[' {
+				i++
+			}
+			if start == i {
+				return nil, fmt.Errorf("empty key in JSON path: %s", path)
+			}
+			steps = append(steps, jsonPathStep{key: path[start:i]})
+		case '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated index in JSON path: %s", path)
+			}
+			index, err := strconv.Atoi(path[i+1 : i+end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid index in JSON path: %s", path)
+			}
+			steps = append(steps, jsonPathStep{index: index, isIndex: true})
+			i += end + 1
+		default:
+			return nil, fmt.Errorf("invalid JSON path: %s", path)
+		}
+	}
+	return steps, nil
+}
+
+// Returns the SQLite json_each() style type name of the given raw JSON value
+func jsonValueType(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return "null"
+	}
+	switch raw[0] {
+	case '{':
+		return "object"
+	case '[':
+		return "array"
+	case '"':
+		return "text"
+	case 't':
+		return "true"
+	case 'f':
+		return "false"
+	case 'n':
+		return "null"
+	}
+	if strings.ContainsAny(string(raw), ".eE") {
+		return "real"
+	}
+	return "integer"
+}
+
+// Returns the SQLite json_type() style type name of a value decoded with UseNumber
+func jsonTypeOf(value interface{}) string {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "text"
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case json.Number:
+		return jsonValueType(json.RawMessage(v))
+	}
+	return "null"
+}
+
+// Returns the value found at the given JSON path of the document, and whether it exists.
+// Numbers are returned as json.Number to preserve precision.
+func jsonExtract(document []byte, steps []jsonPathStep) (interface{}, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, false
+	}
+	for _, step := range steps {
+		if step.isIndex {
+			array, ok := value.([]interface{})
+			if !ok || step.index >= len(array) {
+				return nil, false
+			}
+			value = array[step.index]
+		} else {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			value, ok = object[step.key]
+			if !ok {
+				return nil, false
+			}
+		}
+	}
+	return value, true
+}
+
+// Advance the decoder past the given JSON path, returning the opening
+// delimiter of the found value, or io.EOF if the path doesn't exist.
+func seekJsonPath(decoder *json.Decoder, steps []jsonPathStep) (json.Delim, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return 0, err
+	}
+	for _, step := range steps {
+		delim, ok := token.(json.Delim)
+		if !ok {
+			return 0, io.EOF
+		}
+		found := false
+		if step.isIndex {
+			if delim != '[' {
+				return 0, io.EOF
+			}
+			for i := 0; decoder.More(); i++ {
+				if i == step.index {
+					found = true
+					break
+				}
+				var skip json.RawMessage
+				if err := decoder.Decode(&skip); err != nil {
+					return 0, err
+				}
+			}
+		} else {
+			if delim != '{' {
+				return 0, io.EOF
+			}
+			for decoder.More() {
+				key, err := decoder.Token()
+				if err != nil {
+					return 0, err
+				}
+				if key == step.key {
+					found = true
+					break
+				}
+				var skip json.RawMessage
+				if err := decoder.Decode(&skip); err != nil {
+					return 0, err
+				}
+			}
+		}
+		if !found {
+			return 0, io.EOF
+		}
+		token, err = decoder.Token()
+		if err != nil {
+			return 0, err
+		}
+	}
+	delim, ok := token.(json.Delim)
+	if !ok || (delim != '[' && delim != '{') {
+		return 0, io.EOF
+	}
+	return delim, nil
+}
+
+/** select key, value, type from http_json_each(url, path, headers)
+ * A table function that streams a JSON response, yielding one row per
+ * element of the array (or member of the object) found at path.
+ */
+var JsonEachColumns = []vtab.Column{
+	{Name: "url", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "path", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "headers", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "key", Type: ""},
+	{Name: "value", Type: ""},
+	{Name: "type", Type: sqlite.SQLITE_TEXT.String()},
+}
+
+type JsonEachCursor struct {
+	response *http.Response
+	decoder  *json.Decoder
+
+	// true when iterating members of an object instead of array elements
+	isObject bool
+	// true when the body is a sequence of JSON values (NDJSON) instead of a single array
+	isSequence bool
+
+	index int
+	key   string
+	value json.RawMessage
+}
+
+func (cur *JsonEachCursor) Column(ctx vtab.Context, c int) error {
+	col := JsonEachColumns[c]
+
+	switch col.Name {
+	case "key":
+		if cur.isObject {
+			ctx.ResultText(cur.key)
+		} else {
+			ctx.ResultInt(cur.index)
+		}
+	case "value":
+		switch jsonValueType(cur.value) {
+		case "object", "array":
+			ctx.ResultText(string(cur.value))
+		case "text":
+			var s string
+			if err := json.Unmarshal(cur.value, &s); err != nil {
+				return err
+			}
+			ctx.ResultText(s)
+		case "integer":
+			i, err := strconv.ParseInt(string(cur.value), 10, 64)
+			if err != nil {
+				// too large for an int64, fallback to a float like SQLite does
+				f, _ := strconv.ParseFloat(string(cur.value), 64)
+				ctx.ResultFloat(f)
+			} else {
+				ctx.ResultInt64(i)
+			}
+		case "real":
+			f, err := strconv.ParseFloat(string(cur.value), 64)
+			if err != nil {
+				return err
+			}
+			ctx.ResultFloat(f)
+		case "true":
+			ctx.ResultInt(1)
+		case "false":
+			ctx.ResultInt(0)
+		default:
+			ctx.ResultNull()
+		}
+	case "type":
+		ctx.ResultText(jsonValueType(cur.value))
+	}
+	return nil
+}
+
+func (cur *JsonEachCursor) Next() (vtab.Row, error) {
+	cur.index += 1
+
+	if !cur.isSequence && !cur.decoder.More() {
+		cur.Close()
+		return nil, io.EOF
+	}
+	if cur.isObject {
+		key, err := cur.decoder.Token()
+		if err != nil {
+			cur.Close()
+			return nil, err
+		}
+		cur.key, _ = key.(string)
+	}
+	cur.value = nil
+	if err := cur.decoder.Decode(&cur.value); err != nil {
+		cur.Close()
+		return nil, err
+	}
+	return cur, nil
+}
+
+// Close the response body, called when SQLite stops reading rows early
+func (cur *JsonEachCursor) Close() error {
+	return cur.response.Body.Close()
+}
+
+func JsonEachIterator(connection *connection, constraints []*vtab.Constraint, order []*sqlite.OrderBy) (vtab.Iterator, error) {
+	var url string
+	var path string
+	var headers string
+
+	for _, constraint := range constraints {
+		if constraint.Op == sqlite.INDEX_CONSTRAINT_EQ {
+			column := JsonEachColumns[constraint.ColIndex]
+			switch column.Name {
+			case "url":
+				url = constraint.Value.Text()
+			case "path":
+				path = constraint.Value.Text()
+			case "headers":
+				headers = constraint.Value.Text()
+			}
+		}
+	}
+
+	steps, err := parseJsonPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	client, request, err := prepareRequest(&PrepareRequestParams{method: "GET", url: url, headers: headers, body: nil, cookies: "", connection: connection, streaming: true})
+	if err != nil {
+		return nil, fmt.Errorf("error preparing request: %s", err)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("error on client.Do: %s", err)
+	}
+	return newJsonEachCursor(response, steps)
+}
+
+// Returns an iterator over the values found at the given path of the response body
+func newJsonEachCursor(response *http.Response, steps []jsonPathStep) (vtab.Iterator, error) {
+	reader := bufio.NewReaderSize(response.Body, jsonSequenceWindow)
+	cursor := JsonEachCursor{
+		response: response,
+		index:    -1,
+	}
+
+	// A root path on a body that isn't a JSON array or object is treated as
+	// a sequence of JSON values, like NDJSON, one row per value.
+	if len(steps) == 0 {
+		first, err := peekNonSpace(reader)
+		if err != nil && !errors.Is(err, io.EOF) {
+			response.Body.Close()
+			return nil, err
+		}
+		sequence := first != '[' && first != '{' || isJsonSequence(response.Header.Get("Content-Type"))
+		// A single object has one row per member, but NDJSON of objects starts
+		// the same way, so look past the end of the first object to tell them apart
+		if !sequence && first == '{' {
+			sequence, err = peekJsonSequence(reader)
+			if err != nil {
+				response.Body.Close()
+				return nil, err
+			}
+		}
+		if sequence {
+			cursor.isSequence = true
+			cursor.decoder = json.NewDecoder(reader)
+			return &cursor, nil
+		}
+	}
+
+	cursor.decoder = json.NewDecoder(reader)
+	delim, err := seekJsonPath(cursor.decoder, steps)
+	if err != nil {
+		response.Body.Close()
+		if errors.Is(err, io.EOF) {
+			return &emptyIterator{}, nil
+		}
+		return nil, err
+	}
+	cursor.isObject = delim == '{'
+
+	return &cursor, nil
+}
+
+// Returns the first non-whitespace byte of the reader without consuming it
+func peekNonSpace(reader *bufio.Reader) (byte, error) {
+	for {
+		b, err := reader.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			reader.ReadByte()
+		default:
+			return b[0], nil
+		}
+	}
+}
+
+// How far peekJsonSequence looks for the end of the first value before
+// giving up and treating the body as a single value
+const jsonSequenceWindow = 64 << 10
+
+// Reports whether another JSON value follows the first one of the reader,
+// without consuming anything. Only the bytes of the first value are scanned,
+// and they stay in the reader's buffer, so values larger than
+// jsonSequenceWindow are assumed to be alone.
+func peekJsonSequence(reader *bufio.Reader) (bool, error) {
+	depth := 0
+	inString, escaped, ended := false, false, false
+	for n := 0; ; {
+		buf, err := reader.Peek(max(n+1, reader.Buffered()))
+		for ; n < len(buf); n++ {
+			c := buf[n]
+			switch {
+			case ended:
+				switch c {
+				case ' ', '\t', '\r', '\n':
+				default:
+					return true, nil
+				}
+			case inString:
+				switch {
+				case escaped:
+					escaped = false
+				case c == '\\':
+					escaped = true
+				case c == '"':
+					inString = false
+				}
+			case c == '"':
+				inString = true
+			case c == '{' || c == '[':
+				depth++
+			case c == '}' || c == ']':
+				depth--
+				ended = depth == 0
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, bufio.ErrBufferFull) || n >= jsonSequenceWindow {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// Returns true for the media types of JSON sequences like NDJSON
+func isJsonSequence(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/x-ndjson", "application/ndjson", "application/jsonl":
+		return true
+	}
+	return false
+}
+
+// An iterator with no rows
+type emptyIterator struct{}
+
+func (*emptyIterator) Next() (vtab.Row, error) { return nil, io.EOF }
+
+func RegisterJson(api *sqlite.ExtensionApi, connection *connection) error {
+	iterator := func(constraints []*vtab.Constraint, order []*sqlite.OrderBy) (vtab.Iterator, error) {
+		return JsonEachIterator(connection, constraints, order)
+	}
+	if err := api.CreateModule("http_json_each", vtab.NewTableFunc("http_json_each", JsonEachColumns, iterator)); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.riyazali.net/sqlite"
+)
+
+// Running webhook listeners, by listening address. Started with http_listen
+var listeners = map[string]*webhookListener{}
+var listenersMu sync.Mutex
+
+// A background HTTP server that inserts every request it receives into a table,
+// through a separate connection to the database file so it never joins the
+// transaction open on the user's connection. A request is only answered with
+// the configured response once its row is committed.
+type webhookListener struct {
+	// the address as given to http_listen, which could differ from the listening address
+	addr       string
+	server     *http.Server
+	db         *database
+	table      string
+	removeHook func()
+	stopOnce   sync.Once
+
+	responseStatus  int
+	responseHeaders http.Header
+	responseBody    []byte
+}
+
+func (l *webhookListener) createTable() error {
+	sql := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s(
+  id INTEGER PRIMARY KEY,
+  received_at TEXT,
+  method TEXT,
+  path TEXT,
+  query TEXT,
+  headers TEXT,
+  body BLOB,
+  remote_address TEXT
+)`, quoteIdentifier(l.table))
+	return l.db.exec(sql, nil)
+}
+
+func (l *webhookListener) stop() {
+	l.stopOnce.Do(func() {
+		l.removeHook()
+		l.server.Close()
+		l.db.close()
+	})
+}
+
+func (l *webhookListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	receivedAt := time.Now()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var bodyValue, query interface{}
+	if len(body) > 0 {
+		bodyValue = body
+	}
+	if r.URL.RawQuery != "" {
+		query = r.URL.RawQuery
+	}
+	headers := new(bytes.Buffer)
+	r.Header.Write(headers)
+
+	sql := fmt.Sprintf(`INSERT INTO %s(received_at, method, path, query, headers, body, remote_address) VALUES (?, ?, ?, ?, ?, ?, ?)`, quoteIdentifier(l.table))
+	err = l.db.exec(sql, nil,
+		*formatSqliteDatetime(&receivedAt),
+		r.Method,
+		r.URL.Path,
+		query,
+		headers.String(),
+		bodyValue,
+		r.RemoteAddr,
+	)
+	if err != nil {
+		// the sender should retry a request that wasn't stored
+		http.Error(w, fmt.Sprintf("error inserting request into %s: %s", l.table, err), http.StatusInternalServerError)
+		return
+	}
+
+	for key, values := range l.responseHeaders {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(l.responseStatus)
+	w.Write(l.responseBody)
+}
+
+/* http_listen(addr, table_name, [response_status], [response_body], [response_headers])
+* Start a background HTTP server on addr, like 'localhost:8081', that inserts
+* every request it receives into the table_name table, creating it if needed.
+* Each request is answered with response_status, 200 by default, and the given
+* body and headers once inserted, or a 500 if it couldn't be. Runs until stopped
+* or the connection closes. Returns the listening address.
+ */
+type HttpListenFunc struct {
+	connection *connection
+}
+
+func (*HttpListenFunc) Deterministic() bool { return false }
+func (*HttpListenFunc) Args() int           { return -1 }
+func (f *HttpListenFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	if len(values) < 2 || len(values) > 5 {
+		c.ResultError(fmt.Errorf("usage: http_listen(addr, table_name, [response_status], [response_body], [response_headers])"))
+		return
+	}
+	listener := &webhookListener{
+		addr:           values[0].Text(),
+		table:          values[1].Text(),
+		responseStatus: http.StatusOK,
+	}
+	if listener.table == "" {
+		c.ResultError(fmt.Errorf("http_listen() requires a table name"))
+		return
+	}
+	if len(values) > 2 && values[2].Type() != sqlite.SQLITE_NULL {
+		listener.responseStatus = values[2].Int()
+		if listener.responseStatus < 100 || listener.responseStatus > 999 {
+			c.ResultError(fmt.Errorf("invalid response status %d", listener.responseStatus))
+			return
+		}
+	}
+	if len(values) > 3 {
+		listener.responseBody = values[3].Blob()
+	}
+	if len(values) > 4 && values[4].Type() != sqlite.SQLITE_NULL {
+		listener.responseHeaders = http.Header(readHeader(values[4].Text()))
+	}
+	db, err := openDatabase(f.connection.conn, false)
+	if err != nil {
+		c.ResultError(fmt.Errorf("http_listen() %s", err))
+		return
+	}
+	listener.db = db
+	if err := listener.createTable(); err != nil {
+		db.close()
+		c.ResultError(fmt.Errorf("error creating table %s: %s", listener.table, err))
+		return
+	}
+
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	ln, err := net.Listen("tcp", listener.addr)
+	if err != nil {
+		db.close()
+		c.ResultError(fmt.Errorf("error listening on %s: %s", listener.addr, err))
+		return
+	}
+	addr := ln.Addr().String()
+	listener.server = &http.Server{Handler: listener}
+	listeners[addr] = listener
+	listener.removeHook = f.connection.onClose(func() {
+		listenersMu.Lock()
+		defer listenersMu.Unlock()
+		delete(listeners, addr)
+		listener.stop()
+	})
+	go listener.server.Serve(ln)
+
+	c.ResultText(addr)
+}
+
+/* http_listen_stop([addr])
+* Stop the listener started on addr, either as given to http_listen or as
+* returned by it, or every listener if omitted. Returns the number of stopped listeners.
+ */
+type HttpListenStopFunc struct{}
+
+func (*HttpListenStopFunc) Deterministic() bool { return false }
+func (*HttpListenStopFunc) Args() int           { return -1 }
+func (*HttpListenStopFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	if len(values) > 1 {
+		c.ResultError(fmt.Errorf("usage: http_listen_stop([addr])"))
+		return
+	}
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	stopped := 0
+	for addr, listener := range listeners {
+		if len(values) == 0 || values[0].Text() == addr || values[0].Text() == listener.addr {
+			listener.stop()
+			delete(listeners, addr)
+			stopped += 1
+		}
+	}
+	c.ResultInt(stopped)
+}
+
+func RegisterListen(api *sqlite.ExtensionApi, connection *connection) error {
+	if err := api.CreateFunction("http_listen", &HttpListenFunc{connection: connection}); err != nil {
+		return err
+	}
+	if err := api.CreateFunction("http_listen_stop", &HttpListenStopFunc{}); err != nil {
+		return err
+	}
+	return nil
+}
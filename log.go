@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.riyazali.net/sqlite"
+)
+
+// Table the requests made from a connection are logged into, see http_log_to
+type requestLog struct {
+	conn *sqlite.Conn
+	// separate connection to the same database, for requests made in the
+	// background. nil for in-memory databases, whose background requests aren't logged
+	background *database
+	table      string
+	// Maximum number of bytes of request and response bodies to store, 0 to not store bodies
+	bodyLimit int
+
+	// writes of background requests waiting for the separate connection, in order
+	queue  []func() error
+	queued *sync.Cond
+	closed bool
+	mu     sync.Mutex
+}
+
+// Print a warning to stderr, for errors that can't fail the SQL that caused them
+func warnf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "sqlite-http: "+format+"\n", args...)
+}
+
+// Log background requests through the given separate connection
+func (l *requestLog) startBackground(background *database) {
+	l.background = background
+	l.queued = sync.NewCond(&l.mu)
+	go l.flush()
+}
+
+// Write the queued rows of background requests through the separate connection.
+// While another connection holds the write lock, like the log's own connection
+// in the middle of a transaction, the rows wait until that writer finishes.
+// Rows still waiting once the log is closed are dropped.
+func (l *requestLog) flush() {
+	for {
+		l.mu.Lock()
+		for len(l.queue) == 0 && !l.closed {
+			l.queued.Wait()
+		}
+		if len(l.queue) == 0 {
+			l.mu.Unlock()
+			l.background.close()
+			return
+		}
+		write, closed := l.queue[0], l.closed
+		l.mu.Unlock()
+
+		err := write()
+		// the busy timeout already waited, so try again right away
+		if errors.Is(err, errDatabaseBusy) && !closed {
+			continue
+		}
+		l.mu.Lock()
+		l.queue = l.queue[1:]
+		l.mu.Unlock()
+		if err != nil {
+			warnf("error logging request to %s: %s", l.table, err)
+		}
+	}
+}
+
+func (l *requestLog) close() {
+	if l.background == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	l.queued.Signal()
+}
+
+// Run the given SQL with the arguments returned by args, calling fn with the
+// first column of every row. Requests made in the background queue it for the
+// separate connection instead, since the log's connection can only be used from
+// SQLite's calls into the extension, so args is called once every earlier write
+// of the log ran. Logging never fails a request, errors are only warned about.
+func (l *requestLog) exec(background bool, sql string, fn func(int64), args func() []interface{}) {
+	if background {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.closed {
+			warnf("not logging request to %s, logging stopped", l.table)
+			return
+		}
+		l.queue = append(l.queue, func() error {
+			return l.background.exec(sql, func(stmt *databaseStmt) error {
+				if fn != nil {
+					fn(stmt.columnInt64(0))
+				}
+				return nil
+			}, args()...)
+		})
+		l.queued.Signal()
+		return
+	}
+	err := l.conn.Exec(sql, func(stmt *sqlite.Stmt) error {
+		if fn != nil {
+			fn(stmt.ColumnInt64(0))
+		}
+		return nil
+	}, args()...)
+	if err != nil {
+		warnf("error logging request to %s: %s", l.table, err)
+	}
+}
+
+// Quote the given name as a SQL identifier
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (l *requestLog) createTable() error {
+	sql := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s(
+  id INTEGER PRIMARY KEY,
+  started_at TEXT,
+  request_method TEXT,
+  request_url TEXT,
+  request_headers TEXT,
+  request_body BLOB,
+  request_size INT,
+  response_status TEXT,
+  response_status_code INT,
+  response_headers TEXT,
+  response_body BLOB,
+  response_size INT,
+  remote_address TEXT,
+  timings TEXT,
+  error TEXT
+)`, quoteIdentifier(l.table))
+	return l.conn.Exec(sql, nil)
+}
+
+// Read up to limit bytes of the given request's body, without consuming it
+func peekRequestBody(request *http.Request, limit int) []byte {
+	if limit <= 0 || request.GetBody == nil {
+		return nil
+	}
+	body, err := request.GetBody()
+	if err != nil {
+		return nil
+	}
+	defer body.Close()
+	data, _ := io.ReadAll(io.LimitReader(body, int64(limit)))
+	return data
+}
+
+// A single logged request, inserted when the response headers arrive and
+// updated once the response body is read or closed
+type requestLogEntry struct {
+	log *requestLog
+	// true for requests made in the background, outside of SQLite's calls into the extension
+	background bool
+	id         int64
+	timing     Timings
+	remoteAddr string
+}
+
+func (e *requestLogEntry) insert(request *http.Request, response *http.Response, requestErr error) {
+	requestHeaders := new(bytes.Buffer)
+	request.Header.Write(requestHeaders)
+	timings, _ := json.Marshal(e.timing)
+
+	var requestBody interface{}
+	if body := peekRequestBody(request, e.log.bodyLimit); body != nil {
+		requestBody = body
+	}
+	var status, statusCode, responseHeaders, errorMessage interface{}
+	if response != nil {
+		buf := new(bytes.Buffer)
+		response.Header.Write(buf)
+		status, statusCode, responseHeaders = response.Status, response.StatusCode, buf.String()
+	}
+	if requestErr != nil {
+		errorMessage = requestErr.Error()
+	}
+
+	sql := fmt.Sprintf(`INSERT INTO %s(started_at, request_method, request_url, request_headers, request_body, request_size, response_status, response_status_code, response_headers, remote_address, timings, error)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`, quoteIdentifier(e.log.table))
+	args := []interface{}{
+		*formatSqliteDatetime(e.timing.Started),
+		request.Method,
+		request.URL.String(),
+		requestHeaders.String(),
+		requestBody,
+		request.ContentLength,
+		status,
+		statusCode,
+		responseHeaders,
+		e.remoteAddr,
+		string(timings),
+		errorMessage,
+	}
+	e.log.exec(e.background, sql, func(id int64) { e.id = id }, func() []interface{} { return args })
+}
+
+func (e *requestLogEntry) update(size int64, body []byte, bodyErr error) {
+	timings, _ := json.Marshal(e.timing)
+	var responseBody, errorMessage interface{}
+	if body != nil {
+		responseBody = body
+	}
+	if bodyErr != nil {
+		errorMessage = bodyErr.Error()
+	}
+	sql := fmt.Sprintf(`UPDATE %s SET response_size = ?, response_body = ?, timings = ?, error = coalesce(?, error) WHERE id = ?`, quoteIdentifier(e.log.table))
+	e.log.exec(e.background, sql, nil, func() []interface{} {
+		return []interface{}{size, responseBody, string(timings), errorMessage, e.id}
+	})
+}
+
+// A response body that records its size, and the start of it up to the body
+// limit, into the log entry once fully read or closed
+type loggingBody struct {
+	body  io.ReadCloser
+	entry *requestLogEntry
+
+	size     int64
+	captured []byte
+	done     bool
+}
+
+func (b *loggingBody) finish(bodyErr error) {
+	if b.done {
+		return
+	}
+	b.done = true
+	end := time.Now()
+	b.entry.timing.BodyEnd = &end
+	b.entry.update(b.size, b.captured, bodyErr)
+}
+
+func (b *loggingBody) Read(p []byte) (int, error) {
+	if b.entry.timing.BodyStart == nil {
+		start := time.Now()
+		b.entry.timing.BodyStart = &start
+	}
+	n, err := b.body.Read(p)
+	b.size += int64(n)
+	if limit := b.entry.log.bodyLimit; limit > 0 && len(b.captured) < limit {
+		remaining := limit - len(b.captured)
+		if remaining > n {
+			remaining = n
+		}
+		b.captured = append(b.captured, p[:remaining]...)
+	}
+	if err == io.EOF {
+		b.finish(nil)
+	} else if err != nil {
+		b.finish(err)
+	}
+	return n, err
+}
+
+func (b *loggingBody) Close() error {
+	err := b.body.Close()
+	b.finish(nil)
+	return err
+}
+
+// A http.RoundTripper that logs every request made through it into the given table,
+// including each hop of a redirect
+type loggingTransport struct {
+	base       http.RoundTripper
+	log        *requestLog
+	background bool
+}
+
+func (t *loggingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	entry := &requestLogEntry{log: t.log, background: t.background}
+	started := time.Now()
+	entry.timing.Started = &started
+
+	trace := newTimingTrace(&entry.timing, &entry.remoteAddr)
+	response, err := t.base.RoundTrip(request.WithContext(httptrace.WithClientTrace(request.Context(), trace)))
+	entry.insert(request, response, err)
+	if err != nil {
+		return nil, err
+	}
+	response.Body = &loggingBody{body: response.Body, entry: entry}
+	return response, nil
+}
+
+/* http_log_to(table_name, [body_limit])
+* Log every HTTP request made from this connection into the given table, created
+* if it doesn't exist. Up to body_limit bytes of request and response bodies are
+* stored, none by default. NULL disables logging. Requests made in the background
+* are only logged when the database has a file another connection can open.
+ */
+type HttpLogTo struct {
+	connection *connection
+}
+
+func (*HttpLogTo) Deterministic() bool { return false }
+func (*HttpLogTo) Args() int           { return -1 }
+func (f *HttpLogTo) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	if len(values) < 1 || len(values) > 2 {
+		c.ResultError(fmt.Errorf("http_log_to() expects 1 or 2 arguments, got %d", len(values)))
+		return
+	}
+	if values[0].Type() == sqlite.SQLITE_NULL || values[0].Text() == "" {
+		f.connection.setRequestLog(nil)
+		c.ResultNull()
+		return
+	}
+	log := &requestLog{conn: f.connection.conn, table: values[0].Text()}
+	if len(values) > 1 {
+		log.bodyLimit = values[1].Int()
+	}
+	if err := log.createTable(); err != nil {
+		c.ResultError(fmt.Errorf("error creating log table %s: %s", log.table, err))
+		return
+	}
+	background, err := openDatabase(f.connection.conn, false)
+	if err != nil && !errors.Is(err, errNoDatabaseFile) {
+		c.ResultError(fmt.Errorf("error opening log table %s: %s", log.table, err))
+		return
+	}
+	if background != nil {
+		log.startBackground(background)
+	}
+	f.connection.setRequestLog(log)
+	c.ResultText(log.table)
+}
+
+func RegisterLog(api *sqlite.ExtensionApi, connection *connection) error {
+	if err := api.CreateFunction("http_log_to", &HttpLogTo{connection: connection}); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.riyazali.net/sqlite"
+)
+
+// Requests shared by identical requests while in flight and after they finish,
+// by key, while memoizing. Configurable with http_memo
+var DoMemo = &memoRegistry{maxBytes: memoDefaultMaxBytes, recent: list.New(), expiryOrder: list.New()}
+
+// Total size of the bodies kept in memory by default, before the least recently
+// used responses are forgotten
+const memoDefaultMaxBytes = 64 << 20
+
+// A response kept in memory, replayed for every identical request
+type memoResponse struct {
+	status     string
+	statusCode int
+	proto      string
+	protoMajor int
+	protoMinor int
+	header     http.Header
+	body       []byte
+}
+
+// A request shared by every identical request made while it's in flight, and
+// after it finishes until it expires
+type memoCall struct {
+	done chan struct{}
+
+	// set before done is closed
+	response *memoResponse
+	err      error
+	// true for responses that can't be shared, identical requests are made on their own
+	unshared bool
+	// zero if the response never expires
+	expires time.Time
+
+	// set once memoized, for the registry's lists
+	key         string
+	size        int64
+	recent      *list.Element
+	expiryOrder *list.Element
+}
+
+func (c *memoCall) expired(now time.Time) bool {
+	select {
+	case <-c.done:
+		return !c.expires.IsZero() && now.After(c.expires)
+	default:
+		return false
+	}
+}
+
+type memoRegistry struct {
+	enabled bool
+	// how long responses are kept once they arrive, 0 to keep them until disabled
+	ttl time.Duration
+	// maximum total size of memoized bodies, a larger body is never memoized
+	maxBytes int64
+	calls    map[string]*memoCall
+
+	// memoized calls, most recently used first
+	recent *list.List
+	// memoized calls, first to expire first. Every response is kept for the
+	// same ttl, so that's the order they finished in
+	expiryOrder *list.List
+	size        int64
+	mu          sync.Mutex
+}
+
+// Whether requests are memoized, and so go through a memoTransport
+func (r *memoRegistry) active() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.enabled
+}
+
+// The maximum size of a memoized body
+func (r *memoRegistry) bodyLimit() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.maxBytes
+}
+
+// Enable or disable memoizing, forgetting every memoized response
+func (r *memoRegistry) set(enabled bool, ttl time.Duration, maxBytes int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.enabled = enabled
+	r.ttl = ttl
+	r.maxBytes = maxBytes
+	r.calls = nil
+	r.recent = list.New()
+	r.expiryOrder = list.New()
+	r.size = 0
+}
+
+// Forget a memoized call, with r.mu held
+func (r *memoRegistry) remove(call *memoCall) {
+	if r.calls[call.key] == call {
+		delete(r.calls, call.key)
+	}
+	if call.recent != nil {
+		r.recent.Remove(call.recent)
+		r.expiryOrder.Remove(call.expiryOrder)
+		call.recent, call.expiryOrder = nil, nil
+		r.size -= call.size
+	}
+}
+
+// Forget expired calls, then the least recently used ones until the rest fit, with r.mu held
+func (r *memoRegistry) evict(now time.Time) {
+	for e := r.expiryOrder.Front(); e != nil; e = r.expiryOrder.Front() {
+		call := e.Value.(*memoCall)
+		if !call.expired(now) {
+			break
+		}
+		r.remove(call)
+	}
+	for r.size > r.maxBytes {
+		r.remove(r.recent.Back().Value.(*memoCall))
+	}
+}
+
+// Returns the key identical requests share, or "" if the request isn't memoized.
+// Only GET, HEAD, and OPTIONS requests are, since they shouldn't change anything
+func memoKey(request *http.Request) (string, error) {
+	method := strings.ToUpper(request.Method)
+	if method != "GET" && method != "HEAD" && method != "OPTIONS" {
+		return "", nil
+	}
+	// an upgraded connection like a WebSocket can't be shared
+	if request.Header.Get("Upgrade") != "" {
+		return "", nil
+	}
+	body, err := readRequestBody(request)
+	if err != nil {
+		return "", err
+	}
+	headers := new(bytes.Buffer)
+	request.Header.Write(headers)
+	return fmt.Sprintf("%q %q %q %q", method, request.URL.String(), headers.String(), body), nil
+}
+
+// Returns the call for the given key, and true if the caller should make the
+// request and finish the call, or false if it should wait for the call instead
+func (r *memoRegistry) join(key string) (*memoCall, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if call, ok := r.calls[key]; ok {
+		if !call.expired(now) {
+			if call.recent != nil {
+				r.recent.MoveToFront(call.recent)
+			}
+			return call, false
+		}
+		r.remove(call)
+	}
+	call := &memoCall{done: make(chan struct{}), key: key}
+	if r.calls == nil {
+		r.calls = map[string]*memoCall{}
+	}
+	r.calls[key] = call
+	return call, true
+}
+
+// Report the outcome of a call, forgetting failed and unshared calls so the
+// next identical request is made again, and every call unless memoizing
+func (r *memoRegistry) finish(call *memoCall) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if call.err != nil || call.unshared || !r.enabled {
+		r.remove(call)
+	} else if r.calls[call.key] == call {
+		if r.ttl > 0 {
+			call.expires = now.Add(r.ttl)
+		}
+		call.size = int64(len(call.response.body))
+		call.recent = r.recent.PushFront(call)
+		call.expiryOrder = r.expiryOrder.PushBack(call)
+		r.size += call.size
+	}
+	close(call.done)
+	r.evict(now)
+}
+
+// Wait for the next tick of http_rate_limit, unless the request is cancelled first
+func waitRateLimit(request *http.Request) error {
+	select {
+	case <-DoTicker.C:
+		return nil
+	case <-request.Context().Done():
+		return request.Context().Err()
+	}
+}
+
+// A http.RoundTripper that answers requests with the response to an identical
+// in-flight or earlier request, and memoizes the responses it doesn't have
+// yet. Only used while memoizing, so it also waits on http_rate_limit, for
+// the requests it makes and not the ones it answers.
+type memoTransport struct {
+	base     http.RoundTripper
+	registry *memoRegistry
+}
+
+func (t *memoTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	key, err := memoKey(request)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		if err := waitRateLimit(request); err != nil {
+			return nil, err
+		}
+		return t.base.RoundTrip(request)
+	}
+	call, leader := t.registry.join(key)
+	if !leader {
+		select {
+		case <-call.done:
+		case <-request.Context().Done():
+			return nil, request.Context().Err()
+		}
+		if call.unshared {
+			if err := waitRateLimit(request); err != nil {
+				return nil, err
+			}
+			return t.base.RoundTrip(request)
+		}
+		if call.err != nil {
+			return nil, call.err
+		}
+		return call.response.replay(request), nil
+	}
+
+	if err := waitRateLimit(request); err != nil {
+		call.err = err
+		t.registry.finish(call)
+		return nil, err
+	}
+	response, err := t.base.RoundTrip(request)
+	if err != nil {
+		call.err = err
+		t.registry.finish(call)
+		return nil, err
+	}
+	// bodies over the limit are streamed to the caller instead of memoized
+	limit := t.registry.bodyLimit()
+	if response.ContentLength > limit {
+		call.unshared = true
+		t.registry.finish(call)
+		return response, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, limit+1))
+	if err != nil {
+		response.Body.Close()
+		call.err = err
+		t.registry.finish(call)
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		call.unshared = true
+		t.registry.finish(call)
+		response.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), response.Body), response.Body}
+		return response, nil
+	}
+	response.Body.Close()
+	call.response = &memoResponse{
+		status:     response.Status,
+		statusCode: response.StatusCode,
+		proto:      response.Proto,
+		protoMajor: response.ProtoMajor,
+		protoMinor: response.ProtoMinor,
+		header:     response.Header.Clone(),
+		body:       body,
+	}
+	t.registry.finish(call)
+	return call.response.replay(request), nil
+}
+
+func (m *memoResponse) replay(request *http.Request) *http.Response {
+	return &http.Response{
+		Status:        m.status,
+		StatusCode:    m.statusCode,
+		Proto:         m.proto,
+		ProtoMajor:    m.protoMajor,
+		ProtoMinor:    m.protoMinor,
+		Header:        m.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(m.body)),
+		ContentLength: int64(len(m.body)),
+		Request:       request,
+	}
+}
+
+/* http_memo(enabled, [ttl_ms], [max_bytes])
+* When enabled, identical GET, HEAD, and OPTIONS requests made while one is in
+* flight wait for its response, and later ones are answered from memory, for up
+* to ttl_ms milliseconds if given.
+* At most max_bytes of bodies are kept, 64 MiB by default, forgetting the least
+* recently used ones. Disabling forgets every memoized response. Disabled by default.
+ */
+type HttpMemoFunc struct{}
+
+func (*HttpMemoFunc) Deterministic() bool { return false }
+func (*HttpMemoFunc) Args() int           { return -1 }
+func (*HttpMemoFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	if len(values) < 1 || len(values) > 3 {
+		c.ResultError(fmt.Errorf("http_memo() expects 1 to 3 arguments, got %d", len(values)))
+		return
+	}
+	enabled := values[0].Int() != 0
+	var ttl time.Duration
+	if len(values) > 1 && values[1].Type() != sqlite.SQLITE_NULL {
+		ms := values[1].Int64()
+		if ms <= 0 {
+			c.ResultError(fmt.Errorf("http_memo() ttl_ms must be positive, got %d", ms))
+			return
+		}
+		ttl = time.Duration(ms) * time.Millisecond
+	}
+	maxBytes := int64(memoDefaultMaxBytes)
+	if len(values) > 2 && values[2].Type() != sqlite.SQLITE_NULL {
+		maxBytes = values[2].Int64()
+		if maxBytes <= 0 {
+			c.ResultError(fmt.Errorf("http_memo() max_bytes must be positive, got %d", maxBytes))
+			return
+		}
+	}
+	DoMemo.set(enabled, ttl, maxBytes)
+	if enabled {
+		c.ResultInt(1)
+	} else {
+		c.ResultInt(0)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/asg017/sqlite-http/internal/vtab"
+	"go.riyazali.net/sqlite"
+)
+
+/* http_mime_type(content_type)
+ * Returns the lowercased media type of the given Content-Type value without any
+ * parameters, like 'text/html' for 'text/HTML; charset=UTF-8'. NULL if invalid.
+ */
+type MimeTypeFunc struct{}
+
+func (*MimeTypeFunc) Deterministic() bool { return true }
+func (*MimeTypeFunc) Args() int           { return 1 }
+func (*MimeTypeFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	mediaType, _, err := mime.ParseMediaType(values[0].Text())
+	if err != nil && err != mime.ErrInvalidMediaParameter {
+		c.ResultNull()
+		return
+	}
+	c.ResultText(mediaType)
+}
+
+/** select name, value from http_mime_params_each(content_type)
+ * A table function for enumerating each parameter of a Content-Type value,
+ * like charset or boundary. RFC 2231 encoded parameters are decoded.
+ */
+var MimeParamsEachColumns = []vtab.Column{
+	{Name: "content_type", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "name", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "value", Type: sqlite.SQLITE_TEXT.String()},
+}
+
+type MimeParamsEachCursor struct {
+	params  map[string]string
+	names   []string
+	current int
+}
+
+func (cur *MimeParamsEachCursor) Column(ctx vtab.Context, c int) error {
+	col := MimeParamsEachColumns[c]
+
+	switch col.Name {
+	case "name":
+		ctx.ResultText(cur.names[cur.current])
+	case "value":
+		ctx.ResultText(cur.params[cur.names[cur.current]])
+	}
+	return nil
+}
+
+func (cur *MimeParamsEachCursor) Next() (vtab.Row, error) {
+	cur.current += 1
+	if cur.current >= len(cur.names) {
+		return nil, io.EOF
+	}
+	return cur, nil
+}
+
+func MimeParamsEachIterator(constraints []*vtab.Constraint, order []*sqlite.OrderBy) (vtab.Iterator, error) {
+	var contentType string
+	for _, constraint := range constraints {
+		if constraint.Op == sqlite.INDEX_CONSTRAINT_EQ {
+			column := MimeParamsEachColumns[constraint.ColIndex]
+			switch column.Name {
+			case "content_type":
+				contentType = constraint.Value.Text()
+			}
+		}
+	}
+
+	// invalid values yield no rows instead of an error, like http_mime_type returning NULL
+	_, params, _ := mime.ParseMediaType(contentType)
+
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return &MimeParamsEachCursor{params: params, names: names, current: -1}, nil
+}
+
+/* http_content_disposition(value)
+ * Returns the filename of the given Content-Disposition header value, like
+ * 'attachment; filename="report.pdf"'. The RFC 5987 "filename*" parameter takes
+ * precedence and is decoded. NULL if there is no filename.
+ */
+type ContentDispositionFunc struct{}
+
+func (*ContentDispositionFunc) Deterministic() bool { return true }
+func (*ContentDispositionFunc) Args() int           { return 1 }
+func (*ContentDispositionFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	// mime.ParseMediaType already prefers and decodes "filename*" over "filename"
+	_, params, err := mime.ParseMediaType(values[0].Text())
+	if err != nil && err != mime.ErrInvalidMediaParameter {
+		c.ResultNull()
+		return
+	}
+	filename, ok := params["filename"]
+	if !ok {
+		c.ResultNull()
+		return
+	}
+	c.ResultText(filename)
+}
+
+// A single entry of an Accept, Accept-Language, or Accept-Encoding header value
+type acceptEntry struct {
+	value  string
+	q      float64
+	params map[string]string
+}
+
+// Split the given string on sep, ignoring any separators in quoted strings
+func splitQuoted(s string, sep byte) []string {
+	parts := []string{}
+	inQuote := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && inQuote:
+			i++
+		case s[i] == '"':
+			inQuote = !inQuote
+		case s[i] == sep && !inQuote:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Remove the quotes and backslash escapes of a HTTP quoted-string, if quoted
+func unquoteHeaderValue(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	var b strings.Builder
+	for i := 1; i < len(s)-1; i++ {
+		if s[i] == '\\' && i+1 < len(s)-1 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Parse an Accept-style header value, ranked by descending q-value. Entries
+// with the same q-value keep their original order.
+func parseAccept(header string) []acceptEntry {
+	entries := []acceptEntry{}
+	for _, part := range splitQuoted(header, ',') {
+		fields := splitQuoted(part, ';')
+		value := strings.TrimSpace(fields[0])
+		if value == "" {
+			continue
+		}
+		entry := acceptEntry{value: value, q: 1, params: map[string]string{}}
+		for _, field := range fields[1:] {
+			name, paramValue, _ := strings.Cut(field, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			paramValue = unquoteHeaderValue(strings.TrimSpace(paramValue))
+			if name == "q" {
+				q, err := strconv.ParseFloat(paramValue, 64)
+				if err != nil || q < 0 || q > 1 {
+					q = 0
+				}
+				entry.q = q
+				continue
+			}
+			entry.params[name] = paramValue
+		}
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].q > entries[j].q
+	})
+	return entries
+}
+
+/** select value, q, params from http_accept_each(header)
+ * A table function for enumerating each entry of an Accept, Accept-Language,
+ * or Accept-Encoding header value, ranked by q-value.
+ */
+var AcceptEachColumns = []vtab.Column{
+	{Name: "header", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "rank", Type: sqlite.SQLITE_INTEGER.String()},
+	{Name: "value", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "q", Type: sqlite.SQLITE_FLOAT.String()},
+	{Name: "params", Type: sqlite.SQLITE_TEXT.String()},
+}
+
+type AcceptEachCursor struct {
+	entries []acceptEntry
+	current int
+}
+
+func (cur *AcceptEachCursor) Column(ctx vtab.Context, c int) error {
+	col := AcceptEachColumns[c]
+	entry := cur.entries[cur.current]
+
+	switch col.Name {
+	case "rank":
+		ctx.ResultInt(cur.current + 1)
+	case "value":
+		ctx.ResultText(entry.value)
+	case "q":
+		ctx.ResultFloat(entry.q)
+	case "params":
+		buf, err := json.Marshal(entry.params)
+		if err != nil {
+			return err
+		}
+		ctx.ResultText(string(buf))
+	}
+	return nil
+}
+
+func (cur *AcceptEachCursor) Next() (vtab.Row, error) {
+	cur.current += 1
+	if cur.current >= len(cur.entries) {
+		return nil, io.EOF
+	}
+	return cur, nil
+}
+
+func AcceptEachIterator(constraints []*vtab.Constraint, order []*sqlite.OrderBy) (vtab.Iterator, error) {
+	var header string
+	for _, constraint := range constraints {
+		if constraint.Op == sqlite.INDEX_CONSTRAINT_EQ {
+			column := AcceptEachColumns[constraint.ColIndex]
+			switch column.Name {
+			case "header":
+				header = constraint.Value.Text()
+			}
+		}
+	}
+	return &AcceptEachCursor{entries: parseAccept(header), current: -1}, nil
+}
+
+/* http_detect_content_type(data)
+ * Returns the sniffed MIME type of the given BLOB, using the WHATWG MIME
+ * sniffing algorithm like net/http.DetectContentType.
+ */
+type DetectContentTypeFunc struct{}
+
+func (*DetectContentTypeFunc) Deterministic() bool { return true }
+func (*DetectContentTypeFunc) Args() int           { return 1 }
+func (*DetectContentTypeFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	c.ResultText(http.DetectContentType(values[0].Blob()))
+}
+
+func RegisterMime(api *sqlite.ExtensionApi) error {
+	if err := api.CreateModule("http_mime_params_each", vtab.NewTableFunc("http_mime_params_each", MimeParamsEachColumns, MimeParamsEachIterator)); err != nil {
+		return err
+	}
+	if err := api.CreateModule("http_accept_each", vtab.NewTableFunc("http_accept_each", AcceptEachColumns, AcceptEachIterator)); err != nil {
+		return err
+	}
+	if err := api.CreateFunction("http_mime_type", &MimeTypeFunc{}); err != nil {
+		return err
+	}
+	if err := api.CreateFunction("http_content_disposition", &ContentDispositionFunc{}); err != nil {
+		return err
+	}
+	if err := api.CreateFunction("http_detect_content_type", &DetectContentTypeFunc{}); err != nil {
+		return err
+	}
+	return nil
+}
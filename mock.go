@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asg017/sqlite-http/internal/vtab"
+	"go.riyazali.net/sqlite"
+)
+
+// Registered mock responses and the requests made while mocking. Configurable with
+// http_mock, http_mock_strict, and http_mock_reset
+var DoMocks = &mockRegistry{}
+
+// A canned response for requests matching a method and URL pattern
+type httpMock struct {
+	id         int64
+	method     string
+	urlPattern *regexp.Regexp
+	status     int
+	headers    string
+	body       []byte
+	delay      time.Duration
+}
+
+// A request made while mocking, for the http_mock_calls table
+type mockCall struct {
+	method      string
+	url         string
+	headers     string
+	body        []byte
+	mockId      int64
+	requestedAt time.Time
+}
+
+type mockRegistry struct {
+	mocks []*httpMock
+	calls []mockCall
+	// true to error on requests that match no mock, instead of sending them to the network
+	strict bool
+	nextId int64
+	mu     sync.Mutex
+}
+
+// Returns true if requests should go through the mock transport
+func (r *mockRegistry) active() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.strict || len(r.mocks) > 0
+}
+
+// Compile a URL glob pattern, where "*" matches any characters and "?" matches one
+func compileUrlPattern(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// Record the given request, and return the most recently registered mock matching it, if any
+func (r *mockRegistry) match(request *http.Request, body []byte) *httpMock {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var found *httpMock
+	for i := len(r.mocks) - 1; i >= 0; i-- {
+		mock := r.mocks[i]
+		if (mock.method == "*" || strings.EqualFold(mock.method, request.Method)) && mock.urlPattern.MatchString(request.URL.String()) {
+			found = mock
+			break
+		}
+	}
+
+	headers := new(bytes.Buffer)
+	request.Header.Write(headers)
+	call := mockCall{
+		method:      request.Method,
+		url:         request.URL.String(),
+		headers:     headers.String(),
+		body:        body,
+		requestedAt: time.Now(),
+	}
+	if found != nil {
+		call.mockId = found.id
+	}
+	r.calls = append(r.calls, call)
+	return found
+}
+
+// A http.RoundTripper that answers requests from registered mocks. Unmatched
+// requests are sent to base, unless in strict mode.
+type mockTransport struct {
+	base     http.RoundTripper
+	registry *mockRegistry
+}
+
+func (t *mockTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	body, err := readRequestBody(request)
+	if err != nil {
+		return nil, err
+	}
+	mock := t.registry.match(request, body)
+	if mock == nil {
+		t.registry.mu.Lock()
+		strict := t.registry.strict
+		t.registry.mu.Unlock()
+		if strict {
+			return nil, fmt.Errorf("no mock matches %s %s", request.Method, request.URL)
+		}
+		return t.base.RoundTrip(request)
+	}
+
+	if mock.delay > 0 {
+		select {
+		case <-time.After(mock.delay):
+		case <-request.Context().Done():
+			return nil, request.Context().Err()
+		}
+	}
+	return &http.Response{
+		Status:        strings.TrimSpace(fmt.Sprintf("%d %s", mock.status, http.StatusText(mock.status))),
+		StatusCode:    mock.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header(readHeader(mock.headers)),
+		Body:          io.NopCloser(bytes.NewReader(mock.body)),
+		ContentLength: int64(len(mock.body)),
+		Request:       request,
+	}, nil
+}
+
+// A http.RoundTripper for the http_no_network entrypoint, which never touches the network
+type noNetworkTransport struct{}
+
+func (noNetworkTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("no mock matches %s %s, and network access is disabled", request.Method, request.URL)
+}
+
+/* http_mock(method, url_pattern, status, headers, body, [delay_ms])
+* Register a canned response for requests with the given method ('*' for any)
+* and a URL matching url_pattern, a glob where '*' matches any characters.
+* Returns the ID of the mock, as found in http_mock_calls.
+ */
+type HttpMockFunc struct{}
+
+func (*HttpMockFunc) Deterministic() bool { return false }
+func (*HttpMockFunc) Args() int           { return -1 }
+func (*HttpMockFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	if len(values) < 5 || len(values) > 6 {
+		c.ResultError(fmt.Errorf("usage: http_mock(method, url_pattern, status, headers, body, [delay_ms])"))
+		return
+	}
+	urlPattern, err := compileUrlPattern(values[1].Text())
+	if err != nil {
+		c.ResultError(err)
+		return
+	}
+	method := values[0].Text()
+	if values[0].Type() == sqlite.SQLITE_NULL || method == "" {
+		method = "*"
+	}
+	mock := &httpMock{
+		method:     method,
+		urlPattern: urlPattern,
+		status:     values[2].Int(),
+		headers:    values[3].Text(),
+		body:       values[4].Blob(),
+	}
+	if len(values) > 5 {
+		mock.delay = time.Duration(values[5].Int64()) * time.Millisecond
+	}
+
+	DoMocks.mu.Lock()
+	DoMocks.nextId += 1
+	mock.id = DoMocks.nextId
+	DoMocks.mocks = append(DoMocks.mocks, mock)
+	DoMocks.mu.Unlock()
+
+	c.ResultInt64(mock.id)
+}
+
+/* http_mock_strict(enabled)
+* When enabled, requests that match no mock raise an error instead of going to
+* the network. Disabled by default.
+ */
+type HttpMockStrictFunc struct{}
+
+func (*HttpMockStrictFunc) Deterministic() bool { return false }
+func (*HttpMockStrictFunc) Args() int           { return 1 }
+func (*HttpMockStrictFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	DoMocks.mu.Lock()
+	DoMocks.strict = values[0].Int() != 0
+	strict := DoMocks.strict
+	DoMocks.mu.Unlock()
+	if strict {
+		c.ResultInt(1)
+	} else {
+		c.ResultInt(0)
+	}
+}
+
+/* http_mock_reset()
+* Remove all registered mocks and recorded calls, and disable strict mode.
+ */
+type HttpMockResetFunc struct{}
+
+func (*HttpMockResetFunc) Deterministic() bool { return false }
+func (*HttpMockResetFunc) Args() int           { return 0 }
+func (*HttpMockResetFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	DoMocks.mu.Lock()
+	DoMocks.mocks = nil
+	DoMocks.calls = nil
+	DoMocks.strict = false
+	DoMocks.mu.Unlock()
+	c.ResultInt(1)
+}
+
+/** select * from http_mock_calls
+ * A table of every request made while mocking, in order, and the ID of the
+ * mock that answered it, NULL if none did.
+ */
+var MockCallsColumns = []vtab.Column{
+	{Name: "method", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "url", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "headers", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "body", Type: sqlite.SQLITE_BLOB.String()},
+	{Name: "mock_id", Type: sqlite.SQLITE_INTEGER.String()},
+	{Name: "requested_at", Type: sqlite.SQLITE_TEXT.String()},
+}
+
+type MockCallsCursor struct {
+	calls   []mockCall
+	current int
+}
+
+func (cur *MockCallsCursor) Column(ctx vtab.Context, c int) error {
+	col := MockCallsColumns[c]
+	call := cur.calls[cur.current]
+
+	switch col.Name {
+	case "method":
+		ctx.ResultText(call.method)
+	case "url":
+		ctx.ResultText(call.url)
+	case "headers":
+		ctx.ResultText(call.headers)
+	case "body":
+		if len(call.body) == 0 {
+			ctx.ResultNull()
+		} else {
+			ctx.ResultBlob(call.body)
+		}
+	case "mock_id":
+		if call.mockId == 0 {
+			ctx.ResultNull()
+		} else {
+			ctx.ResultInt64(call.mockId)
+		}
+	case "requested_at":
+		ctx.ResultText(*formatSqliteDatetime(&call.requestedAt))
+	}
+	return nil
+}
+
+func (cur *MockCallsCursor) Next() (vtab.Row, error) {
+	cur.current += 1
+	if cur.current >= len(cur.calls) {
+		return nil, io.EOF
+	}
+	return cur, nil
+}
+
+func MockCallsIterator(constraints []*vtab.Constraint, order []*sqlite.OrderBy) (vtab.Iterator, error) {
+	DoMocks.mu.Lock()
+	calls := append([]mockCall{}, DoMocks.calls...)
+	DoMocks.mu.Unlock()
+	return &MockCallsCursor{calls: calls, current: -1}, nil
+}
+
+func RegisterMock(api *sqlite.ExtensionApi) error {
+	if err := api.CreateModule("http_mock_calls", vtab.NewTableFunc("http_mock_calls", MockCallsColumns, MockCallsIterator)); err != nil {
+		return err
+	}
+	if err := api.CreateFunction("http_mock", &HttpMockFunc{}); err != nil {
+		return err
+	}
+	if err := api.CreateFunction("http_mock_strict", &HttpMockStrictFunc{}); err != nil {
+		return err
+	}
+	if err := api.CreateFunction("http_mock_reset", &HttpMockResetFunc{}); err != nil {
+		return err
+	}
+	return nil
+}
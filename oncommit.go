@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"go.riyazali.net/sqlite"
+)
+
+// Table that http_do_on_commit records requests into, and reports their results in
+const onCommitTable = "http_on_commit"
+
+// How often, and for how long, sending waits for a commit to be visible
+const (
+	onCommitPoll    = 10 * time.Millisecond
+	onCommitTimeout = databaseBusyTimeout
+)
+
+// Requests recorded by http_do_on_commit on a connection, sent once their transaction commits
+type onCommitQueue struct {
+	connection *connection
+	conn       *sqlite.Conn
+	// true for the http_no_network entrypoint, which only mocks can answer
+	noNetwork bool
+
+	// separate connection to the database file that requests are read and
+	// updated through once committed, opened by the first http_do_on_commit
+	db *database
+	// rows recorded in the current transaction
+	recorded []int64
+	closed   bool
+	mu       sync.Mutex
+	// held while sending a batch, so requests are sent in commit order
+	sendMu sync.Mutex
+}
+
+func newOnCommitQueue(connection *connection, noNetwork bool) *onCommitQueue {
+	q := &onCommitQueue{connection: connection, conn: connection.conn, noNetwork: noNetwork}
+	addTransactionHooks(q.connection, func() {
+		q.mu.Lock()
+		batch := q.recorded
+		q.recorded = nil
+		q.mu.Unlock()
+		if len(batch) > 0 {
+			// the commit isn't done yet, so send once it's visible to other connections
+			go q.send(batch)
+		}
+	}, func() {
+		q.mu.Lock()
+		q.recorded = nil
+		q.mu.Unlock()
+	})
+	connection.onClose(q.close)
+	return q
+}
+
+// The separate connection requests are sent from, opened if needed
+func (q *onCommitQueue) database() (*database, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, errDatabaseClosed
+	}
+	if q.db == nil {
+		db, err := openDatabase(q.conn, false)
+		if err != nil {
+			return nil, err
+		}
+		q.db = db
+	}
+	return q.db, nil
+}
+
+func (q *onCommitQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	if q.db != nil {
+		q.db.close()
+	}
+}
+
+// Create the table requests are recorded into, unless it exists. Done by every
+// http_do_on_commit call instead of only the first, since rolling back the
+// transaction of the first call also undoes the table.
+func (q *onCommitQueue) createTable() error {
+	sql := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s(
+  id INTEGER PRIMARY KEY,
+  created_at TEXT,
+  method TEXT,
+  url TEXT,
+  request_headers TEXT,
+  request_body BLOB,
+  status TEXT,
+  response_status TEXT,
+  response_status_code INT,
+  response_headers TEXT,
+  response_body BLOB,
+  error TEXT,
+  sent_at TEXT
+)`, quoteIdentifier(onCommitTable))
+	return q.conn.Exec(sql, nil)
+}
+
+// Read the given requests through the separate connection, once the commit
+// that recorded them is visible to it. The commit hook runs before the commit
+// is written, and a commit either makes all of its rows visible or none, so
+// requests are only missing once it's visible if rolled back to a savepoint.
+// Requests still unreadable after onCommitTimeout are marked as failed.
+func (q *onCommitQueue) committed(db *database, ids []int64) map[int64]*PrepareRequestParams {
+	sql := fmt.Sprintf(`SELECT method, url, request_headers, request_body FROM %s WHERE id = ? AND status = 'pending'`, quoteIdentifier(onCommitTable))
+	deadline := time.Now().Add(onCommitTimeout)
+	var lastErr error
+	for {
+		requests := map[int64]*PrepareRequestParams{}
+		for _, id := range ids {
+			err := db.exec(sql, func(stmt *databaseStmt) error {
+				requests[id] = &PrepareRequestParams{
+					method:     stmt.columnText(0),
+					url:        stmt.columnText(1),
+					headers:    stmt.columnText(2),
+					body:       stmt.columnBlob(3),
+					noNetwork:  q.noNetwork,
+					connection: q.connection,
+					background: true,
+				}
+				return nil
+			}, id)
+			if err == errDatabaseClosed {
+				return nil
+			}
+			if err != nil {
+				lastErr = err
+			}
+		}
+		if len(requests) > 0 {
+			return requests
+		}
+		// a failed commit or a batch entirely rolled back to savepoints never
+		// shows up, and then there's nothing to mark
+		if time.Now().After(deadline) {
+			message := "timed out waiting for the commit to be readable"
+			if lastErr != nil {
+				message = fmt.Sprintf("%s: %s", message, lastErr)
+			}
+			now := time.Now()
+			sql := fmt.Sprintf(`UPDATE %s SET status = 'failed', error = ?, sent_at = ? WHERE id = ? AND status = 'pending'`, quoteIdentifier(onCommitTable))
+			for _, id := range ids {
+				if err := db.exec(sql, nil, message, *formatSqliteDatetime(&now), id); err != nil {
+					warnf("http_do_on_commit couldn't mark request %d as failed: %s", id, err)
+				}
+			}
+			return requests
+		}
+		time.Sleep(onCommitPoll)
+	}
+}
+
+// Send the given requests in order once durably committed, skipping any that
+// were rolled back to a savepoint, and report their results in the table
+func (q *onCommitQueue) send(ids []int64) {
+	q.sendMu.Lock()
+	defer q.sendMu.Unlock()
+	db, err := q.database()
+	if err != nil {
+		return
+	}
+	requests := q.committed(db, ids)
+	for _, id := range ids {
+		params, ok := requests[id]
+		if !ok {
+			continue
+		}
+
+		var status, statusCode, responseHeaders, responseBody, errorMessage interface{}
+		result := "failed"
+		client, request, err := prepareRequest(params)
+		if err == nil {
+			response, doErr := client.Do(request)
+			err = doErr
+			if err == nil {
+				body, bodyErr := io.ReadAll(response.Body)
+				response.Body.Close()
+				headers := new(bytes.Buffer)
+				response.Header.Write(headers)
+				status, statusCode, responseHeaders, responseBody = response.Status, response.StatusCode, headers.String(), body
+				err = bodyErr
+			}
+		}
+		if err != nil {
+			errorMessage = err.Error()
+		} else {
+			result = "sent"
+		}
+
+		now := time.Now()
+		sql := fmt.Sprintf(`UPDATE %s SET status = ?, response_status = ?, response_status_code = ?, response_headers = ?, response_body = ?, error = ?, sent_at = ? WHERE id = ?`, quoteIdentifier(onCommitTable))
+		db.exec(sql, nil, result, status, statusCode, responseHeaders, responseBody, errorMessage, *formatSqliteDatetime(&now), id)
+	}
+}
+
+/* http_do_on_commit(method, url, [headers], [body])
+* Record a request into the http_on_commit table, and only send it once the
+* current transaction commits. Rolled back requests are never sent. Returns
+* the ID of the request's row, where its response is reported once sent. The
+* table is created by the first call.
+ */
+type HttpDoOnCommitFunc struct {
+	queue *onCommitQueue
+}
+
+func (*HttpDoOnCommitFunc) Deterministic() bool { return false }
+func (*HttpDoOnCommitFunc) Args() int           { return -1 }
+func (f *HttpDoOnCommitFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	if len(values) < 2 || len(values) > 4 {
+		c.ResultError(fmt.Errorf("usage: http_do_on_commit(method, url, [headers], [body])"))
+		return
+	}
+	var headers, body interface{}
+	if len(values) > 2 && values[2].Type() != sqlite.SQLITE_NULL {
+		headers = values[2].Text()
+	}
+	if len(values) > 3 && values[3].Type() != sqlite.SQLITE_NULL {
+		body = values[3].Blob()
+	}
+	// opened now, for errors like an in-memory database to show up here
+	if _, err := f.queue.database(); err != nil {
+		c.ResultError(fmt.Errorf("http_do_on_commit() %s", err))
+		return
+	}
+	if err := f.queue.createTable(); err != nil {
+		c.ResultError(fmt.Errorf("http_do_on_commit() creating %s: %s", onCommitTable, err))
+		return
+	}
+
+	now := time.Now()
+	var id int64
+	sql := fmt.Sprintf(`INSERT INTO %s(created_at, method, url, request_headers, request_body, status) VALUES (?, ?, ?, ?, ?, 'pending') RETURNING id`, quoteIdentifier(onCommitTable))
+	err := f.queue.conn.Exec(sql, func(stmt *sqlite.Stmt) error {
+		id = stmt.ColumnInt64(0)
+		return nil
+	}, *formatSqliteDatetime(&now), values[0].Text(), values[1].Text(), headers, body)
+	if err != nil {
+		c.ResultError(err)
+		return
+	}
+
+	f.queue.mu.Lock()
+	f.queue.recorded = append(f.queue.recorded, id)
+	f.queue.mu.Unlock()
+	c.ResultInt64(id)
+}
+
+func RegisterOnCommit(api *sqlite.ExtensionApi, connection *connection, noNetwork bool) error {
+	queue := newOnCommitQueue(connection, noNetwork)
+	if err := api.CreateFunction("http_do_on_commit", &HttpDoOnCommitFunc{queue: queue}); err != nil {
+		return err
+	}
+	return nil
+}
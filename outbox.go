@@ -0,0 +1,651 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.riyazali.net/sqlite"
+)
+
+const (
+	// waiting to be delivered, possibly after a failed attempt
+	outboxPending = "pending"
+	// claimed by a worker that's delivering it right now
+	outboxDelivering = "delivering"
+	// delivered with a 2xx response
+	outboxDelivered = "delivered"
+	// failed with a non retryable response, or out of attempts
+	outboxFailed = "failed"
+)
+
+// How long a claimed request can stay 'delivering', before any worker can
+// claim it again, like after the process delivering it exited
+const outboxLease = 5 * time.Minute
+
+// The columns of http_outbox tables, in order. The shadow table has the same
+// columns after its "id" primary key, which is the rowid of the virtual table.
+var outboxColumns = []string{
+	"method",
+	"url",
+	"headers",
+	"body",
+	"status",
+	"attempts",
+	"max_attempts",
+	"next_attempt_at",
+	"last_error",
+	"response_status_code",
+	"response_headers",
+	"response_body",
+	"created_at",
+	"delivered_at",
+}
+
+const outboxSchema = `CREATE TABLE x(
+  method TEXT,
+  url TEXT,
+  headers TEXT,
+  body BLOB,
+  status TEXT,
+  attempts INT,
+  max_attempts INT,
+  next_attempt_at TEXT,
+  last_error TEXT,
+  response_status_code INT,
+  response_headers TEXT,
+  response_body BLOB,
+  created_at TEXT,
+  delivered_at TEXT
+)`
+
+// Options of an outbox, set as key=value arguments of CREATE VIRTUAL TABLE
+type outboxOptions struct {
+	// attempts before a request is marked as failed, unless set per request
+	maxAttempts int
+	// delay before the first retry, doubled after every failed attempt
+	backoff time.Duration
+	// maximum number of requests delivered at once to the same host
+	concurrency int
+	// how often to look for requests to retry
+	poll time.Duration
+}
+
+func parseOutboxOptions(args []string) (*outboxOptions, error) {
+	options := &outboxOptions{maxAttempts: 5, backoff: time.Second, concurrency: 1, poll: time.Second}
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid http_outbox option %q, expected key=value", arg)
+		}
+		n, err := strconv.Atoi(strings.Trim(strings.TrimSpace(value), `'"`))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("http_outbox option %s must be a positive integer", strings.TrimSpace(key))
+		}
+		switch strings.TrimSpace(key) {
+		case "max_attempts":
+			options.maxAttempts = n
+		case "backoff_ms":
+			options.backoff = time.Duration(n) * time.Millisecond
+		case "concurrency":
+			options.concurrency = n
+		case "poll_ms":
+			options.poll = time.Duration(n) * time.Millisecond
+		default:
+			return nil, fmt.Errorf("unknown http_outbox option %q", strings.TrimSpace(key))
+		}
+	}
+	return options, nil
+}
+
+/* CREATE VIRTUAL TABLE webhooks USING http_outbox([max_attempts=5], [backoff_ms=1000], [concurrency=1], [poll_ms=1000])
+* A table of HTTP requests to deliver in the background. Inserted requests are
+* stored in the webhooks_requests shadow table, and only delivered once their
+* transaction commits. Failed requests are retried with exponential backoff.
+* The worker reads and updates requests through a separate connection, so it
+* only ever sees committed requests.
+ */
+type OutboxModule struct {
+	connection *connection
+}
+
+func (m *OutboxModule) Create(conn *sqlite.Conn, args []string, declare func(string) error) (sqlite.VirtualTable, error) {
+	table, err := m.connect(conn, args, declare)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s(id INTEGER PRIMARY KEY, %s)`, quoteIdentifier(table.shadow), strings.Join(outboxColumns, ", ")), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := table.start(); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+func (m *OutboxModule) Connect(conn *sqlite.Conn, args []string, declare func(string) error) (sqlite.VirtualTable, error) {
+	table, err := m.connect(conn, args, declare)
+	if err != nil {
+		return nil, err
+	}
+	if err := table.start(); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+func (m *OutboxModule) connect(conn *sqlite.Conn, args []string, declare func(string) error) (*OutboxTable, error) {
+	// args are the module name, database name, and table name, then the options
+	if len(args) < 3 {
+		return nil, fmt.Errorf("http_outbox requires a table name")
+	}
+	options, err := parseOutboxOptions(args[3:])
+	if err != nil {
+		return nil, err
+	}
+	if err := declare(outboxSchema); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &OutboxTable{
+		connection: m.connection,
+		conn:       conn,
+		shadow:     args[2] + "_requests",
+		options:    options,
+		inflight:   map[int64]bool{},
+		hostLimits: map[string]chan struct{}{},
+		wake:       make(chan struct{}, 1),
+		ctx:        ctx,
+		cancel:     cancel,
+	}, nil
+}
+
+type OutboxTable struct {
+	// the connection whose log deliveries go into
+	connection *connection
+	conn       *sqlite.Conn
+	// the worker's own connection to the database file
+	db      *database
+	shadow  string
+	options *outboxOptions
+
+	// whether the current transaction queued a request
+	queued bool
+	// requests this worker is delivering or waiting to deliver, so it only
+	// starts once for each. Workers of other connections go by the claim.
+	inflight map[int64]bool
+	// a semaphore per host, to limit concurrent deliveries
+	hostLimits map[string]chan struct{}
+
+	removeHooks func()
+	wake        chan struct{}
+	// cancelled when the table is disconnected, to stop the worker and its deliveries
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+	closed  bool
+	mu      sync.Mutex
+}
+
+func (t *OutboxTable) start() error {
+	db, err := openDatabase(t.conn, false)
+	if err != nil {
+		return fmt.Errorf("http_outbox %s", err)
+	}
+	t.db = db
+	t.removeHooks = addTransactionHooks(t.connection, func() {
+		t.mu.Lock()
+		queued := t.queued
+		t.queued = false
+		t.mu.Unlock()
+		// the worker waits for the commit to finish before it can read
+		if queued {
+			t.notify()
+		}
+	}, func() {
+		t.mu.Lock()
+		t.queued = false
+		t.mu.Unlock()
+	})
+	t.workers.Add(1)
+	go t.work()
+	return nil
+}
+
+// Stop the worker and cancel deliveries, waiting for them to return
+func (t *OutboxTable) stop() {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.closed = true
+	t.removeHooks()
+	t.cancel()
+	t.mu.Unlock()
+	t.workers.Wait()
+	t.db.close()
+}
+
+// Wake up the worker to look for requests to deliver
+func (t *OutboxTable) notify() {
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (t *OutboxTable) work() {
+	defer t.workers.Done()
+	ticker := time.NewTicker(t.options.poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-t.wake:
+		case <-ticker.C:
+		}
+		t.deliverDue()
+	}
+}
+
+// A queued request, as read by the worker
+type outboxRequest struct {
+	id          int64
+	method      string
+	url         string
+	headers     string
+	body        []byte
+	attempts    int
+	maxAttempts int
+}
+
+// Start delivering every committed request that's due, either pending or
+// claimed by a worker whose lease ran out
+func (t *OutboxTable) deliverDue() {
+	now := time.Now()
+	due := []*outboxRequest{}
+	sql := fmt.Sprintf(`SELECT id, method, url, headers, body, attempts, max_attempts FROM %s WHERE status IN (?, ?) AND next_attempt_at <= ? ORDER BY id`, quoteIdentifier(t.shadow))
+	err := t.db.exec(sql, func(stmt *databaseStmt) error {
+		due = append(due, &outboxRequest{
+			id:          stmt.columnInt64(0),
+			method:      stmt.columnText(1),
+			url:         stmt.columnText(2),
+			headers:     stmt.columnText(3),
+			body:        stmt.columnBlob(4),
+			attempts:    int(stmt.columnInt64(5)),
+			maxAttempts: int(stmt.columnInt64(6)),
+		})
+		return nil
+	}, outboxPending, outboxDelivering, *formatSqliteDatetime(&now))
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, request := range due {
+		if t.closed || t.inflight[request.id] {
+			continue
+		}
+		t.inflight[request.id] = true
+		t.workers.Add(1)
+		go t.deliver(request)
+	}
+}
+
+// Returns the semaphore limiting concurrent deliveries to the host of the given URL
+func (t *OutboxTable) hostLimit(rawUrl string) chan struct{} {
+	host := rawUrl
+	if u, err := url.Parse(rawUrl); err == nil {
+		host = u.Host
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	limit, ok := t.hostLimits[host]
+	if !ok {
+		limit = make(chan struct{}, t.options.concurrency)
+		t.hostLimits[host] = limit
+	}
+	return limit
+}
+
+// Returns true if a request that failed with the given status code should be retried
+func retryableStatus(code int) bool {
+	return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+}
+
+// Claim the given request for this worker, unless another one claimed or
+// changed it since it was read. Returns true if it's this worker's to deliver.
+func (t *OutboxTable) claim(request *outboxRequest) bool {
+	now := time.Now()
+	lease := now.Add(outboxLease)
+	sql := fmt.Sprintf(`UPDATE %s SET status = ?, next_attempt_at = ? WHERE id = ? AND status IN (?, ?) AND attempts = ? AND next_attempt_at <= ?`, quoteIdentifier(t.shadow))
+	claimed, err := t.db.update(sql, outboxDelivering, *formatSqliteDatetime(&lease), request.id, outboxPending, outboxDelivering, request.attempts, *formatSqliteDatetime(&now))
+	return err == nil && claimed == 1
+}
+
+func (t *OutboxTable) deliver(request *outboxRequest) {
+	defer t.workers.Done()
+	defer func() {
+		t.mu.Lock()
+		delete(t.inflight, request.id)
+		t.mu.Unlock()
+	}()
+	limit := t.hostLimit(request.url)
+	select {
+	case limit <- struct{}{}:
+	case <-t.ctx.Done():
+		return
+	}
+	defer func() { <-limit }()
+	if !t.claim(request) {
+		return
+	}
+
+	var statusCode, responseHeaders, responseBody, lastError interface{}
+	status := outboxDelivered
+	retry := false
+
+	client, httpRequest, err := prepareRequest(&PrepareRequestParams{
+		method:     request.method,
+		url:        request.url,
+		headers:    request.headers,
+		body:       request.body,
+		connection: t.connection,
+		background: true,
+	})
+	if err == nil {
+		var response *http.Response
+		response, err = client.Do(httpRequest.WithContext(t.ctx))
+		if err == nil {
+			body, bodyErr := io.ReadAll(response.Body)
+			response.Body.Close()
+			headers := new(bytes.Buffer)
+			response.Header.Write(headers)
+			statusCode, responseHeaders, responseBody = response.StatusCode, headers.String(), body
+			if bodyErr != nil {
+				err = bodyErr
+				retry = true
+			} else if response.StatusCode < 200 || response.StatusCode > 299 {
+				err = fmt.Errorf("unexpected response status %s", response.Status)
+				retry = retryableStatus(response.StatusCode)
+			}
+		} else {
+			retry = true
+		}
+	}
+
+	attempts := request.attempts + 1
+	now := time.Now()
+	var deliveredAt interface{}
+	nextAttemptAt := *formatSqliteDatetime(&now)
+	if err != nil {
+		lastError = err.Error()
+		status = outboxFailed
+		if retry && attempts < request.maxAttempts {
+			status = outboxPending
+			next := now.Add(t.options.backoff * time.Duration(1<<min(attempts-1, 20)))
+			nextAttemptAt = *formatSqliteDatetime(&next)
+		}
+	} else {
+		deliveredAt = nextAttemptAt
+	}
+
+	// a delivery cancelled by the table closing is released to be attempted
+	// again, one whose update fails is attempted again once its lease runs out
+	if t.ctx.Err() != nil {
+		sql := fmt.Sprintf(`UPDATE %s SET status = ?, next_attempt_at = ? WHERE id = ? AND status = ?`, quoteIdentifier(t.shadow))
+		t.db.exec(sql, nil, outboxPending, *formatSqliteDatetime(&now), request.id, outboxDelivering)
+		return
+	}
+	sql := fmt.Sprintf(`UPDATE %s SET status = ?, attempts = ?, next_attempt_at = ?, last_error = ?, response_status_code = ?, response_headers = ?, response_body = ?, delivered_at = ? WHERE id = ?`, quoteIdentifier(t.shadow))
+	t.db.exec(sql, nil, status, attempts, nextAttemptAt, lastError, statusCode, responseHeaders, responseBody, deliveredAt, request.id)
+}
+
+// Bits of the index number, for the equality constraints passed to Filter in this order
+const (
+	outboxIndexRowid = 1 << iota
+	outboxIndexStatus
+)
+
+// Index of the status column
+const outboxStatusColumn = 4
+
+func (t *OutboxTable) BestIndex(input *sqlite.IndexInfoInput) (*sqlite.IndexInfoOutput, error) {
+	usage := make([]*sqlite.ConstraintUsage, len(input.Constraints))
+	rowid, status := -1, -1
+	for i, constraint := range input.Constraints {
+		usage[i] = &sqlite.ConstraintUsage{}
+		if !constraint.Usable || constraint.Op != sqlite.INDEX_CONSTRAINT_EQ {
+			continue
+		}
+		if constraint.ColumnIndex == -1 && rowid < 0 {
+			rowid = i
+		} else if constraint.ColumnIndex == outboxStatusColumn && status < 0 {
+			status = i
+		}
+	}
+
+	index := 0
+	cost := 1000000.0
+	argv := 0
+	if rowid >= 0 {
+		argv += 1
+		usage[rowid] = &sqlite.ConstraintUsage{ArgvIndex: argv, Omit: true}
+		index |= outboxIndexRowid
+		cost = 1
+	}
+	if status >= 0 {
+		argv += 1
+		usage[status] = &sqlite.ConstraintUsage{ArgvIndex: argv, Omit: true}
+		index |= outboxIndexStatus
+		cost = min(cost, 1000)
+	}
+	return &sqlite.IndexInfoOutput{ConstraintUsage: usage, IndexNumber: index, EstimatedCost: cost}, nil
+}
+
+func (t *OutboxTable) Open() (sqlite.VirtualCursor, error) {
+	return &OutboxCursor{table: t}, nil
+}
+
+func (t *OutboxTable) Disconnect() error {
+	t.stop()
+	return nil
+}
+
+func (t *OutboxTable) Destroy() error {
+	t.stop()
+	return t.conn.Exec(fmt.Sprintf(`DROP TABLE IF EXISTS %s`, quoteIdentifier(t.shadow)), nil)
+}
+
+// Returns the value of the given column for the shadow table, or def if NULL
+func outboxValue(value sqlite.Value, def interface{}) interface{} {
+	switch value.Type() {
+	case sqlite.SQLITE_NULL:
+		return def
+	case sqlite.SQLITE_INTEGER:
+		return value.Int64()
+	case sqlite.SQLITE_FLOAT:
+		return value.Float()
+	case sqlite.SQLITE_BLOB:
+		return value.Blob()
+	default:
+		return value.Text()
+	}
+}
+
+// Enqueue a request, given values for every column. Only method, url, headers,
+// body, and max_attempts are used, the rest are reset for the new request.
+func (t *OutboxTable) Insert(values ...sqlite.Value) (int64, error) {
+	if len(values) != len(outboxColumns) {
+		return 0, fmt.Errorf("expected %d values, got %d", len(outboxColumns), len(values))
+	}
+	if values[1].Type() == sqlite.SQLITE_NULL || values[1].Text() == "" {
+		return 0, fmt.Errorf("http_outbox requests require a url")
+	}
+	method := "POST"
+	if values[0].Type() != sqlite.SQLITE_NULL && values[0].Text() != "" {
+		method = strings.ToUpper(values[0].Text())
+	}
+	now := time.Now()
+	createdAt := *formatSqliteDatetime(&now)
+
+	var id int64
+	sql := fmt.Sprintf(`INSERT INTO %s(method, url, headers, body, status, attempts, max_attempts, next_attempt_at, created_at) VALUES (?, ?, ?, ?, ?, 0, ?, ?, ?) RETURNING id`, quoteIdentifier(t.shadow))
+	err := t.conn.Exec(sql, func(stmt *sqlite.Stmt) error {
+		id = stmt.ColumnInt64(0)
+		return nil
+	},
+		method,
+		values[1].Text(),
+		outboxValue(values[2], nil),
+		outboxValue(values[3], nil),
+		outboxPending,
+		outboxValue(values[6], int64(t.options.maxAttempts)),
+		createdAt,
+		createdAt,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	t.mu.Lock()
+	t.queued = true
+	t.mu.Unlock()
+	return id, nil
+}
+
+// Update every column of the given request. Requests set back to 'pending'
+// are delivered again once the transaction commits.
+func (t *OutboxTable) Update(rowid sqlite.Value, values ...sqlite.Value) error {
+	if len(values) != len(outboxColumns) {
+		return fmt.Errorf("expected %d values, got %d", len(outboxColumns), len(values))
+	}
+	assignments := make([]string, len(outboxColumns))
+	args := make([]interface{}, len(outboxColumns)+1)
+	for i, column := range outboxColumns {
+		assignments[i] = column + " = ?"
+		args[i] = outboxValue(values[i], nil)
+	}
+	id := rowid.Int64()
+	args[len(outboxColumns)] = id
+	sql := fmt.Sprintf(`UPDATE %s SET %s WHERE id = ?`, quoteIdentifier(t.shadow), strings.Join(assignments, ", "))
+	if err := t.conn.Exec(sql, nil, args...); err != nil {
+		return err
+	}
+
+	if values[4].Text() == outboxPending {
+		t.mu.Lock()
+		t.queued = true
+		t.mu.Unlock()
+	}
+	return nil
+}
+
+func (t *OutboxTable) Replace(old, new sqlite.Value, _ ...sqlite.Value) error {
+	return fmt.Errorf("the rowid of http_outbox requests can't be changed")
+}
+
+func (t *OutboxTable) Delete(rowid sqlite.Value) error {
+	return t.conn.Exec(fmt.Sprintf(`DELETE FROM %s WHERE id = ?`, quoteIdentifier(t.shadow)), nil, rowid.Int64())
+}
+
+// Steps through the rows of the shadow table, one at a time
+type OutboxCursor struct {
+	table *OutboxTable
+	stmt  *sqlite.Stmt
+	eof   bool
+}
+
+func (cur *OutboxCursor) Filter(index int, _ string, values ...sqlite.Value) error {
+	cur.Close()
+	where := []string{"1"}
+	args := []interface{}{}
+	if index&outboxIndexRowid != 0 {
+		where = append(where, "id = ?")
+		args = append(args, outboxValue(values[len(args)], nil))
+	}
+	if index&outboxIndexStatus != 0 {
+		where = append(where, "status = ?")
+		args = append(args, outboxValue(values[len(args)], nil))
+	}
+	sql := fmt.Sprintf(`SELECT id, %s FROM %s WHERE %s ORDER BY id`, strings.Join(outboxColumns, ", "), quoteIdentifier(cur.table.shadow), strings.Join(where, " AND "))
+	stmt, _, err := cur.table.conn.Prepare(sql)
+	if err != nil {
+		return err
+	}
+	cur.stmt = stmt
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case nil:
+			stmt.BindNull(i + 1)
+		case int64:
+			stmt.BindInt64(i+1, v)
+		case float64:
+			stmt.BindFloat(i+1, v)
+		case []byte:
+			stmt.BindBlob(i+1, v)
+		case string:
+			stmt.BindText(i+1, v)
+		}
+	}
+	return cur.Next()
+}
+
+func (cur *OutboxCursor) Next() error {
+	more, err := cur.stmt.Step()
+	cur.eof = !more
+	return err
+}
+
+func (cur *OutboxCursor) Rowid() (int64, error) {
+	return cur.stmt.ColumnInt64(0), nil
+}
+
+func (cur *OutboxCursor) Column(ctx *sqlite.VirtualTableContext, c int) error {
+	// the shadow table's columns come after its id
+	i := c + 1
+	switch cur.stmt.ColumnType(i) {
+	case sqlite.SQLITE_NULL:
+		ctx.ResultNull()
+	case sqlite.SQLITE_INTEGER:
+		ctx.ResultInt64(cur.stmt.ColumnInt64(i))
+	case sqlite.SQLITE_FLOAT:
+		ctx.ResultFloat(cur.stmt.ColumnFloat(i))
+	case sqlite.SQLITE_TEXT:
+		ctx.ResultText(cur.stmt.ColumnText(i))
+	case sqlite.SQLITE_BLOB:
+		ctx.ResultBlob([]byte(cur.stmt.ColumnText(i)))
+	}
+	return nil
+}
+
+func (cur *OutboxCursor) Eof() bool {
+	return cur.eof
+}
+
+func (cur *OutboxCursor) Close() error {
+	if cur.stmt == nil {
+		return nil
+	}
+	err := cur.stmt.Finalize()
+	cur.stmt = nil
+	return err
+}
+
+func RegisterOutbox(api *sqlite.ExtensionApi, connection *connection) error {
+	if err := api.CreateModule("http_outbox", &OutboxModule{connection: connection}); err != nil {
+		return err
+	}
+	return nil
+}
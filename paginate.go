@@ -0,0 +1,439 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/asg017/sqlite-http/internal/vtab"
+	"go.riyazali.net/sqlite"
+)
+
+// A single link from a RFC 8288 "Link" header, like `<https://example.com/?page=2>; rel="next"`
+type link struct {
+	target string
+	params map[string]string
+}
+
+// Parse all links found in the given "Link" header values
+func parseLinkHeader(values []string) []link {
+	links := []link{}
+	for _, value := range values {
+		for len(value) > 0 {
+			start := strings.IndexByte(value, '<')
+			if start < 0 {
+				break
+			}
+			end := strings.IndexByte(value[start:], '>')
+			if end < 0 {
+				break
+			}
+			l := link{target: value[start+1 : start+end], params: map[string]string{}}
+			value = value[start+end+1:]
+
+			// parameters continue until the next unquoted comma
+			for {
+				value = strings.TrimLeft(value, " \t")
+				if len(value) == 0 || value[0] != ';' {
+					break
+				}
+				value = strings.TrimLeft(value[1:], " \t")
+				nameEnd := strings.IndexAny(value, "=;,")
+				if nameEnd < 0 {
+					l.params[strings.ToLower(strings.TrimSpace(value))] = ""
+					value = ""
+					break
+				}
+				name := strings.ToLower(strings.TrimSpace(value[:nameEnd]))
+				if value[nameEnd] != '=' {
+					l.params[name] = ""
+					value = value[nameEnd:]
+					continue
+				}
+				value = strings.TrimLeft(value[nameEnd+1:], " \t")
+				var paramValue string
+				if len(value) > 0 && value[0] == '"' {
+					var b strings.Builder
+					i := 1
+					for ; i < len(value) && value[i] != '"'; i++ {
+						if value[i] == '\\' && i+1 < len(value) {
+							i++
+						}
+						b.WriteByte(value[i])
+					}
+					paramValue = b.String()
+					if i < len(value) {
+						i++
+					}
+					value = value[i:]
+				} else {
+					valueEnd := strings.IndexAny(value, ";,")
+					if valueEnd < 0 {
+						valueEnd = len(value)
+					}
+					paramValue = strings.TrimSpace(value[:valueEnd])
+					value = value[valueEnd:]
+				}
+				l.params[name] = paramValue
+			}
+			links = append(links, l)
+		}
+	}
+	return links
+}
+
+// Returns the target of the first link with the given relation type, resolved
+// against base, or "" if none exists. "rel" can contain multiple space-separated types.
+func findLinkRel(header http.Header, base *url.URL, rel string) string {
+	for _, l := range parseLinkHeader(header.Values("Link")) {
+		for _, r := range strings.Fields(l.params["rel"]) {
+			if strings.EqualFold(r, rel) {
+				target, err := base.Parse(l.target)
+				if err != nil {
+					return ""
+				}
+				return target.String()
+			}
+		}
+	}
+	return ""
+}
+
+/** select * from http_paginate(url, headers, max_pages)
+ * A table function that follows "Link: <...>; rel=next" headers, yielding
+ * one row per page with the same columns as http_get.
+ */
+var PaginateTableColumns = append([]vtab.Column{
+	{Name: "url", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "headers", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "max_pages", Type: sqlite.SQLITE_INTEGER.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "page_number", Type: sqlite.SQLITE_INTEGER.String()},
+}, SharedDoTableColumns...)
+
+// A cursor over pages of responses, shared by all http_paginate* table functions
+type PaginateCursor struct {
+	connection *connection
+	columns    []vtab.Column
+	headers    string
+	maxPages   int
+
+	// URL of the next page to request, "" if there are no more pages
+	nextUrl string
+	// URLs already requested, to avoid looping on misbehaving servers
+	visited map[string]bool
+	// Computes the URL of the page after the given one, "" if there are no more pages
+	nextPage func(page *HttpDoCursor) (string, error)
+	// Reports whether the given page is past the last one and isn't yielded, nil if every page is
+	pastEnd func(page *HttpDoCursor) (bool, error)
+
+	pageNumber int
+	page       *HttpDoCursor
+}
+
+func (cur *PaginateCursor) Column(ctx vtab.Context, c int) error {
+	col := cur.columns[c]
+
+	switch col.Name {
+	case "page_number":
+		ctx.ResultInt(cur.pageNumber)
+	default:
+		return cur.page.Column(ctx, c)
+	}
+	return nil
+}
+
+func (cur *PaginateCursor) Next() (vtab.Row, error) {
+	cur.Close()
+	if cur.nextUrl == "" || cur.visited[cur.nextUrl] {
+		return nil, io.EOF
+	}
+	if cur.maxPages > 0 && cur.pageNumber >= cur.maxPages {
+		return nil, io.EOF
+	}
+
+	page, err := newHttpDoCursor(&PrepareRequestParams{method: "GET", url: cur.nextUrl, headers: cur.headers, body: nil, cookies: "", connection: cur.connection}, cur.columns)
+	if err != nil {
+		return nil, err
+	}
+	cur.visited[cur.nextUrl] = true
+	cur.page = page
+	if cur.pastEnd != nil {
+		end, err := cur.pastEnd(page)
+		if err != nil {
+			return nil, err
+		}
+		if end {
+			cur.Close()
+			return nil, io.EOF
+		}
+	}
+	cur.pageNumber += 1
+
+	cur.nextUrl, err = cur.nextPage(page)
+	if err != nil {
+		return nil, err
+	}
+
+	return cur, nil
+}
+
+// Close the current page's response, called when SQLite stops reading rows early
+func (cur *PaginateCursor) Close() error {
+	if cur.page == nil {
+		return nil
+	}
+	return cur.page.response.Body.Close()
+}
+
+func PaginateTableIterator(connection *connection, constraints []*vtab.Constraint, order []*sqlite.OrderBy) (vtab.Iterator, error) {
+	cursor := PaginateCursor{
+		connection: connection,
+		columns:    PaginateTableColumns,
+		visited:    map[string]bool{},
+		// the body is still read lazily by the "response_body" column, only the headers are needed here
+		nextPage: func(page *HttpDoCursor) (string, error) {
+			return findLinkRel(page.response.Header, page.request.URL, "next"), nil
+		},
+	}
+
+	for _, constraint := range constraints {
+		if constraint.Op == sqlite.INDEX_CONSTRAINT_EQ {
+			column := PaginateTableColumns[constraint.ColIndex]
+			switch column.Name {
+			case "url":
+				cursor.nextUrl = constraint.Value.Text()
+			case "headers":
+				cursor.headers = constraint.Value.Text()
+			case "max_pages":
+				cursor.maxPages = constraint.Value.Int()
+			}
+		}
+	}
+
+	return &cursor, nil
+}
+
+// Returns the given URL with the query parameter name set to value
+func withQueryParam(rawUrl string, name string, value string) (string, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set(name, value)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Format a value from jsonExtract as a string for a URL, "" for null or empty values
+func jsonCursorString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		buf, _ := json.Marshal(v)
+		return string(buf)
+	}
+}
+
+/** select * from http_paginate_cursor(url, cursor_path, cursor_param, headers, max_pages)
+ * A table function that follows a "next cursor" found in each JSON response body at
+ * cursor_path, passing it as the cursor_param query parameter of the next request.
+ * If cursor_param is empty, the cursor is treated as the URL of the next page.
+ */
+var PaginateCursorTableColumns = append([]vtab.Column{
+	{Name: "url", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "cursor_path", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "cursor_param", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "headers", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "max_pages", Type: sqlite.SQLITE_INTEGER.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "page_number", Type: sqlite.SQLITE_INTEGER.String()},
+}, SharedDoTableColumns...)
+
+func PaginateCursorTableIterator(connection *connection, constraints []*vtab.Constraint, order []*sqlite.OrderBy) (vtab.Iterator, error) {
+	var startUrl string
+	var cursorPath string
+	var cursorParam string
+	cursor := PaginateCursor{
+		connection: connection,
+		columns:    PaginateCursorTableColumns,
+		visited:    map[string]bool{},
+	}
+
+	for _, constraint := range constraints {
+		if constraint.Op == sqlite.INDEX_CONSTRAINT_EQ {
+			column := PaginateCursorTableColumns[constraint.ColIndex]
+			switch column.Name {
+			case "url":
+				startUrl = constraint.Value.Text()
+			case "cursor_path":
+				cursorPath = constraint.Value.Text()
+			case "cursor_param":
+				cursorParam = constraint.Value.Text()
+			case "headers":
+				cursor.headers = constraint.Value.Text()
+			case "max_pages":
+				cursor.maxPages = constraint.Value.Int()
+			}
+		}
+	}
+
+	steps, err := parseJsonPath(cursorPath)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor.nextUrl = startUrl
+	cursor.nextPage = func(page *HttpDoCursor) (string, error) {
+		body, err := page.readBody()
+		if err != nil {
+			return "", err
+		}
+		value, _ := jsonExtract(body, steps)
+		next := jsonCursorString(value)
+		if next == "" {
+			return "", nil
+		}
+		if cursorParam == "" {
+			target, err := page.request.URL.Parse(next)
+			if err != nil {
+				return "", err
+			}
+			return target.String(), nil
+		}
+		return withQueryParam(startUrl, cursorParam, next)
+	}
+
+	return &cursor, nil
+}
+
+/** select * from http_paginate_offset(url, param, start, step, items_path, headers, max_pages)
+ * A table function that requests pages by incrementing the param query parameter
+ * by step, starting at start, until the JSON array found at items_path is empty.
+ * That final empty page isn't yielded.
+ */
+var PaginateOffsetTableColumns = append([]vtab.Column{
+	{Name: "url", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "param", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "start", Type: sqlite.SQLITE_INTEGER.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "step", Type: sqlite.SQLITE_INTEGER.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "items_path", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "headers", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "max_pages", Type: sqlite.SQLITE_INTEGER.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "page_number", Type: sqlite.SQLITE_INTEGER.String()},
+}, SharedDoTableColumns...)
+
+func PaginateOffsetTableIterator(connection *connection, constraints []*vtab.Constraint, order []*sqlite.OrderBy) (vtab.Iterator, error) {
+	var startUrl string
+	var param string
+	var itemsPath string
+	start := 1
+	step := 1
+	cursor := PaginateCursor{
+		connection: connection,
+		columns:    PaginateOffsetTableColumns,
+		visited:    map[string]bool{},
+	}
+
+	for _, constraint := range constraints {
+		if constraint.Op == sqlite.INDEX_CONSTRAINT_EQ {
+			column := PaginateOffsetTableColumns[constraint.ColIndex]
+			switch column.Name {
+			case "url":
+				startUrl = constraint.Value.Text()
+			case "param":
+				param = constraint.Value.Text()
+			case "start":
+				start = constraint.Value.Int()
+			case "step":
+				step = constraint.Value.Int()
+			case "items_path":
+				itemsPath = constraint.Value.Text()
+			case "headers":
+				cursor.headers = constraint.Value.Text()
+			case "max_pages":
+				cursor.maxPages = constraint.Value.Int()
+			}
+		}
+	}
+
+	if param == "" {
+		return nil, errors.New("http_paginate_offset requires a param name")
+	}
+	if step == 0 {
+		return nil, errors.New("http_paginate_offset step must not be 0")
+	}
+	steps, err := parseJsonPath(itemsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor.nextUrl, err = withQueryParam(startUrl, param, strconv.Itoa(start))
+	if err != nil {
+		return nil, err
+	}
+	isSuccess := func(page *HttpDoCursor) bool {
+		return page.response.StatusCode >= 200 && page.response.StatusCode <= 299
+	}
+	// a successful page without items is past the last one
+	cursor.pastEnd = func(page *HttpDoCursor) (bool, error) {
+		if !isSuccess(page) {
+			return false, nil
+		}
+		body, err := page.readBody()
+		if err != nil {
+			return false, err
+		}
+		value, found := jsonExtract(body, steps)
+		if !found {
+			return false, fmt.Errorf("http_paginate_offset items_path %s not found in the response", itemsPath)
+		}
+		items, ok := value.([]interface{})
+		if !ok {
+			return false, fmt.Errorf("http_paginate_offset items_path %s must be an array, found %s", itemsPath, jsonTypeOf(value))
+		}
+		return len(items) == 0, nil
+	}
+	// a non-2xx response is yielded, but is the last page
+	cursor.nextPage = func(page *HttpDoCursor) (string, error) {
+		if !isSuccess(page) {
+			return "", nil
+		}
+		return withQueryParam(startUrl, param, strconv.Itoa(start+step*cursor.pageNumber))
+	}
+
+	return &cursor, nil
+}
+
+func RegisterPaginate(api *sqlite.ExtensionApi, connection *connection) error {
+	paginate := func(constraints []*vtab.Constraint, order []*sqlite.OrderBy) (vtab.Iterator, error) {
+		return PaginateTableIterator(connection, constraints, order)
+	}
+	if err := api.CreateModule("http_paginate", vtab.NewTableFunc("http_paginate", PaginateTableColumns, paginate)); err != nil {
+		return err
+	}
+	paginateCursor := func(constraints []*vtab.Constraint, order []*sqlite.OrderBy) (vtab.Iterator, error) {
+		return PaginateCursorTableIterator(connection, constraints, order)
+	}
+	if err := api.CreateModule("http_paginate_cursor", vtab.NewTableFunc("http_paginate_cursor", PaginateCursorTableColumns, paginateCursor)); err != nil {
+		return err
+	}
+	paginateOffset := func(constraints []*vtab.Constraint, order []*sqlite.OrderBy) (vtab.Iterator, error) {
+		return PaginateOffsetTableIterator(connection, constraints, order)
+	}
+	if err := api.CreateModule("http_paginate_offset", vtab.NewTableFunc("http_paginate_offset", PaginateOffsetTableColumns, paginateOffset)); err != nil {
+		return err
+	}
+	return nil
+}
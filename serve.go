@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.riyazali.net/sqlite"
+)
+
+// Running SQL API servers, by listening address. Started with http_serve
+var sqlServers = map[string]*sqlServer{}
+var sqlServersMu sync.Mutex
+
+// A route of http_serve, mapping a URL path to a SQL query
+type sqlRoute struct {
+	path   string
+	sql    string
+	format string
+	// the named parameters of sql, in the order of their ?NNN replacements
+	params []string
+	// the names of path wildcards, like "id" for "/users/:id"
+	pathParams []string
+	// sql prepared on the server's database, run by one request at a time
+	stmt *databaseStmt
+	mu   sync.Mutex
+}
+
+// A background HTTP server that answers GET requests with the results of SQL
+// queries, run on a separate read-only connection to the database file so they
+// only see committed data and never wait on the user's connection
+type sqlServer struct {
+	// the address as given to http_serve, which could differ from the listening address
+	addr       string
+	server     *http.Server
+	db         *database
+	routes     []*sqlRoute
+	token      string
+	removeHook func()
+	stopOnce   sync.Once
+}
+
+// Prepare the SQL of every route, erroring on any that would write to the database
+func (s *sqlServer) prepare() error {
+	for _, route := range s.routes {
+		stmt, err := s.db.prepare(route.sql)
+		if err != nil {
+			return fmt.Errorf("route %s: %s", route.path, err)
+		}
+		route.stmt = stmt
+		if !stmt.readOnly() {
+			return fmt.Errorf("route %s must have a single SELECT statement", route.path)
+		}
+	}
+	return nil
+}
+
+func (s *sqlServer) stop() {
+	s.stopOnce.Do(func() {
+		if s.removeHook != nil {
+			s.removeHook()
+		}
+		if s.server != nil {
+			s.server.Close()
+		}
+		for _, route := range s.routes {
+			if route.stmt != nil {
+				route.stmt.finalize()
+			}
+		}
+		s.db.close()
+	})
+}
+
+// Run the route's statement with the given arguments, writing each row to
+// writer as it's stepped
+func (s *sqlServer) query(route *sqlRoute, args []interface{}, writer *serveRowWriter) error {
+	route.mu.Lock()
+	defer route.mu.Unlock()
+	for i, arg := range args {
+		if err := route.stmt.bind(i+1, arg); err != nil {
+			return err
+		}
+	}
+	writer.columns = make([]string, route.stmt.columnCount())
+	for i := range writer.columns {
+		writer.columns[i] = route.stmt.columnName(i)
+	}
+	row := make([]interface{}, len(writer.columns))
+	return route.stmt.run(func(stmt *databaseStmt) error {
+		for i := range row {
+			row[i] = stmt.column(i)
+		}
+		return writer.write(row)
+	})
+}
+
+// How long a client of http_serve has to send its request headers, and to
+// accept each row of the response
+const serveTimeout = 10 * time.Second
+
+// Writes the rows of a http_serve response as JSON or CSV while they're
+// stepped, instead of holding every row in memory. The response only starts
+// with the first row, so an error before it is still sent as an error.
+type serveRowWriter struct {
+	w       http.ResponseWriter
+	format  string
+	columns []string
+	rows    int
+
+	json *bufio.Writer
+	csv  *csv.Writer
+}
+
+func (rw *serveRowWriter) start() {
+	if rw.format == "csv" {
+		rw.w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		rw.csv = csv.NewWriter(rw.w)
+		rw.csv.Write(rw.columns)
+	} else {
+		rw.w.Header().Set("Content-Type", "application/json")
+		rw.json = bufio.NewWriter(rw.w)
+		rw.json.WriteString("[")
+	}
+}
+
+func (rw *serveRowWriter) write(row []interface{}) error {
+	if rw.rows == 0 {
+		rw.start()
+	}
+	rw.rows += 1
+	// a client that stops reading can't hold the database for long
+	http.NewResponseController(rw.w).SetWriteDeadline(time.Now().Add(serveTimeout))
+	if rw.csv != nil {
+		record := make([]string, len(row))
+		for i, value := range row {
+			switch v := value.(type) {
+			case nil:
+			case []byte:
+				record[i] = base64.StdEncoding.EncodeToString(v)
+			default:
+				record[i] = fmt.Sprint(v)
+			}
+		}
+		return rw.csv.Write(record)
+	}
+	// encoded by hand to keep the columns in order
+	if rw.rows > 1 {
+		rw.json.WriteString(",")
+	}
+	rw.json.WriteString("\n  {")
+	for i, value := range row {
+		if i > 0 {
+			rw.json.WriteString(", ")
+		}
+		key, _ := json.Marshal(rw.columns[i])
+		data, _ := json.Marshal(value)
+		rw.json.Write(key)
+		rw.json.WriteString(": ")
+		rw.json.Write(data)
+	}
+	_, err := rw.json.WriteString("}")
+	return err
+}
+
+// End the response after the last row
+func (rw *serveRowWriter) finish() error {
+	if rw.rows == 0 {
+		rw.start()
+	}
+	if rw.csv != nil {
+		rw.csv.Flush()
+		return rw.csv.Error()
+	}
+	if rw.rows > 0 {
+		rw.json.WriteString("\n")
+	}
+	rw.json.WriteString("]\n")
+	return rw.json.Flush()
+}
+
+// Replace the :name, @name, and $name parameters of the given SQL with ?NNN
+// parameters, returning the new SQL and the parameter names in order.
+// Quoted strings, identifiers, and comments are left as-is.
+func numberSqlParameters(sql string) (string, []string) {
+	var b strings.Builder
+	names := []string{}
+	indexes := map[string]int{}
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			end := c
+			if c == '[' {
+				end = ']'
+			}
+			j := i + 1
+			for j < len(sql) && sql[j] != end {
+				j++
+			}
+			j = min(j+1, len(sql))
+			b.WriteString(sql[i:j])
+			i = j
+		case c == '-' && i+1 < len(sql) && sql[i+1] == '-':
+			j := strings.IndexByte(sql[i:], '\n')
+			if j < 0 {
+				j = len(sql) - i
+			}
+			b.WriteString(sql[i : i+j])
+			i += j
+		case c == '/' && i+1 < len(sql) && sql[i+1] == '*':
+			j := strings.Index(sql[i+2:], "*/")
+			if j < 0 {
+				j = len(sql) - i - 2
+			} else {
+				j += 2
+			}
+			b.WriteString(sql[i : i+2+j])
+			i += 2 + j
+		case (c == ':' || c == '@' || c == '$') && i+1 < len(sql) && isSqlIdentifierByte(sql[i+1]):
+			j := i + 1
+			for j < len(sql) && isSqlIdentifierByte(sql[j]) {
+				j++
+			}
+			name := sql[i+1 : j]
+			index, ok := indexes[name]
+			if !ok {
+				names = append(names, name)
+				index = len(names)
+				indexes[name] = index
+			}
+			fmt.Fprintf(&b, "?%d", index)
+			i = j
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String(), names
+}
+
+func isSqlIdentifierByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// Parse the routes of http_serve, a JSON object of paths to either SQL, or an
+// object with "sql" and optionally "format" keys
+func parseSqlRoutes(routesJson string) ([]*sqlRoute, error) {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(routesJson), &raw); err != nil {
+		return nil, fmt.Errorf("routes must be a JSON object: %s", err)
+	}
+	routes := []*sqlRoute{}
+	for path, value := range raw {
+		route := &sqlRoute{format: "json"}
+		if err := json.Unmarshal(value, &route.sql); err != nil {
+			var options struct {
+				Sql    string `json:"sql"`
+				Format string `json:"format"`
+			}
+			if err := json.Unmarshal(value, &options); err != nil {
+				return nil, fmt.Errorf("route %s must be SQL or an object with a sql key", path)
+			}
+			route.sql = options.Sql
+			if options.Format != "" {
+				route.format = options.Format
+			}
+		}
+		if route.format != "json" && route.format != "csv" {
+			return nil, fmt.Errorf("route %s has unknown format %q, expected 'json' or 'csv'", path, route.format)
+		}
+
+		// a single statement, wrapped in a subquery so that only SELECTs are possible
+		query := strings.TrimRight(strings.TrimSpace(route.sql), ";")
+		if query == "" || strings.Contains(query, ";") {
+			return nil, fmt.Errorf("route %s must have a single SELECT statement", path)
+		}
+		query, route.params = numberSqlParameters(query)
+		route.sql = "SELECT * FROM (" + query + "\n)"
+
+		segments := strings.Split(path, "/")
+		for i, segment := range segments {
+			if strings.HasPrefix(segment, ":") {
+				segments[i] = "{" + segment[1:] + "}"
+			}
+			if strings.HasPrefix(segments[i], "{") && strings.HasSuffix(segments[i], "}") {
+				route.pathParams = append(route.pathParams, strings.TrimSuffix(strings.Trim(segments[i], "{}"), "..."))
+			}
+		}
+		route.path = strings.Join(segments, "/")
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// Returns the given request parameter as an integer if it's written like one, otherwise as text
+func sqlParameterValue(value string) interface{} {
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil && strconv.FormatInt(i, 10) == value {
+		return i
+	}
+	return value
+}
+
+func writeServeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+func (s *sqlServer) authorized(r *http.Request) bool {
+	if s.token == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+func (s *sqlServer) handle(route *sqlRoute) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeServeError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+			return
+		}
+
+		query := r.URL.Query()
+		args := make([]interface{}, len(route.params))
+		for i, name := range route.params {
+			var value interface{}
+			if query.Has(name) {
+				value = sqlParameterValue(query.Get(name))
+			}
+			for _, pathParam := range route.pathParams {
+				if pathParam == name {
+					value = sqlParameterValue(r.PathValue(name))
+				}
+			}
+			args[i] = value
+		}
+		format := route.format
+		if query.Has("_format") {
+			format = query.Get("_format")
+		}
+		if format != "json" && format != "csv" {
+			writeServeError(w, http.StatusBadRequest, fmt.Sprintf("unknown format %q, expected 'json' or 'csv'", format))
+			return
+		}
+
+		writer := &serveRowWriter{w: w, format: format}
+		err := s.query(route, args, writer)
+		if err != nil && writer.rows == 0 {
+			writeServeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err == nil {
+			err = writer.finish()
+		}
+		// the status was already sent, so cut the response short for the client to notice
+		if err != nil {
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// Returns a http.Handler for the given routes, or an error if any route has an invalid path
+func (s *sqlServer) handler(routes []*sqlRoute) (handler http.Handler, err error) {
+	mux := http.NewServeMux()
+	// ServeMux panics on invalid or conflicting patterns
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid route: %v", r)
+		}
+	}()
+	for _, route := range routes {
+		mux.HandleFunc("GET "+route.path, s.handle(route))
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeServeError(w, http.StatusNotFound, "not found")
+	})
+	return mux, nil
+}
+
+/* http_serve(addr, routes, [bearer_token])
+* Start a background HTTP server on addr that answers GET requests with the
+* results of read-only SQL queries, as JSON or CSV. routes is a JSON object
+* of URL paths to SQL, where :name parameters are bound from path wildcards
+* like "/users/:id" and query parameters. Routes are prepared right away, on a
+* separate read-only connection. Runs until stopped or the connection closes.
+* Returns the listening address.
+ */
+type HttpServeFunc struct {
+	connection *connection
+}
+
+func (*HttpServeFunc) Deterministic() bool { return false }
+func (*HttpServeFunc) Args() int           { return -1 }
+func (f *HttpServeFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	if len(values) < 2 || len(values) > 3 {
+		c.ResultError(fmt.Errorf("usage: http_serve(addr, routes, [bearer_token])"))
+		return
+	}
+	routes, err := parseSqlRoutes(values[1].Text())
+	if err != nil {
+		c.ResultError(err)
+		return
+	}
+	server := &sqlServer{addr: values[0].Text(), routes: routes}
+	if len(values) > 2 {
+		server.token = values[2].Text()
+	}
+	handler, err := server.handler(routes)
+	if err != nil {
+		c.ResultError(err)
+		return
+	}
+	db, err := openDatabase(f.connection.conn, true)
+	if err != nil {
+		c.ResultError(fmt.Errorf("http_serve() %s", err))
+		return
+	}
+	server.db = db
+	if err := server.prepare(); err != nil {
+		server.stop()
+		c.ResultError(err)
+		return
+	}
+
+	sqlServersMu.Lock()
+	defer sqlServersMu.Unlock()
+	ln, err := net.Listen("tcp", server.addr)
+	if err != nil {
+		server.stop()
+		c.ResultError(fmt.Errorf("error listening on %s: %s", server.addr, err))
+		return
+	}
+	addr := ln.Addr().String()
+	server.server = &http.Server{Handler: handler, ReadHeaderTimeout: serveTimeout}
+	sqlServers[addr] = server
+	server.removeHook = f.connection.onClose(func() {
+		sqlServersMu.Lock()
+		defer sqlServersMu.Unlock()
+		delete(sqlServers, addr)
+		server.stop()
+	})
+	go server.server.Serve(ln)
+
+	c.ResultText(addr)
+}
+
+/* http_serve_stop([addr])
+* Stop the server started on addr, either as given to http_serve or as
+* returned by it, or every server if omitted. Returns the number of stopped servers.
+ */
+type HttpServeStopFunc struct{}
+
+func (*HttpServeStopFunc) Deterministic() bool { return false }
+func (*HttpServeStopFunc) Args() int           { return -1 }
+func (*HttpServeStopFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	if len(values) > 1 {
+		c.ResultError(fmt.Errorf("usage: http_serve_stop([addr])"))
+		return
+	}
+	sqlServersMu.Lock()
+	defer sqlServersMu.Unlock()
+	stopped := 0
+	for addr, server := range sqlServers {
+		if len(values) == 0 || values[0].Text() == addr || values[0].Text() == server.addr {
+			server.stop()
+			delete(sqlServers, addr)
+			stopped += 1
+		}
+	}
+	c.ResultInt(stopped)
+}
+
+func RegisterServe(api *sqlite.ExtensionApi, connection *connection) error {
+	if err := api.CreateFunction("http_serve", &HttpServeFunc{connection: connection}); err != nil {
+		return err
+	}
+	if err := api.CreateFunction("http_serve_stop", &HttpServeStopFunc{}); err != nil {
+		return err
+	}
+	return nil
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	"go.riyazali.net/sqlite"
@@ -17,7 +19,7 @@ var DoTimeout = 5 * time.Second
  */
 type HttpRateLimit struct{}
 
-func (*HttpRateLimit) Deterministic() bool { return true }
+func (*HttpRateLimit) Deterministic() bool { return false }
 func (*HttpRateLimit) Args() int           { return 1 }
 func (*HttpRateLimit) Apply(c *sqlite.Context, values ...sqlite.Value) {
 	ms := values[0].Int()
@@ -28,7 +30,7 @@ func (*HttpRateLimit) Apply(c *sqlite.Context, values ...sqlite.Value) {
 // http_timeout_set(duration)
 type HttpTimeoutSet struct{}
 
-func (*HttpTimeoutSet) Deterministic() bool { return true }
+func (*HttpTimeoutSet) Deterministic() bool { return false }
 func (*HttpTimeoutSet) Args() int           { return 1 }
 
 // TODO see if a duration string was passed, ex "10s". Else, parse in milliseconds
@@ -39,6 +41,54 @@ func (*HttpTimeoutSet) Apply(c *sqlite.Context, values ...sqlite.Value) {
 	c.ResultInt(ms)
 }
 
+// Whether compressed responses are decoded when a request sets its own
+// Accept-Encoding header. Configurable with http_decompress_set
+var DoDecompress = true
+
+// Content-Encoding to compress all request bodies with, "" for none.
+// Configurable with http_compress_body_set
+var DoBodyCompression = ""
+
+/* http_decompress_set(enabled)
+* Enable or disable decoding of gzip, deflate, br, and zstd response bodies
+* when a request sets its own Accept-Encoding header. Enabled by default.
+ */
+type HttpDecompressSet struct{}
+
+func (*HttpDecompressSet) Deterministic() bool { return false }
+func (*HttpDecompressSet) Args() int           { return 1 }
+func (*HttpDecompressSet) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	DoDecompress = values[0].Int() != 0
+	if DoDecompress {
+		c.ResultInt(1)
+	} else {
+		c.ResultInt(0)
+	}
+}
+
+/* http_compress_body_set(encoding)
+* Compress all non-empty request bodies with the given encoding ("gzip", "deflate",
+* "br", or "zstd") and send the matching Content-Encoding header. NULL or '' disables.
+ */
+type HttpCompressBodySet struct{}
+
+func (*HttpCompressBodySet) Deterministic() bool { return false }
+func (*HttpCompressBodySet) Args() int           { return 1 }
+func (*HttpCompressBodySet) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	encodings := parseContentEncodings(values[0].Text())
+	if len(encodings) > 1 || !supportedEncodings(encodings) {
+		c.ResultError(fmt.Errorf("unsupported request body encoding: %s", values[0].Text()))
+		return
+	}
+	DoBodyCompression = strings.Join(encodings, "")
+	if DoBodyCompression == "" {
+		c.ResultNull()
+	} else {
+		c.ResultText(DoBodyCompression)
+	}
+}
+
+// Registered by every entrypoint, including http_no_network
 func RegisterSettings(api *sqlite.ExtensionApi) error {
 	if err := api.CreateFunction("http_rate_limit", &HttpRateLimit{}); err != nil {
 		return err
@@ -46,5 +96,14 @@ func RegisterSettings(api *sqlite.ExtensionApi) error {
 	if err := api.CreateFunction("http_timeout_set", &HttpTimeoutSet{}); err != nil {
 		return err
 	}
+	if err := api.CreateFunction("http_decompress_set", &HttpDecompressSet{}); err != nil {
+		return err
+	}
+	if err := api.CreateFunction("http_compress_body_set", &HttpCompressBodySet{}); err != nil {
+		return err
+	}
+	if err := api.CreateFunction("http_memo", &HttpMemoFunc{}); err != nil {
+		return err
+	}
 	return nil
 }
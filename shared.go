@@ -21,6 +21,10 @@ var (
 
 func init() {
 	sqlite.Register(func(api *sqlite.ExtensionApi) (sqlite.ErrorCode, error) {
+		connection, err := RegisterConnection(api)
+		if err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
 
 		if err := RegisterMeta(api, false); err != nil {
 			return sqlite.SQLITE_ERROR, err
@@ -31,16 +35,74 @@ func init() {
 		if err := RegisterCookies(api); err != nil {
 			return sqlite.SQLITE_ERROR, err
 		}
-		if err := RegisterDo(api); err != nil {
+		if err := RegisterEncoding(api); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterMime(api); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterHar(api); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterDo(api, connection, false); err != nil {
 			return sqlite.SQLITE_ERROR, err
 		}
 		if err := RegisterSettings(api); err != nil {
 			return sqlite.SQLITE_ERROR, err
 		}
+		if err := RegisterJson(api, connection); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterPaginate(api, connection); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterSse(api, connection); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterWebsocket(api, connection); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterLog(api, connection); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterWarc(api); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterCassette(api); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterMock(api); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterFault(api); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterTestServer(api, connection); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterListen(api, connection); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterServe(api, connection); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterOutbox(api, connection); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterOnCommit(api, connection, false); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterAsync(api, connection, false); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
 
 		return sqlite.SQLITE_OK, nil
 	})
 	sqlite.RegisterNamed("http", func(api *sqlite.ExtensionApi) (sqlite.ErrorCode, error) {
+		connection, err := RegisterConnection(api)
+		if err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
 
 		if err := RegisterMeta(api, false); err != nil {
 			return sqlite.SQLITE_ERROR, err
@@ -51,16 +113,74 @@ func init() {
 		if err := RegisterCookies(api); err != nil {
 			return sqlite.SQLITE_ERROR, err
 		}
-		if err := RegisterDo(api); err != nil {
+		if err := RegisterEncoding(api); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterMime(api); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterHar(api); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterDo(api, connection, false); err != nil {
 			return sqlite.SQLITE_ERROR, err
 		}
 		if err := RegisterSettings(api); err != nil {
 			return sqlite.SQLITE_ERROR, err
 		}
+		if err := RegisterJson(api, connection); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterPaginate(api, connection); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterSse(api, connection); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterWebsocket(api, connection); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterLog(api, connection); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterWarc(api); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterCassette(api); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterMock(api); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterFault(api); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterTestServer(api, connection); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterListen(api, connection); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterServe(api, connection); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterOutbox(api, connection); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterOnCommit(api, connection, false); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterAsync(api, connection, false); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
 
 		return sqlite.SQLITE_OK, nil
 	})
 	sqlite.RegisterNamed("http_no_network", func(api *sqlite.ExtensionApi) (sqlite.ErrorCode, error) {
+		connection, err := RegisterConnection(api)
+		if err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
 
 		if err := RegisterMeta(api, true); err != nil {
 			return sqlite.SQLITE_ERROR, err
@@ -72,6 +192,34 @@ func init() {
 		if err := RegisterCookies(api); err != nil {
 			return sqlite.SQLITE_ERROR, err
 		}
+		if err := RegisterEncoding(api); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterMime(api); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterHar(api); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		// requests can only be answered by mocks, see noNetworkTransport
+		if err := RegisterDo(api, connection, true); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterSettings(api); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterMock(api); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterFault(api); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterOnCommit(api, connection, true); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
+		if err := RegisterAsync(api, connection, true); err != nil {
+			return sqlite.SQLITE_ERROR, err
+		}
 
 		return sqlite.SQLITE_OK, nil
 	})
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asg017/sqlite-http/internal/vtab"
+	"go.riyazali.net/sqlite"
+)
+
+// Default delay before reconnecting to a dropped event stream, if the server never sent a "retry" field
+const sseDefaultRetry = 3 * time.Second
+
+// bufio.SplitFunc for event stream lines, which can end in CRLF, LF, or a lone CR
+func scanSSELines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		if data[i] == '\n' {
+			return i + 1, data[:i], nil
+		}
+		// a CR at the end of the buffer could be followed by a LF we haven't read yet
+		if i+1 == len(data) && !atEOF {
+			return 0, nil, nil
+		}
+		if i+1 < len(data) && data[i+1] == '\n' {
+			return i + 2, data[:i], nil
+		}
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// A single dispatched server-sent event
+type sseEvent struct {
+	id    string
+	event string
+	data  string
+	retry *int
+}
+
+/** select id, event, data, retry from http_sse(url, headers, max_events, max_duration_ms)
+ * A table function that connects to a text/event-stream, yielding one row per event.
+ * Reconnects with Last-Event-ID when the stream drops, until max_events or
+ * max_duration_ms is reached.
+ */
+var SseColumns = []vtab.Column{
+	{Name: "url", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "headers", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "max_events", Type: sqlite.SQLITE_INTEGER.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "max_duration_ms", Type: sqlite.SQLITE_INTEGER.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "id", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "event", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "data", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "retry", Type: sqlite.SQLITE_INTEGER.String()},
+}
+
+type SseCursor struct {
+	connection *connection
+	url        string
+	headers    string
+	maxEvents  int
+
+	// canceled once max_duration_ms has passed, ends the stream without an error
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	response   *http.Response
+	connCancel context.CancelFunc
+	scanner    *bufio.Scanner
+
+	lastEventId string
+	retry       time.Duration
+	count       int
+	current     sseEvent
+}
+
+func (cur *SseCursor) Column(ctx vtab.Context, c int) error {
+	col := SseColumns[c]
+
+	switch col.Name {
+	case "id":
+		ctx.ResultText(cur.current.id)
+	case "event":
+		ctx.ResultText(cur.current.event)
+	case "data":
+		ctx.ResultText(cur.current.data)
+	case "retry":
+		if cur.current.retry == nil {
+			ctx.ResultNull()
+		} else {
+			ctx.ResultInt(*cur.current.retry)
+		}
+	}
+	return nil
+}
+
+// Open a new connection to the event stream, sending Last-Event-ID if any event had an ID
+func (cur *SseCursor) connect() error {
+	client, request, err := prepareRequest(&PrepareRequestParams{method: "GET", url: cur.url, headers: cur.headers, body: nil, cookies: "", connection: cur.connection, streaming: true, quiet: true})
+	if err != nil {
+		return fmt.Errorf("error preparing request: %s", err)
+	}
+	request.Header.Set("Accept", "text/event-stream")
+	request.Header.Set("Cache-Control", "no-cache")
+	if cur.lastEventId != "" {
+		request.Header.Set("Last-Event-ID", cur.lastEventId)
+	}
+
+	// the stream is expected to outlive the request timeout, which only applies
+	// while waiting for the response headers
+	connCtx, connCancel := context.WithCancel(cur.ctx)
+	response, err := client.Do(request.WithContext(connCtx))
+	if err != nil {
+		connCancel()
+		return err
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if response.StatusCode != http.StatusOK || mediaType != "text/event-stream" {
+		response.Body.Close()
+		connCancel()
+		if response.StatusCode == http.StatusNoContent {
+			return io.EOF
+		}
+		return fmt.Errorf("not an event stream: %s, Content-Type %q", response.Status, response.Header.Get("Content-Type"))
+	}
+
+	cur.response = response
+	cur.connCancel = connCancel
+	cur.scanner = bufio.NewScanner(response.Body)
+	cur.scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	cur.scanner.Split(scanSSELines)
+	return nil
+}
+
+// Read lines from the current connection until an event is dispatched
+func (cur *SseCursor) readEvent() (*sseEvent, error) {
+	var data strings.Builder
+	event := sseEvent{}
+	for cur.scanner.Scan() {
+		line := cur.scanner.Text()
+
+		if line == "" {
+			if data.Len() == 0 {
+				event = sseEvent{}
+				continue
+			}
+			event.id = cur.lastEventId
+			event.data = strings.TrimSuffix(data.String(), "\n")
+			if event.event == "" {
+				event.event = "message"
+			}
+			return &event, nil
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+
+		switch field {
+		case "event":
+			event.event = value
+		case "data":
+			data.WriteString(value)
+			data.WriteByte('\n')
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				cur.lastEventId = value
+			}
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil && ms >= 0 {
+				event.retry = &ms
+				cur.retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+	if err := cur.scanner.Err(); err != nil {
+		return nil, err
+	}
+	// an event without a trailing blank line is never dispatched
+	return nil, io.EOF
+}
+
+// Close the current connection to the event stream, if any
+func (cur *SseCursor) disconnect() {
+	if cur.response != nil {
+		cur.response.Body.Close()
+		cur.connCancel()
+		cur.response = nil
+	}
+}
+
+// Close the stream for good, called when SQLite stops reading rows early
+func (cur *SseCursor) Close() error {
+	cur.disconnect()
+	cur.cancel()
+	return nil
+}
+
+func (cur *SseCursor) Next() (vtab.Row, error) {
+	if cur.maxEvents > 0 && cur.count >= cur.maxEvents {
+		cur.Close()
+		return nil, io.EOF
+	}
+	for {
+		if cur.ctx.Err() != nil {
+			cur.Close()
+			return nil, io.EOF
+		}
+		if cur.response == nil {
+			if err := cur.connect(); err != nil {
+				cur.Close()
+				if errors.Is(err, io.EOF) || cur.ctx.Err() != nil {
+					return nil, io.EOF
+				}
+				return nil, err
+			}
+		}
+
+		event, err := cur.readEvent()
+		if err == nil {
+			cur.count += 1
+			cur.current = *event
+			return cur, nil
+		}
+
+		// the stream dropped: wait for the retry delay, then reconnect
+		cur.disconnect()
+		select {
+		case <-cur.ctx.Done():
+		case <-time.After(cur.retry):
+		}
+	}
+}
+
+func SseIterator(connection *connection, constraints []*vtab.Constraint, order []*sqlite.OrderBy) (vtab.Iterator, error) {
+	cursor := SseCursor{
+		connection: connection,
+		retry:      sseDefaultRetry,
+	}
+	var maxDuration time.Duration
+
+	for _, constraint := range constraints {
+		if constraint.Op == sqlite.INDEX_CONSTRAINT_EQ {
+			column := SseColumns[constraint.ColIndex]
+			switch column.Name {
+			case "url":
+				cursor.url = constraint.Value.Text()
+			case "headers":
+				cursor.headers = constraint.Value.Text()
+			case "max_events":
+				cursor.maxEvents = constraint.Value.Int()
+			case "max_duration_ms":
+				maxDuration = time.Duration(constraint.Value.Int64()) * time.Millisecond
+			}
+		}
+	}
+
+	if maxDuration > 0 {
+		cursor.ctx, cursor.cancel = context.WithTimeout(context.Background(), maxDuration)
+	} else {
+		cursor.ctx, cursor.cancel = context.WithCancel(context.Background())
+	}
+
+	return &cursor, nil
+}
+
+func RegisterSse(api *sqlite.ExtensionApi, connection *connection) error {
+	iterator := func(constraints []*vtab.Constraint, order []*sqlite.OrderBy) (vtab.Iterator, error) {
+		return SseIterator(connection, constraints, order)
+	}
+	if err := api.CreateModule("http_sse", vtab.NewTableFunc("http_sse", SseColumns, iterator)); err != nil {
+		return err
+	}
+	return nil
+}
@@ -1,7 +1,14 @@
 import sqlite3
 import unittest
 import json
+import base64
+import gzip
+import hashlib
 import os
+import tempfile
+import time
+import urllib.request
+import urllib.error
 from datetime import datetime, timedelta
 
 EXT_PATH = "dist/http0"
@@ -19,8 +26,8 @@ def skip_do(f):
   return wrapper
 
 
-def connect(path:str, entrypoint=None) -> sqlite3.Cursor:
-  db = sqlite3.connect(":memory:")
+def connect(path:str, entrypoint=None, db_path=":memory:") -> sqlite3.Cursor:
+  db = sqlite3.connect(db_path)
 
   db.execute("create table fbefore as select name from pragma_function_list")
   db.execute("create table mbefore as select name from pragma_module_list")
@@ -41,6 +48,10 @@ def connect(path:str, entrypoint=None) -> sqlite3.Cursor:
 db = connect(EXT_PATH)
 db_nonet = connect(EXT_PATH, 'sqlite3_http_no_network_init')
 
+# serve the httpbin endpoints these tests use from the extension itself, instead of docker
+if os.environ.get("LOCAL_HTTPBIN") == "1":
+  db.execute("select http_test_server_start(8080)").fetchone()
+
 # Fun fact: the SQLite datetime() format, with fractional seconds,
 # doesn't always have 3 digits of precision.
 # so right pad timestamp with 000's until it does
@@ -54,44 +65,152 @@ class TestHttp(unittest.TestCase):
   def test_funcs(self):
     funcs = list(map(lambda a: a[0], db.execute("select name from fafter where name not in (select name from fbefore) order by name").fetchall()))
     self.assertEqual(funcs, [
+      "http_await",
+      "http_cassette",
+      "http_compress",
+      "http_compress_body_set",
+      "http_concurrency_set",
+      "http_content_disposition",
       "http_cookies",
       "http_debug",
+      "http_decompress",
+      "http_decompress_set",
+      "http_delete_body",
+      "http_delete_headers",
+      "http_detect_content_type",
       "http_do_body",
       "http_do_headers",
+      "http_do_on_commit",
+      "http_do_text",
+      "http_fault_inject",
+      "http_fault_reset",
       "http_get_body",
       "http_get_headers",
+      "http_get_text",
+      "http_har_export",
+      "http_head",
       "http_headers",
       "http_headers_date",
       "http_headers_get",
       "http_headers_has",
+      "http_listen",
+      "http_listen_stop",
+      "http_log_to",
+      "http_memo",
+      "http_mime_type",
+      "http_mock",
+      "http_mock_reset",
+      "http_mock_strict",
+      "http_options",
+      "http_patch_body",
+      "http_patch_headers",
       "http_post_body",
       "http_post_form_urlencoded",
       "http_post_headers",
+      "http_put_body",
+      "http_put_headers",
       "http_rate_limit",
+      "http_request_async",
+      "http_results_clear",
+      "http_serve",
+      "http_serve_stop",
+      "http_test_server_start",
+      "http_test_server_stop",
       "http_timeout_set",
-      "http_version"
+      "http_version",
+      "http_warc_to"
     ])
+
+    # functions that make requests or change settings must never be constant folded
+    SQLITE_DETERMINISTIC = 0x800
+    deterministic = list(map(lambda a: a[0], db.execute("""
+      select name from pragma_function_list
+      where name in (
+        'http_get_body', 'http_get_text', 'http_get_headers', 'http_post_body', 'http_post_headers',
+        'http_do_body', 'http_do_text', 'http_do_headers', 'http_rate_limit', 'http_timeout_set',
+        'http_decompress_set', 'http_compress_body_set', 'http_memo', 'http_log_to', 'http_warc_to',
+        'http_cassette', 'http_mock_strict', 'http_head', 'http_options', 'http_put_body', 'http_put_headers',
+        'http_patch_body', 'http_patch_headers', 'http_delete_body', 'http_delete_headers',
+        'http_request_async', 'http_await', 'http_concurrency_set'
+      )
+      and flags & ?
+    """, [SQLITE_DETERMINISTIC]).fetchall()))
+    self.assertEqual(deterministic, [])
   
   def test_modules(self):
     funcs = list(map(lambda a: a[0], db.execute("select name from mafter where name not in (select name from mbefore) order by name").fetchall()))
     self.assertEqual(funcs, [
+      "http_accept_each",
+      "http_connection",
+      "http_delete",
       "http_do",
       "http_get",
+      "http_har_entries",
+      "http_head",
       "http_headers_each",
+      "http_json_each",
+      "http_mime_params_each",
+      "http_mock_calls",
+      "http_options",
+      "http_outbox",
+      "http_paginate",
+      "http_paginate_cursor",
+      "http_paginate_offset",
+      "http_patch",
       "http_post",
+      "http_put",
+      "http_results",
+      "http_sse",
+      "http_websocket",
     ])
   
   def test_nodofuncs(self):
     funcs = list(map(lambda a: a[0], db_nonet.execute("select name from fafter where name not in (select name from fbefore) order by name").fetchall()))
     self.assertEqual(funcs, [
+      "http_await",
+      "http_compress",
+      "http_concurrency_set",
+      "http_content_disposition",
+      "http_compress_body_set",
       "http_cookies",
       "http_debug",
+      "http_decompress",
+      "http_decompress_set",
+      "http_delete_body",
+      "http_delete_headers",
+      "http_detect_content_type",
+      "http_do_body",
+      "http_do_headers",
+      "http_do_on_commit",
+      "http_do_text",
+      "http_fault_inject",
+      "http_fault_reset",
+      "http_get_body",
+      "http_get_headers",
+      "http_get_text",
+      "http_har_export",
+      "http_head",
       "http_headers",
       "http_headers_date",
       "http_headers_get",
       "http_headers_has",
-      # TODO should be a part of nodo
-      #"http_post_form_urlencoded",
+      "http_memo",
+      "http_mime_type",
+      "http_mock",
+      "http_mock_reset",
+      "http_mock_strict",
+      "http_options",
+      "http_patch_body",
+      "http_patch_headers",
+      "http_post_body",
+      "http_post_form_urlencoded",
+      "http_post_headers",
+      "http_put_body",
+      "http_put_headers",
+      "http_rate_limit",
+      "http_request_async",
+      "http_results_clear",
+      "http_timeout_set",
       "http_version"
     ])
 
@@ -125,6 +244,79 @@ class TestHttp(unittest.TestCase):
     """).fetchone()
     self.assertEqual(d, "{\"name\":\"Alex\"}")
   
+  def test_http_compress(self):
+    for encoding in ["gzip", "deflate", "br", "zstd", "gzip, br", "identity"]:
+      d, = db.execute(
+        "select http_decompress(http_compress('alex', ?1), ?1)",
+        [encoding]
+      ).fetchone()
+      self.assertEqual(d, b"alex")
+
+    compressed, = db.execute("select http_compress('alex', 'gzip')").fetchone()
+    self.assertEqual(compressed[:2], b"\x1f\x8b")
+    self.assertEqual(db.execute("select http_compress(null, 'gzip')").fetchone()[0], None)
+
+    with self.assertRaises(sqlite3.OperationalError):
+      db.execute("select http_compress('alex', 'lzma')").fetchone()
+
+  def test_http_decompress(self):
+    d, = db_nonet.execute(
+      "select http_decompress(?, 'gzip')",
+      [b"\x1f\x8b\x08\x00\x00\x00\x00\x00\x02\x03K\xccI\xad\x00\x00\xd2\x1bG\xa5\x04\x00\x00\x00"]
+    ).fetchone()
+    self.assertEqual(d, b"alex")
+
+    with self.assertRaises(sqlite3.OperationalError):
+      db.execute("select http_decompress('not gzip', 'gzip')").fetchone()
+
+    # the decoded size is limited
+    self.assertEqual(db.execute("select http_decompress(http_compress('alex', 'gzip'), 'gzip', 4)").fetchone()[0], b"alex")
+    with self.assertRaisesRegex(sqlite3.OperationalError, "decompressed data is larger than 3 bytes"):
+      db.execute("select http_decompress(http_compress('alex', 'gzip'), 'gzip', 3)").fetchone()
+    with self.assertRaisesRegex(sqlite3.OperationalError, "decompressed data is larger than 67108864 bytes"):
+      db.execute("select http_decompress(http_compress(zeroblob(67108865), 'gzip'), 'gzip')").fetchone()
+
+  @skip_do
+  def test_http_compress_body_set(self):
+    self.assertEqual(db.execute("select http_compress_body_set('gzip')").fetchone()[0], "gzip")
+    d, = db.execute("""
+      select http_post_body('http://localhost:8080/post', null, 'alex')
+    """).fetchone()
+    self.assertEqual(db.execute("select http_compress_body_set(null)").fetchone()[0], None)
+    data = json.loads(d.decode("utf8"))
+    self.assertEqual(data.get("headers").get("Content-Encoding"), "gzip")
+    self.assertNotEqual(data.get("data"), "alex")
+
+    with self.assertRaises(sqlite3.OperationalError):
+      db.execute("select http_compress_body_set('lzma')").fetchone()
+
+  @skip_do
+  def test_http_decompress_set(self):
+    for encoding, path, key in [("br", "brotli", "brotli"), ("gzip", "gzip", "gzipped"), ("deflate", "deflate", "deflated")]:
+      d, = db.execute(
+        "select http_get_body(?, http_headers('Accept-Encoding', ?))",
+        ["http://localhost:8080/" + path, encoding]
+      ).fetchone()
+      data = json.loads(d.decode("utf8"))
+      self.assertTrue(data.get(key))
+
+    self.assertEqual(db.execute("select http_decompress_set(0)").fetchone()[0], 0)
+    d, = db.execute("""
+      select http_get_body('http://localhost:8080/brotli', http_headers('Accept-Encoding', 'br'))
+    """).fetchone()
+    self.assertEqual(db.execute("select http_decompress_set(1)").fetchone()[0], 1)
+    with self.assertRaises(ValueError):
+      json.loads(d.decode("utf8", errors="replace"))
+
+    # response_body_raw keeps the compressed bytes of a single request
+    body, raw, uncompressed = db.execute("""
+      select response_body, response_body_raw, (select response_body_raw from http_get('http://localhost:8080/get'))
+      from http_get('http://localhost:8080/brotli', http_headers('Accept-Encoding', 'br'))
+    """).fetchone()
+    self.assertTrue(json.loads(body.decode("utf8")).get("brotli"))
+    self.assertEqual(db.execute("select http_decompress(?, 'br')", [raw]).fetchone()[0], body)
+    self.assertTrue(json.loads(uncompressed.decode("utf8")).get("url"))
+
   @skip_do
   def test_http_do_body(self):
     d, = db.execute("""
@@ -202,6 +394,98 @@ class TestHttp(unittest.TestCase):
     """).fetchone()
     self.assertEqual(len(headers.splitlines()), 7)
   
+  @skip_do
+  def test_http_get_text(self):
+    # "café" in ISO-8859-1, served by httpbin as "charset=utf-8"
+    url = "http://localhost:8080/base64/Y2Fm6Q=="
+    self.assertEqual(
+      db.execute("select http_get_text(?, null, null, 'iso-8859-1')", [url]).fetchone()[0],
+      "café"
+    )
+    self.assertEqual(
+      db.execute("select http_get_text(?)", [url]).fetchone()[0],
+      "caf\ufffd"
+    )
+    with self.assertRaises(sqlite3.OperationalError):
+      db.execute("select http_get_text(?, null, null, 'not-a-charset')", [url]).fetchone()
+
+    text, body = db.execute("""
+      select response_text, response_body
+      from http_get('http://localhost:8080/encoding/utf8')
+    """).fetchone()
+    self.assertEqual(text, body.decode("utf8"))
+
+    # the table functions take a charset override too
+    self.assertEqual(db.execute("select response_text from http_get(?)", [url]).fetchone()[0], "caf\ufffd")
+    self.assertEqual(db.execute("select response_text from http_get(?, null, null, 'windows-1252')", [url]).fetchone()[0], "café")
+    self.assertEqual(
+      db.execute("select response_text from http_do('GET', ?, null, null, null, 'windows-1252')", [url]).fetchone()[0],
+      "café"
+    )
+
+  # runs without a local httpbin, all requests are answered by mocks
+  def test_http_do_on_commit(self):
+    with self.assertRaisesRegex(sqlite3.OperationalError, "needs a database file"):
+      db.execute("select http_do_on_commit('POST', 'http://oncommit.test/memory')").fetchone()
+    # the table is only created by calls that can record requests
+    self.assertEqual(db.execute("select count(*) from sqlite_master where name = 'http_on_commit'").fetchone()[0], 0)
+
+    tmp = tempfile.TemporaryDirectory()
+    db_file = connect(EXT_PATH, db_path=os.path.join(tmp.name, "oncommit.db"))
+    def wait_sent():
+      for _ in range(200):
+        if db_file.execute("select count(*) from http_on_commit where status = 'pending'").fetchone()[0] == 0:
+          return
+        time.sleep(0.01)
+
+    try:
+      db_file.execute("select http_mock('*', 'http://oncommit.test/*', 201, null, 'ok')")
+
+      # rolled back requests are never sent, and the table they created goes with them
+      db_file.execute("begin")
+      db_file.execute("select http_do_on_commit('POST', 'http://oncommit.test/rolledback', null, 'a')").fetchone()
+      db_file.execute("rollback")
+      self.assertEqual(db_file.execute("select count(*) from sqlite_master where name = 'http_on_commit'").fetchone()[0], 0)
+
+      db_file.execute("begin")
+      id, = db_file.execute("select http_do_on_commit('POST', 'http://oncommit.test/committed', http_headers('X-A', 'b'), 'b')").fetchone()
+      db_file.execute("savepoint s")
+      db_file.execute("select http_do_on_commit('POST', 'http://oncommit.test/savepoint')").fetchone()
+      db_file.execute("rollback to s")
+      self.assertEqual(db_file.execute("select count(*) from http_mock_calls").fetchone()[0], 0)
+      db_file.execute("commit")
+      wait_sent()
+
+      # outside of a transaction, the request is sent once the statement is done
+      db_file.execute("select http_do_on_commit('DELETE', 'http://oncommit.test/autocommit')").fetchone()
+      wait_sent()
+
+      rows = db_file.execute("""
+        select id, method, url, request_body, status, response_status_code, response_body, error, sent_at is not null
+        from http_on_commit
+        order by id
+      """).fetchall()
+      self.assertEqual(list(map(lambda x: tuple(x), rows)), [
+        (id, "POST", "http://oncommit.test/committed", b"b", "sent", 201, b"ok", None, 1),
+        (id + 1, "DELETE", "http://oncommit.test/autocommit", None, "sent", 201, b"ok", None, 1),
+      ])
+      rows = db_file.execute("select method, url from http_mock_calls").fetchall()
+      self.assertEqual(list(map(lambda x: tuple(x), rows)), [
+        ("POST", "http://oncommit.test/committed"),
+        ("DELETE", "http://oncommit.test/autocommit"),
+      ])
+    finally:
+      db_file.execute("select http_mock_reset()")
+      db_file.close()
+      tmp.cleanup()
+
+  @skip_do
+  def test_http_do_text(self):
+    d, = db.execute("""
+      select http_do_text('GET', 'http://localhost:8080/base64/Y2Fm6Q==', null, null, null, 'windows-1252')
+    """).fetchone()
+    self.assertEqual(d, "café")
+
   def test_http_headers(self):
     h1, h2 = db.execute("""
       select http_headers("a", "b"), http_headers("dup", "a", "dup", "b")
@@ -276,6 +560,326 @@ class TestHttp(unittest.TestCase):
     self.assertEqual(http_headers_date('Sun, 06 Nov 1994 08:49:37 GMT'), '1994-11-06 08:49:37')
     self.assertEqual(http_headers_date('N/A'), None)
   
+  @skip_do
+  def test_http_json_each(self):
+    rows = db.execute("""
+      select key, type, value ->> '$.title' as title
+      from http_json_each('http://localhost:8080/json', '$.slideshow.slides')
+    """).fetchall()
+    self.assertEqual(list(map(lambda x: dict(x), rows)), [
+      {"key": 0, "type": "object", "title": "Wake up to WonderWidgets!"},
+      {"key": 1, "type": "object", "title": "Overview"},
+    ])
+
+    rows = db.execute("""
+      select key, value
+      from http_json_each('http://localhost:8080/json', '$.slideshow')
+      where key = 'author'
+    """).fetchall()
+    self.assertEqual(list(map(lambda x: dict(x), rows)), [
+      {"key": "author", "value": "Yours Truly"},
+    ])
+
+    # missing paths yield no rows
+    rows = db.execute("""
+      select * from http_json_each('http://localhost:8080/json', '$.nope')
+    """).fetchall()
+    self.assertEqual(rows, [])
+
+    # a top-level object yields one row per member
+    rows = db.execute("""
+      select key, type from http_json_each('http://localhost:8080/json', '$')
+    """).fetchall()
+    self.assertEqual(list(map(lambda x: tuple(x), rows)), [("slideshow", "object")])
+
+    # NDJSON yields one row per line, and stops reading once the LIMIT is reached
+    rows = db.execute("""
+      select key, value ->> '$.id' as id
+      from http_json_each('http://localhost:8080/stream/3')
+    """).fetchall()
+    self.assertEqual(list(map(lambda x: tuple(x), rows)), [(0, 0), (1, 1), (2, 2)])
+    rows = db.execute("""
+      select value ->> '$.id' as id
+      from http_json_each('http://localhost:8080/stream/3')
+      limit 1
+    """).fetchall()
+    self.assertEqual(list(map(lambda x: tuple(x), rows)), [(0,)])
+
+    try:
+      db.execute("""
+        select http_mock('GET', 'http://example.com/items', 200, http_headers('Content-Type', 'application/json'), ' [1, "two", {"three": 3}, [4], null] ')
+      """)
+      db.execute("""
+        select http_mock('GET', 'http://example.com/items.ndjson', 200, http_headers('Content-Type', 'application/x-ndjson'), '{"a": 1}' || char(10) || '{"a": 2}' || char(10))
+      """)
+      rows = db.execute("""
+        select key, value, type from http_json_each('http://example.com/items')
+      """).fetchall()
+      self.assertEqual(list(map(lambda x: tuple(x), rows)), [
+        (0, 1, "integer"),
+        (1, "two", "text"),
+        (2, '{"three": 3}', "object"),
+        (3, "[4]", "array"),
+        (4, None, "null"),
+      ])
+      rows = db.execute("""
+        select key, value ->> '$.a' from http_json_each('http://example.com/items.ndjson')
+      """).fetchall()
+      self.assertEqual(list(map(lambda x: tuple(x), rows)), [(0, 1), (1, 2)])
+    finally:
+      db.execute("select http_mock_reset()")
+
+  def test_http_har(self):
+    timings = json.dumps({
+      "start": "2023-01-01 00:00:00",
+      "connection": "2023-01-01 00:00:00.01",
+      "wrote_headers": "2023-01-01 00:00:00.02",
+      "first_byte": "2023-01-01 00:00:00.1",
+      "body_end": "2023-01-01 00:00:00.15",
+    })
+    har, = db.execute("""
+      select http_har_export(
+        'GET', 'http://localhost:8080/get?a=1', http_headers('Accept', '*/*'), null,
+        200, http_headers('Content-Type', 'text/plain'), 'hi', ?, '127.0.0.1:8080'
+      )
+    """, [timings]).fetchone()
+    entry = json.loads(har)["log"]["entries"][0]
+    self.assertEqual(json.loads(har)["log"]["version"], "1.2")
+    self.assertEqual(entry["startedDateTime"], "2023-01-01T00:00:00Z")
+    self.assertEqual(entry["request"]["queryString"], [{"name": "a", "value": "1"}])
+    self.assertEqual(entry["response"]["content"], {"size": 2, "mimeType": "text/plain", "text": "hi"})
+    self.assertEqual(entry["timings"], {"blocked": 10, "dns": -1, "connect": -1, "send": 10, "wait": 80, "receive": 50, "ssl": -1})
+    self.assertEqual(entry["time"], 150)
+
+    rows = db.execute("""
+      select started_at, time, request_method, request_url, request_headers, request_body,
+        response_status, response_status_code, response_body, response_mime_type, remote_address
+      from http_har_entries(?)
+    """, [har]).fetchall()
+    self.assertEqual(list(map(lambda x: tuple(x), rows)), [
+      ("2023-01-01 00:00:00", 150.0, "GET", "http://localhost:8080/get?a=1", "Accept: */*\r\n", None,
+        "200 OK", 200, b"hi", "text/plain", "127.0.0.1"),
+    ])
+
+    with self.assertRaisesRegex(sqlite3.OperationalError, "invalid HAR document"):
+      db.execute("select * from http_har_entries('nope')").fetchall()
+
+  def test_http_mime_type(self):
+    http_mime_type = lambda x: db.execute("select http_mime_type(?)", [x]).fetchone()[0]
+    self.assertEqual(http_mime_type("text/HTML; charset=UTF-8"), "text/html")
+    self.assertEqual(http_mime_type("application/json"), "application/json")
+    self.assertEqual(http_mime_type("/"), None)
+
+  def test_http_mime_params_each(self):
+    rows = db.execute("""
+      select name, value
+      from http_mime_params_each('multipart/form-data; charset="utf-8"; Boundary=abc')
+    """).fetchall()
+    self.assertEqual(list(map(lambda x: dict(x), rows)), [
+      {"name": "boundary", "value": "abc"},
+      {"name": "charset", "value": "utf-8"},
+    ])
+
+  def test_http_content_disposition(self):
+    http_content_disposition = lambda x: db.execute("select http_content_disposition(?)", [x]).fetchone()[0]
+    self.assertEqual(http_content_disposition('attachment; filename="report.pdf"'), "report.pdf")
+    self.assertEqual(
+      http_content_disposition("attachment; filename=\"naive.txt\"; filename*=UTF-8''na%C3%AFve.txt"),
+      "naïve.txt"
+    )
+    self.assertEqual(http_content_disposition("inline"), None)
+
+  def test_http_accept_each(self):
+    rows = db.execute("""
+      select rank, value, q, params
+      from http_accept_each('text/html;level=1, application/json;q=0.5, */*;q=0.1, text/plain')
+    """).fetchall()
+    self.assertEqual(list(map(lambda x: dict(x), rows)), [
+      {"rank": 1, "value": "text/html", "q": 1.0, "params": '{"level":"1"}'},
+      {"rank": 2, "value": "text/plain", "q": 1.0, "params": "{}"},
+      {"rank": 3, "value": "application/json", "q": 0.5, "params": "{}"},
+      {"rank": 4, "value": "*/*", "q": 0.1, "params": "{}"},
+    ])
+
+  def test_http_detect_content_type(self):
+    http_detect_content_type = lambda x: db.execute("select http_detect_content_type(?)", [x]).fetchone()[0]
+    self.assertEqual(http_detect_content_type(b"\x89PNG\r\n\x1a\n"), "image/png")
+    self.assertEqual(http_detect_content_type("<!DOCTYPE html><html></html>"), "text/html; charset=utf-8")
+    self.assertEqual(http_detect_content_type(b"%PDF-1.4"), "application/pdf")
+
+  # runs without a local httpbin, all deliveries are answered by mocks
+  def test_http_outbox(self):
+    with self.assertRaisesRegex(sqlite3.OperationalError, "needs a database file"):
+      db.execute("create virtual table outbox using http_outbox()")
+
+    tmp = tempfile.TemporaryDirectory()
+    db_file = connect(EXT_PATH, db_path=os.path.join(tmp.name, "outbox.db"))
+    try:
+      db_file.execute("select http_mock('POST', 'http://outbox.test/ok', 200, null, 'thanks')")
+      db_file.execute("select http_mock('*', 'http://outbox.test/flaky', 503, null, 'down')")
+      db_file.execute("select http_mock('*', 'http://outbox.test/bad', 400, null, 'nope')")
+      db_file.execute("create virtual table outbox using http_outbox(max_attempts=2, backoff_ms=10, poll_ms=10)")
+
+      # requests are only delivered once their transaction commits
+      db_file.execute("insert into outbox(url, body) values ('http://outbox.test/rolledback', 'x')")
+      db_file.rollback()
+      db_file.execute("insert into outbox(url, body) values ('http://outbox.test/ok', 'a')")
+      db_file.execute("insert into outbox(method, url) values ('put', 'http://outbox.test/flaky')")
+      db_file.execute("insert into outbox(url, headers) values ('http://outbox.test/bad', http_headers('X-A', 'b'))")
+      db_file.commit()
+
+      for _ in range(200):
+        if db_file.execute("select count(*) from outbox where status in ('pending', 'delivering')").fetchone()[0] == 0:
+          break
+        time.sleep(0.01)
+      rows = db_file.execute("""
+        select method, url, status, attempts, last_error, response_status_code, response_body, delivered_at is not null
+        from outbox
+        order by rowid
+      """).fetchall()
+      self.assertEqual(list(map(lambda x: tuple(x), rows)), [
+        ("POST", "http://outbox.test/ok", "delivered", 1, None, 200, b"thanks", 1),
+        ("PUT", "http://outbox.test/flaky", "failed", 2, "unexpected response status 503 Service Unavailable", 503, b"down", 0),
+        ("POST", "http://outbox.test/bad", "failed", 1, "unexpected response status 400 Bad Request", 400, b"nope", 0),
+      ])
+      rows = db_file.execute("select url, count(*) from http_mock_calls group by 1 order by 1").fetchall()
+      self.assertEqual(list(map(lambda x: tuple(x), rows)), [
+        ("http://outbox.test/bad", 1),
+        ("http://outbox.test/flaky", 2),
+        ("http://outbox.test/ok", 1),
+      ])
+
+      # failed requests can be retried by making them pending again
+      db_file.execute("select http_mock('*', 'http://outbox.test/flaky', 202, null, 'back')")
+      db_file.execute("update outbox set status = 'pending', max_attempts = 3 where url = 'http://outbox.test/flaky'")
+      db_file.commit()
+      for _ in range(200):
+        if db_file.execute("select status from outbox where url = 'http://outbox.test/flaky'").fetchone()[0] not in ('pending', 'delivering'):
+          break
+        time.sleep(0.01)
+      d = db_file.execute("select status, attempts, response_body from outbox where url = 'http://outbox.test/flaky'").fetchone()
+      self.assertEqual(tuple(d), ("delivered", 3, b"back"))
+
+      # rowid and status lookups are pushed down to the shadow table
+      self.assertEqual(db_file.execute("select url from outbox where rowid = 3").fetchone()[0], "http://outbox.test/bad")
+      self.assertEqual([x[0] for x in db_file.execute("select rowid from outbox where status = 'failed'")], [3])
+      self.assertEqual([x[0] for x in db_file.execute("select rowid from outbox where rowid = 2 and status = 'delivered'")], [2])
+
+      # with the table open on two connections, each request is still delivered once
+      other = connect(EXT_PATH, db_path=os.path.join(tmp.name, "outbox.db"))
+      try:
+        other.execute("select count(*) from outbox").fetchone()
+        db_file.execute("select http_mock('POST', 'http://outbox.test/many', 200, null, 'ok')")
+        db_file.executemany("insert into outbox(url) values (?)", [("http://outbox.test/many",)] * 20)
+        db_file.commit()
+        for _ in range(300):
+          if db_file.execute("select count(*) from outbox where url = 'http://outbox.test/many' and status != 'delivered'").fetchone()[0] == 0:
+            break
+          time.sleep(0.01)
+        self.assertEqual(db_file.execute("select count(*) from outbox where url = 'http://outbox.test/many' and status = 'delivered'").fetchone()[0], 20)
+        self.assertEqual(db_file.execute("select count(*) from http_mock_calls where url = 'http://outbox.test/many'").fetchone()[0], 20)
+      finally:
+        other.close()
+
+      with self.assertRaisesRegex(sqlite3.OperationalError, "require a url"):
+        db_file.execute("insert into outbox(body) values ('x')")
+    finally:
+      db_file.rollback()
+      db_file.execute("drop table if exists outbox")
+      db_file.execute("select http_mock_reset()")
+      self.assertEqual(db_file.execute("select count(*) from sqlite_master where name like 'outbox%'").fetchone()[0], 0)
+      db_file.close()
+      tmp.cleanup()
+
+  @skip_do
+  def test_http_paginate(self):
+    # httpbin's /response-headers echoes back a "Link" header pointing to /get
+    rows = db.execute("""
+      select page_number, request_url, response_status_code
+      from http_paginate(
+        'http://localhost:8080/response-headers?Link=' || '%3C%2Fget%3E%3B%20rel%3D%22next%22'
+      )
+    """).fetchall()
+    self.assertEqual(list(map(lambda x: dict(x), rows)), [
+      {
+        "page_number": 1,
+        "request_url": "http://localhost:8080/response-headers?Link=%3C%2Fget%3E%3B%20rel%3D%22next%22",
+        "response_status_code": 200,
+      },
+      {"page_number": 2, "request_url": "http://localhost:8080/get", "response_status_code": 200},
+    ])
+
+    rows = db.execute("""
+      select page_number
+      from http_paginate(
+        'http://localhost:8080/response-headers?Link=' || '%3C%2Fget%3E%3B%20rel%3D%22next%22',
+        null,
+        1
+      )
+    """).fetchall()
+    self.assertEqual(len(rows), 1)
+
+  @skip_do
+  def test_http_paginate_cursor(self):
+    # httpbin's /anything echoes back query parameters, so the "next" cursor
+    # points to the same page the 2nd time and pagination stops
+    rows = db.execute("""
+      select page_number, request_url
+      from http_paginate_cursor('http://localhost:8080/anything?next=2', '$.args.next', 'page')
+    """).fetchall()
+    self.assertEqual(list(map(lambda x: dict(x), rows)), [
+      {"page_number": 1, "request_url": "http://localhost:8080/anything?next=2"},
+      {"page_number": 2, "request_url": "http://localhost:8080/anything?next=2&page=2"},
+    ])
+
+  @skip_do
+  def test_http_paginate_offset(self):
+    rows = db.execute("""
+      select page_number, request_url
+      from http_paginate_offset(
+        'http://localhost:8080/anything?x=a&x=b',
+        'offset',
+        0,
+        50,
+        '$.args.x',
+        null,
+        3
+      )
+    """).fetchall()
+    self.assertEqual(list(map(lambda x: dict(x), rows)), [
+      {"page_number": 1, "request_url": "http://localhost:8080/anything?offset=0&x=a&x=b"},
+      {"page_number": 2, "request_url": "http://localhost:8080/anything?offset=50&x=a&x=b"},
+      {"page_number": 3, "request_url": "http://localhost:8080/anything?offset=100&x=a&x=b"},
+    ])
+
+    # items_path must resolve to an array
+    with self.assertRaisesRegex(sqlite3.OperationalError, r"items_path \$\.args\.x not found in the response"):
+      db.execute("""
+        select page_number
+        from http_paginate_offset('http://localhost:8080/anything', 'page', 1, 1, '$.args.x')
+      """).fetchall()
+    with self.assertRaisesRegex(sqlite3.OperationalError, r"items_path \$\.args must be an array, found object"):
+      db.execute("""
+        select page_number
+        from http_paginate_offset('http://localhost:8080/anything', 'page', 1, 1, '$.args')
+      """).fetchall()
+
+    # the final empty page isn't yielded
+    try:
+      db.execute("""select http_mock('GET', 'http://example.com/items?page=1', 200, null, '{"items": [1, 2]}')""")
+      db.execute("""select http_mock('GET', 'http://example.com/items?page=2', 200, null, '{"items": [3]}')""")
+      db.execute("""select http_mock('GET', 'http://example.com/items?page=3', 200, null, '{"items": []}')""")
+      rows = db.execute("""
+        select page_number, response_body
+        from http_paginate_offset('http://example.com/items', 'page', 1, 1, '$.items')
+      """).fetchall()
+      self.assertEqual(list(map(lambda x: tuple(x), rows)), [
+        (1, b'{"items": [1, 2]}'),
+        (2, b'{"items": [3]}'),
+      ])
+    finally:
+      db.execute("select http_mock_reset()")
+
   @skip_do
   def test_http_post_body(self):
     d, = db.execute("""
@@ -326,6 +930,443 @@ class TestHttp(unittest.TestCase):
     """, (n,)).fetchall()
     
   
+  # runs without a local httpbin, the listener is requested by the same connection
+  def test_http_listen(self):
+    with self.assertRaisesRegex(sqlite3.OperationalError, "needs a database file"):
+      db.execute("select http_listen('127.0.0.1:0', 'webhooks')").fetchone()
+
+    with tempfile.TemporaryDirectory() as tmp:
+      db_file = connect(EXT_PATH, db_path=os.path.join(tmp, "listen.db"))
+      addr, = db_file.execute("select http_listen('127.0.0.1:0', 'webhooks', 202, 'thanks', http_headers('X-Reply', 'yes'))").fetchone()
+      try:
+        d = db_file.execute("""
+          select response_status_code, response_body, http_headers_get(response_headers, 'X-Reply')
+          from http_post('http://' || ? || '/hooks/github?event=push', http_headers('Content-Type', 'application/json'), '{"a": 1}')
+        """, [addr]).fetchone()
+        self.assertEqual(tuple(d), (202, b"thanks", "yes"))
+        db_file.execute("select http_get_body('http://' || ? || '/ping')", [addr]).fetchone()
+
+        # rows are committed before the reply
+        rows = db_file.execute("""
+          select method, path, query, body, http_headers_get(headers, 'Content-Type'), remote_address like '127.0.0.1:%'
+          from webhooks
+          order by id
+        """).fetchall()
+        self.assertEqual(list(map(lambda x: tuple(x), rows)), [
+          ("POST", "/hooks/github", "event=push", b'{"a": 1}', "application/json", 1),
+          ("GET", "/ping", None, None, None, 1),
+        ])
+
+        # requests that can't be inserted fail instead
+        db_file.execute("drop table webhooks")
+        d = db_file.execute("select response_status_code, response_body like '%no such table%' from http_get('http://' || ? || '/ping')", [addr]).fetchone()
+        self.assertEqual(tuple(d), (500, 1))
+      finally:
+        self.assertEqual(db_file.execute("select http_listen_stop(?)", [addr]).fetchone()[0], 1)
+      self.assertEqual(db_file.execute("select http_listen_stop()").fetchone()[0], 0)
+      with self.assertRaises(sqlite3.OperationalError):
+        db_file.execute("select http_get_body('http://' || ? || '/ping')", [addr]).fetchone()
+
+      # listeners stop when their connection closes
+      addr, = db_file.execute("select http_listen('127.0.0.1:0', 'webhooks')").fetchone()
+      db_file.execute("select http_get_body('http://' || ? || '/ping')", [addr]).fetchone()
+      db_file.close()
+      with self.assertRaises(sqlite3.OperationalError):
+        db.execute("select http_get_body('http://' || ? || '/ping')", [addr]).fetchone()
+
+  @skip_do
+  def test_http_log_to(self):
+    self.assertEqual(db.execute("select http_log_to('http_log', 4)").fetchone()[0], "http_log")
+    db.execute("select http_get_body('http://localhost:8080/get')").fetchone()
+    db.execute("select http_post_body('http://localhost:8080/post', null, 'alex')").fetchone()
+    with self.assertRaises(sqlite3.OperationalError):
+      db.execute("select http_get_body('http://localhost:9999/get')").fetchone()
+    self.assertIsNone(db.execute("select http_log_to(null)").fetchone()[0])
+    db.execute("select http_get_body('http://localhost:8080/get')").fetchone()
+
+    rows = db.execute("""
+      select request_method, request_url, request_body, request_size, response_status_code,
+        response_body, response_size > 4, json_type(timings, '$.body_end'), error is not null
+      from http_log
+      order by id
+    """).fetchall()
+    self.assertEqual(list(map(lambda x: tuple(x), rows)), [
+      ("GET", "http://localhost:8080/get", None, 0, 200, b'{\n  ', 1, "text", 0),
+      ("POST", "http://localhost:8080/post", b"alex", 4, 200, b'{\n  ', 1, "text", 0),
+      ("GET", "http://localhost:9999/get", None, 0, None, None, None, "null", 1),
+    ])
+    db.execute("drop table http_log")
+
+    # a row that can't be written doesn't fail the request
+    db.execute("create table http_log_broken(id INTEGER PRIMARY KEY)")
+    db.execute("select http_log_to('http_log_broken')")
+    try:
+      d, = db.execute("select http_get_body('http://localhost:8080/base64/YWxleA==')").fetchone()
+      self.assertEqual(d, b"alex")
+    finally:
+      db.execute("select http_log_to(null)")
+    self.assertEqual(db.execute("select count(*) from http_log_broken").fetchone()[0], 0)
+    db.execute("drop table http_log_broken")
+
+  @skip_do
+  def test_http_log_to_per_connection(self):
+    with tempfile.TemporaryDirectory() as tmp:
+      path = os.path.join(tmp, "log.db")
+      db_file = connect(EXT_PATH, db_path=path)
+      db_other = connect(EXT_PATH, db_path=path)
+      try:
+        self.assertEqual(db_file.execute("select http_log_to('http_log')").fetchone()[0], "http_log")
+        db_file.execute("select http_get_body('http://localhost:8080/get?from=file')").fetchone()
+        # only requests made from the connection that called http_log_to are logged
+        db_other.execute("select http_get_body('http://localhost:8080/get?from=other')").fetchone()
+        # requests made in the background are logged through a separate connection
+        db_file.execute("select http_await(http_request_async('GET', 'http://localhost:8080/get?from=async'))").fetchone()
+
+        rows = db_other.execute("select request_url, response_status_code, response_size > 0 from http_log order by id").fetchall()
+        self.assertEqual(list(map(lambda x: tuple(x), rows)), [
+          ("http://localhost:8080/get?from=file", 200, 1),
+          ("http://localhost:8080/get?from=async", 200, 1),
+        ])
+      finally:
+        db_file.close()
+        db_other.close()
+
+  # runs without a local httpbin, faults are injected on top of mocks
+  def test_http_fault_inject(self):
+    try:
+      db_nonet.execute("select http_mock('GET', 'http://*', 200, null, 'hello world')")
+      self.assertEqual(db_nonet.execute("select http_fault_inject('*.example.com', 'status', 1, 503)").fetchone()[0], 1)
+      d = db_nonet.execute("select response_status_code, response_body from http_get('http://api.example.com/a')").fetchone()
+      self.assertEqual(dict(d), {"response_status_code": 503, "response_body": b"Service Unavailable"})
+
+      # other hosts are unaffected, and a rate of 0 never injects
+      self.assertEqual(db_nonet.execute("select http_get_body('http://example.org/a')").fetchone()[0], b"hello world")
+      db_nonet.execute("select http_fault_inject('example.org', 'refused', 0)")
+      self.assertEqual(db_nonet.execute("select http_get_body('http://example.org/a')").fetchone()[0], b"hello world")
+
+      db_nonet.execute("select http_fault_inject('example.net', 'refused', 1)")
+      with self.assertRaisesRegex(sqlite3.OperationalError, "connection refused"):
+        db_nonet.execute("select http_get_body('http://example.net/a')").fetchone()
+
+      db_nonet.execute("select http_fault_inject('truncated.test', 'truncate', 1, 5)")
+      with self.assertRaisesRegex(sqlite3.OperationalError, "unexpected EOF"):
+        db_nonet.execute("select http_get_body('http://truncated.test/a')").fetchone()
+
+      db_nonet.execute("select http_fault_inject('slow.test', 'latency', 1, 50)")
+      db_nonet.execute("select http_fault_inject('slow.test', 'timeout', 1)")
+      db_nonet.execute("select http_timeout_set(100)")
+      with self.assertRaisesRegex(sqlite3.OperationalError, "Client.Timeout exceeded"):
+        db_nonet.execute("select http_get_body('http://slow.test/a')").fetchone()
+
+      with self.assertRaisesRegex(sqlite3.OperationalError, "unknown fault"):
+        db_nonet.execute("select http_fault_inject('*', 'explode', 1)").fetchone()
+    finally:
+      db_nonet.execute("select http_timeout_set(5000)")
+      db_nonet.execute("select http_fault_reset()")
+      db_nonet.execute("select http_mock_reset()")
+
+  # runs without a local httpbin, all responses come from mocks
+  def test_http_method_functions(self):
+    try:
+      db_nonet.execute("select http_mock('*', 'http://example.com/*', 200, http_headers('Allow', 'GET, PUT'), 'ok')")
+      self.assertEqual(db_nonet.execute("select http_head('http://example.com/a')").fetchone()[0], "Allow: GET, PUT\r\n")
+      self.assertEqual(db_nonet.execute("select http_options('http://example.com/a', null, null)").fetchone()[0], "Allow: GET, PUT\r\n")
+      for method in ["post", "put", "patch", "delete"]:
+        self.assertEqual(db_nonet.execute(f"select http_{method}_body('http://example.com/b', null, '{method}')").fetchone()[0], b"ok")
+        # body without cookies used to read past the given arguments
+        self.assertEqual(db_nonet.execute(f"select http_{method}_headers('http://example.com/c', null, '{method}')").fetchone()[0], "Allow: GET, PUT\r\n")
+
+      for table in ["http_get", "http_head", "http_options"]:
+        d = db_nonet.execute(f"select request_method, response_status_code from {table}('http://example.com/d')").fetchone()
+        self.assertEqual(dict(d), {"request_method": table[len("http_"):].upper(), "response_status_code": 200})
+      for table in ["http_put", "http_patch", "http_delete"]:
+        d = db_nonet.execute(f"select request_method, response_body from {table}('http://example.com/e', null, 'x')").fetchone()
+        self.assertEqual(dict(d), {"request_method": table[len("http_"):].upper(), "response_body": b"ok"})
+
+      rows = db_nonet.execute("select method, url, body from http_mock_calls").fetchall()
+      self.assertEqual(list(map(lambda x: tuple(x), rows)), [
+        ("HEAD", "http://example.com/a", None),
+        ("OPTIONS", "http://example.com/a", None),
+        ("POST", "http://example.com/b", b"post"),
+        ("POST", "http://example.com/c", b"post"),
+        ("PUT", "http://example.com/b", b"put"),
+        ("PUT", "http://example.com/c", b"put"),
+        ("PATCH", "http://example.com/b", b"patch"),
+        ("PATCH", "http://example.com/c", b"patch"),
+        ("DELETE", "http://example.com/b", b"delete"),
+        ("DELETE", "http://example.com/c", b"delete"),
+        ("GET", "http://example.com/d", None),
+        ("HEAD", "http://example.com/d", None),
+        ("OPTIONS", "http://example.com/d", None),
+        ("PUT", "http://example.com/e", b"x"),
+        ("PATCH", "http://example.com/e", b"x"),
+        ("DELETE", "http://example.com/e", b"x"),
+      ])
+
+      with self.assertRaisesRegex(sqlite3.OperationalError, r"usage: http_put_body\(url, \[headers\], \[body\], \[cookies\]\)"):
+        db_nonet.execute("select http_put_body('http://example.com/', null, null, null, 'extra')").fetchone()
+      with self.assertRaisesRegex(sqlite3.OperationalError, r"usage: http_do_body\(method, url, \[headers\], \[body\], \[cookies\]\)"):
+        db_nonet.execute("select http_do_body('GET')").fetchone()
+    finally:
+      db_nonet.execute("select http_mock_reset()")
+
+  # runs without a local httpbin, all responses come from mocks
+  def test_http_memo(self):
+    try:
+      db_nonet.execute("select http_mock('*', 'http://example.com/*', 200, null, 'hi')")
+      self.assertEqual(db_nonet.execute("select http_memo(1)").fetchone()[0], 1)
+      rows = db_nonet.execute("""
+        select http_get_body('http://example.com/' || value)
+        from json_each('["a", "b", "a", "a", "b"]')
+      """).fetchall()
+      self.assertEqual(list(map(lambda x: x[0], rows)), [b"hi"] * 5)
+      db_nonet.execute("select http_post_body('http://example.com/a', null, 'x')").fetchall()
+      db_nonet.execute("select http_post_body('http://example.com/a', null, 'x')").fetchall()
+      rows = db_nonet.execute("select method, url from http_mock_calls").fetchall()
+      self.assertEqual(list(map(lambda x: tuple(x), rows)), [
+        ("GET", "http://example.com/a"),
+        ("GET", "http://example.com/b"),
+        ("POST", "http://example.com/a"),
+        ("POST", "http://example.com/a"),
+      ])
+
+      # disabling forgets every memoized response
+      self.assertEqual(db_nonet.execute("select http_memo(0)").fetchone()[0], 0)
+      db_nonet.execute("select http_get_body('http://example.com/a')").fetchall()
+      self.assertEqual(db_nonet.execute("select count(*) from http_mock_calls").fetchone()[0], 5)
+
+      # identical requests in flight at once share a single request
+      db_nonet.execute("select http_mock_reset()")
+      db_nonet.execute("select http_mock('GET', 'http://example.com/*', 200, null, 'slow', 100)")
+      self.assertEqual(db_nonet.execute("select http_memo(1, 150)").fetchone()[0], 1)
+      handles = [db_nonet.execute("select http_request_async('GET', 'http://example.com/slow')").fetchone()[0] for _ in range(5)]
+      for handle in handles:
+        self.assertEqual(db_nonet.execute("select http_await(?)", [handle]).fetchone()[0], b"slow")
+      self.assertEqual(db_nonet.execute("select count(*) from http_mock_calls").fetchone()[0], 1)
+
+      # but not when memoizing is disabled, where every request is made on its own
+      db_nonet.execute("select http_memo(0)")
+      handles = [db_nonet.execute("select http_request_async('GET', 'http://example.com/slow')").fetchone()[0] for _ in range(5)]
+      for handle in handles:
+        self.assertEqual(db_nonet.execute("select http_await(?)", [handle]).fetchone()[0], b"slow")
+      self.assertEqual(db_nonet.execute("select count(*) from http_mock_calls").fetchone()[0], 6)
+      db_nonet.execute("select http_mock_reset()")
+      db_nonet.execute("select http_mock('GET', 'http://example.com/*', 200, null, 'slow', 100)")
+      self.assertEqual(db_nonet.execute("select http_memo(1, 150)").fetchone()[0], 1)
+      db_nonet.execute("select http_get_body('http://example.com/slow')").fetchall()
+      self.assertEqual(db_nonet.execute("select count(*) from http_mock_calls").fetchone()[0], 1)
+
+      # and responses expire ttl_ms after they arrive
+      db_nonet.execute("select http_get_body('http://example.com/slow')").fetchall()
+      self.assertEqual(db_nonet.execute("select count(*) from http_mock_calls").fetchone()[0], 1)
+      time.sleep(0.2)
+      db_nonet.execute("select http_get_body('http://example.com/slow')").fetchall()
+      self.assertEqual(db_nonet.execute("select count(*) from http_mock_calls").fetchone()[0], 2)
+
+      with self.assertRaisesRegex(sqlite3.OperationalError, "ttl_ms must be positive"):
+        db_nonet.execute("select http_memo(1, 0)").fetchone()
+
+      # at most max_bytes of bodies are kept, forgetting the least recently used
+      db_nonet.execute("select http_mock_reset()")
+      db_nonet.execute("select http_mock('GET', 'http://example.com/*', 200, null, 'hi')")
+      self.assertEqual(db_nonet.execute("select http_memo(1, null, 5)").fetchone()[0], 1)
+      for path in ["a", "b", "a", "c", "a", "b"]:
+        db_nonet.execute("select http_get_body('http://example.com/' || ?)", [path]).fetchall()
+      rows = db_nonet.execute("select url from http_mock_calls").fetchall()
+      self.assertEqual(list(map(lambda x: x[0], rows)), [
+        "http://example.com/a",
+        "http://example.com/b",
+        "http://example.com/c",
+        "http://example.com/b",
+      ])
+
+      # and bodies larger than that are never memoized
+      db_nonet.execute("select http_mock_reset()")
+      db_nonet.execute("select http_mock('GET', 'http://example.com/*', 200, null, 'hi')")
+      self.assertEqual(db_nonet.execute("select http_memo(1, null, 1)").fetchone()[0], 1)
+      for _ in range(2):
+        self.assertEqual(db_nonet.execute("select http_get_body('http://example.com/a')").fetchone()[0], b"hi")
+      self.assertEqual(db_nonet.execute("select count(*) from http_mock_calls").fetchone()[0], 2)
+      with self.assertRaisesRegex(sqlite3.OperationalError, "max_bytes must be positive"):
+        db_nonet.execute("select http_memo(1, null, 0)").fetchone()
+
+      # memoized responses don't wait on http_rate_limit
+      self.assertEqual(db_nonet.execute("select http_memo(1)").fetchone()[0], 1)
+      db_nonet.execute("select http_rate_limit(300)")
+      db_nonet.execute("select http_get_body('http://example.com/limited')").fetchall()
+      started = time.time()
+      for _ in range(3):
+        self.assertEqual(db_nonet.execute("select http_get_body('http://example.com/limited')").fetchone()[0], b"hi")
+      self.assertLess(time.time() - started, 0.3)
+    finally:
+      db_nonet.execute("select http_rate_limit(1)")
+      db_nonet.execute("select http_memo(0)")
+      db_nonet.execute("select http_mock_reset()")
+      db_nonet.execute("select http_results_clear()")
+
+  # runs without a local httpbin, all responses come from mocks
+  def test_http_mock(self):
+    try:
+      with self.assertRaisesRegex(sqlite3.OperationalError, "network access is disabled"):
+        db_nonet.execute("select http_get_body('http://example.com/a')").fetchone()
+
+      id, = db_nonet.execute("""
+        select http_mock('GET', 'http://example.com/*', 200, http_headers('Content-Type', 'text/plain'), 'hi')
+      """).fetchone()
+      self.assertEqual(db_nonet.execute("select http_get_body('http://example.com/a')").fetchone()[0], b"hi")
+      d = db_nonet.execute("select response_status, response_headers from http_get('http://example.com/b?c=d')").fetchone()
+      self.assertEqual(dict(d), {"response_status": "200 OK", "response_headers": "Content-Type: text/plain\r\n"})
+
+      # mocks registered later take precedence, and match any method with '*'
+      id2, = db_nonet.execute("select http_mock('*', 'http://example.com/b*', 503, null, 'down')").fetchone()
+      self.assertEqual(db_nonet.execute("select http_do_headers('POST', 'http://example.com/b', null, 'body')").fetchone()[0], "")
+      with self.assertRaisesRegex(sqlite3.OperationalError, "network access is disabled"):
+        db_nonet.execute("select http_post_body('http://example.org/', null, 'x')").fetchone()
+
+      rows = db_nonet.execute("select method, url, body, mock_id from http_mock_calls").fetchall()
+      self.assertEqual(list(map(lambda x: dict(x), rows)), [
+        {"method": "GET", "url": "http://example.com/a", "body": None, "mock_id": None},
+        {"method": "GET", "url": "http://example.com/a", "body": None, "mock_id": id},
+        {"method": "GET", "url": "http://example.com/b?c=d", "body": None, "mock_id": id},
+        {"method": "POST", "url": "http://example.com/b", "body": b"body", "mock_id": id2},
+        {"method": "POST", "url": "http://example.org/", "body": b"x", "mock_id": None},
+      ])
+
+      # strict mode never sends unmatched requests to the network
+      self.assertEqual(db.execute("select http_mock_strict(1)").fetchone()[0], 1)
+      with self.assertRaisesRegex(sqlite3.OperationalError, "no mock matches GET http://localhost:8080/get"):
+        db.execute("select http_get_body('http://localhost:8080/get')").fetchone()
+    finally:
+      db.execute("select http_mock_reset()")
+    self.assertEqual(db.execute("select count(*) from http_mock_calls").fetchone()[0], 0)
+
+  # runs without a local httpbin, all responses come from tests/cassette.jsonl
+  def test_http_cassette_replay(self):
+    self.assertEqual(db.execute("select http_cassette('tests/cassette.jsonl', 'replay')").fetchone()[0], "replay")
+    try:
+      # repeated requests are replayed in recorded order, then the last one repeats
+      bodies = [db.execute("select http_get_body('http://localhost:8080/get')").fetchone()[0] for _ in range(3)]
+      self.assertEqual(bodies, [b'{"n": 1}', b'{"n": 2}', b'{"n": 2}'])
+
+      d = db.execute("select response_status, response_headers, response_body from http_post('http://localhost:8080/post', null, 'alex')").fetchone()
+      self.assertEqual(dict(d), {
+        "response_status": "201 Created",
+        "response_headers": "Content-Type: text/plain\r\n",
+        "response_body": b"created alex",
+      })
+
+      with self.assertRaisesRegex(sqlite3.OperationalError, "no interaction in cassette"):
+        db.execute("select http_get_body('http://localhost:8080/nope')").fetchone()
+
+      # matching on the body requires the same request body
+      db.execute("select http_cassette('tests/cassette.jsonl', 'replay', 'method,url,body')")
+      with self.assertRaisesRegex(sqlite3.OperationalError, "no interaction in cassette"):
+        db.execute("select http_post_body('http://localhost:8080/post', null, 'angel')").fetchone()
+
+      with self.assertRaisesRegex(sqlite3.OperationalError, "unknown cassette mode"):
+        db.execute("select http_cassette('tests/cassette.jsonl', 'rewind')").fetchone()
+    finally:
+      self.assertIsNone(db.execute("select http_cassette(null)").fetchone()[0])
+
+  @skip_do
+  def test_http_cassette_record(self):
+    path = "tests/recorded.jsonl"
+    db.execute("select http_cassette(?, 'record')", [path])
+    recorded = db.execute("select http_get_body('http://localhost:8080/base64/YWxleA==')").fetchone()[0]
+    db.execute("select http_cassette(?, 'passthrough')", [path])
+    replayed = db.execute("select http_get_body('http://localhost:8080/base64/YWxleA==')").fetchone()[0]
+    passed = db.execute("select http_get_body('http://localhost:8080/base64/YW5nZWw=')").fetchone()[0]
+    db.execute("select http_cassette(null)")
+
+    with open(path) as f:
+      interactions = [json.loads(line) for line in f]
+    os.remove(path)
+    self.assertEqual((recorded, replayed, passed), (b"alex", b"alex", b"angel"))
+    self.assertEqual(len(interactions), 1)
+    self.assertEqual(interactions[0]["url"], "http://localhost:8080/base64/YWxleA==")
+
+  # runs without a local httpbin, against the built-in test server
+  def test_http_cassette_record_stream(self):
+    path = "tests/recorded-stream.jsonl"
+    base, = db.execute("select http_test_server_start()").fetchone()
+    port = int(base.rsplit(":", 1)[1])
+    try:
+      # the stream never ends, so it's saved once closed by the LIMIT
+      db.execute("select http_cassette(?, 'record')", [path])
+      recorded = db.execute("select data from http_sse(? || '/sse/5') limit 2", [base]).fetchall()
+      db.execute("select http_cassette(?, 'replay')", [path])
+      replayed = db.execute("select data from http_sse(? || '/sse/5') limit 2", [base]).fetchall()
+    finally:
+      db.execute("select http_cassette(null)")
+      db.execute("select http_test_server_stop(?)", [port]).fetchone()
+
+    with open(path) as f:
+      interactions = [json.loads(line) for line in f]
+    os.remove(path)
+    self.assertEqual(list(map(lambda x: x[0], recorded)), ["event 1", "event 2"])
+    self.assertEqual(list(map(lambda x: x[0], replayed)), ["event 1", "event 2"])
+    self.assertEqual(len(interactions), 1)
+
+  @skip_do
+  def test_http_warc_to(self):
+    path = "tests/test.warc"
+    if os.path.exists(path):
+      os.remove(path)
+    self.assertEqual(db.execute("select http_warc_to(?)", [path]).fetchone()[0], path)
+    body, = db.execute("select http_get_body('http://localhost:8080/base64/YWxleA==')").fetchone()
+    self.assertIsNone(db.execute("select http_warc_to(null)").fetchone()[0])
+    self.assertEqual(body, b"alex")
+
+    with open(path, "rb") as f:
+      warc = f.read()
+    os.remove(path)
+    records = [r for r in warc.split(b"WARC/1.1\r\n") if r]
+    types = [r.split(b"\r\n")[0] for r in records]
+    self.assertEqual(types, [b"WARC-Type: warcinfo", b"WARC-Type: response", b"WARC-Type: request", b"WARC-Type: metadata"])
+    self.assertIn(b"WARC-Target-URI: http://localhost:8080/base64/YWxleA==\r\n", records[1])
+    # sha1 of 'alex', base32 encoded
+    self.assertIn(b"WARC-Payload-Digest: sha1:MDDNE55IXWA547654GJADP44LCR56CHU\r\n", records[1])
+    self.assertTrue(records[1].endswith(b"\r\n\r\nalex\r\n\r\n"))
+    self.assertTrue(records[2].split(b"\r\n\r\n")[1].startswith(b"GET /base64/YWxleA== HTTP/1.1\r\nHost: localhost:8080\r\n"))
+
+  @skip_do
+  def test_http_warc_to_digests(self):
+    path = "tests/test.warc.gz"
+    if os.path.exists(path):
+      os.remove(path)
+    db.execute("select http_warc_to(?)", [path]).fetchone()
+    db.execute("select http_get_body('http://localhost:8080/stream/50')").fetchone()
+    # the body is never read, but still archived whole once closed
+    db.execute("select http_get_headers('http://localhost:8080/stream/50')").fetchone()
+    db.execute("select http_warc_to(null)").fetchone()
+
+    with gzip.open(path, "rb") as f:
+      warc = f.read()
+    os.remove(path)
+
+    def digest(data):
+      return "sha1:" + base64.b32encode(hashlib.sha1(data).digest()).decode()
+
+    records = []
+    while warc:
+      head, warc = warc.split(b"\r\n\r\n", 1)
+      lines = head.decode().split("\r\n")
+      self.assertEqual(lines[0], "WARC/1.1")
+      fields = dict(line.split(": ", 1) for line in lines[1:])
+      length = int(fields["Content-Length"])
+      block, warc = warc[:length], warc[length:]
+      self.assertEqual(warc[:4], b"\r\n\r\n")
+      warc = warc[4:]
+      self.assertEqual(fields["WARC-Block-Digest"], digest(block))
+      if fields["WARC-Type"] == "response":
+        self.assertEqual(fields["WARC-Payload-Digest"], digest(block.split(b"\r\n\r\n", 1)[1]))
+      records.append((fields, block))
+
+    self.assertEqual([fields["WARC-Type"] for fields, _ in records], ["warcinfo"] + ["response", "request", "metadata"] * 2)
+    for fields, block in [records[1], records[4]]:
+      self.assertNotIn("WARC-Truncated", fields)
+      self.assertEqual(len(block.split(b"\r\n\r\n", 1)[1].splitlines()), 50)
+
   @skip_do
   def test_http_rate_limit(self):
     # turn off rate limit
@@ -361,6 +1402,269 @@ class TestHttp(unittest.TestCase):
         self.assertGreaterEqual((curr_start - prev_start), timedelta(milliseconds=20-3))
         self.assertLessEqual((curr_start - prev_start), timedelta(milliseconds=20+5))
         
+  @skip_do
+  def test_http_sse(self):
+    # httpbin doesn't serve event streams, so connecting must fail loudly
+    with self.assertRaisesRegex(sqlite3.OperationalError, "not an event stream"):
+      db.execute("select * from http_sse('http://localhost:8080/get', null, 1, 1000)").fetchall()
+
+    # 204 No Content tells clients to stop reconnecting
+    rows = db.execute("select * from http_sse('http://localhost:8080/status/204', null, 1, 1000)").fetchall()
+    self.assertEqual(rows, [])
+
+  # runs without a local httpbin, against the built-in test server
+  def test_http_sse_stream(self):
+    base, = db.execute("select http_test_server_start()").fetchone()
+    port = int(base.rsplit(":", 1)[1])
+    def open_streams():
+      return json.loads(db.execute("select http_get_body(? || '/sse/open')", [base]).fetchone()[0])["open"]
+    try:
+      rows = db.execute("select id, event, data, retry from http_sse(? || '/sse/3', null, 2)", [base]).fetchall()
+      self.assertEqual(list(map(lambda x: tuple(x), rows)), [
+        ("1", "message", "event 1", None),
+        ("2", "message", "event 2", None),
+      ])
+
+      # stopping early with a LIMIT closes the stream
+      rows = db.execute("select data from http_sse(? || '/sse/3') limit 2", [base]).fetchall()
+      self.assertEqual(list(map(lambda x: x[0], rows)), ["event 1", "event 2"])
+      for _ in range(100):
+        if open_streams() == 0:
+          break
+        time.sleep(0.01)
+      self.assertEqual(open_streams(), 0)
+    finally:
+      db.execute("select http_test_server_stop(?)", [port]).fetchone()
+
+  @skip_do
+  def test_http_websocket(self):
+    # httpbin doesn't upgrade connections, so the handshake must fail loudly
+    with self.assertRaisesRegex(sqlite3.OperationalError, "error on websocket handshake"):
+      db.execute("select * from http_websocket('http://localhost:8080/get', null, '[\"hello\"]', 1, 1000)").fetchall()
+
+    with self.assertRaisesRegex(sqlite3.OperationalError, "send_messages_json must be a JSON array"):
+      db.execute("select * from http_websocket('ws://localhost:8080/get', null, 'hello', 1, 1000)").fetchall()
+
+  # runs without a local httpbin, against the built-in test server
+  def test_http_websocket_echo(self):
+    base, = db.execute("select http_test_server_start()").fetchone()
+    port = int(base.rsplit(":", 1)[1])
+    try:
+      rows = db.execute("""
+        select type, payload, received_at is not null
+        from http_websocket(? || '/websocket/echo', null, json_array('hello', json_object('a', 1)), 2, 1000)
+      """, [base]).fetchall()
+      self.assertEqual(list(map(lambda x: tuple(x), rows)), [
+        ("text", "hello", 1),
+        ("text", '{"a":1}', 1),
+      ])
+
+      # stopping early with a LIMIT closes the connection
+      rows = db.execute("""
+        select payload from http_websocket(? || '/websocket/echo', null, '["a", "b", "c"]') limit 2
+      """, [base]).fetchall()
+      self.assertEqual(list(map(lambda x: x[0], rows)), ["a", "b"])
+
+      # without timeout_ms, a quiet server ends the table after the request timeout
+      db.execute("select http_timeout_set(200)")
+      try:
+        rows = db.execute("""
+          select payload from http_websocket(? || '/websocket/echo', null, '["a"]')
+        """, [base]).fetchall()
+      finally:
+        db.execute("select http_timeout_set(5000)")
+      self.assertEqual(list(map(lambda x: x[0], rows)), ["a"])
+
+      # the handshake goes through mocks like any other request
+      db.execute("select http_mock_strict(1)")
+      with self.assertRaisesRegex(sqlite3.OperationalError, "no mock matches GET"):
+        db.execute("select * from http_websocket(? || '/websocket/echo', null, null, 1, 1000)", [base]).fetchall()
+      db.execute("select http_mock('GET', ? || '/websocket/echo', 200, null, 'not a websocket')", [base])
+      with self.assertRaisesRegex(sqlite3.OperationalError, "expected 101 Switching Protocols, got 200 OK"):
+        db.execute("select * from http_websocket(? || '/websocket/echo', null, null, 1, 1000)", [base]).fetchall()
+    finally:
+      db.execute("select http_mock_reset()")
+      db.execute("select http_test_server_stop(?)", [port]).fetchone()
+
+  # runs without a local httpbin, the server is requested by the same connection
+  def test_http_serve(self):
+    with self.assertRaisesRegex(sqlite3.OperationalError, "needs a database file"):
+      db.execute("select http_serve('127.0.0.1:0', ?)", [json.dumps({"/": "select 1"})]).fetchone()
+
+    with tempfile.TemporaryDirectory() as tmp:
+      db_file = connect(EXT_PATH, db_path=os.path.join(tmp, "serve.db"))
+      db_file.execute("create table serve_users(id integer primary key, name text, avatar blob)")
+      db_file.execute("insert into serve_users values (1, 'alex', x'00ff'), (2, 'brian', null)")
+      db_file.commit()
+      routes = json.dumps({
+        "/users": "select id, name from serve_users where name like coalesce(:q, '%') order by id",
+        "/users/:id": {"sql": "select * from serve_users where id = :id"},
+        "/users.csv": {"sql": "select id, name from serve_users order by id", "format": "csv"},
+      })
+      addr, = db_file.execute("select http_serve('127.0.0.1:0', ?, 'secret')", [routes]).fetchone()
+
+      def get(path, token="secret"):
+        return tuple(db_file.execute("""
+          select response_status_code, http_headers_get(response_headers, 'Content-Type'), cast(response_body as text)
+          from http_get('http://' || ? || ?, iif(? is null, null, http_headers('Authorization', 'Bearer ' || ?)))
+        """, [addr, path, token, token]).fetchone())
+
+      try:
+        status, content_type, body = get("/users")
+        self.assertEqual((status, content_type), (200, "application/json"))
+        self.assertEqual(body, '[\n  {"id": 1, "name": "alex"},\n  {"id": 2, "name": "brian"}\n]\n')
+        self.assertEqual(json.loads(get("/users?q=b%25")[2]), [{"id": 2, "name": "brian"}])
+        self.assertEqual(json.loads(get("/users/1")[2]), [{"id": 1, "name": "alex", "avatar": "AP8="}])
+        self.assertEqual(json.loads(get("/users/3")[2]), [])
+        self.assertEqual(get("/users.csv")[1:], ("text/csv; charset=utf-8", "id,name\n1,alex\n2,brian\n"))
+        self.assertEqual(get("/users/2?_format=csv")[2], "id,name,avatar\n2,brian,\n")
+
+        self.assertEqual(get("/users", token=None)[0], 401)
+        self.assertEqual(get("/users", token="wrong")[0], 401)
+        self.assertEqual(get("/nope")[0], 404)
+
+        # only committed rows are seen
+        db_file.execute("insert into serve_users values (3, 'craig', null)")
+        self.assertEqual(len(json.loads(get("/users")[2])), 2)
+        db_file.commit()
+        self.assertEqual(len(json.loads(get("/users")[2])), 3)
+      finally:
+        self.assertEqual(db_file.execute("select http_serve_stop(?)", [addr]).fetchone()[0], 1)
+
+      # routes are prepared right away
+      with self.assertRaisesRegex(sqlite3.OperationalError, "no such table"):
+        db_file.execute("select http_serve('127.0.0.1:0', ?)", [json.dumps({"/broken": "select * from nope"})]).fetchone()
+      with self.assertRaisesRegex(sqlite3.OperationalError, "/delete"):
+        db_file.execute("select http_serve('127.0.0.1:0', ?)", [json.dumps({"/delete": "delete from serve_users"})]).fetchone()
+      with self.assertRaisesRegex(sqlite3.OperationalError, "single SELECT statement"):
+        db_file.execute("select http_serve('127.0.0.1:0', ?)", [json.dumps({"/": "select 1; delete from x"})]).fetchone()
+      self.assertEqual(db_file.execute("select http_serve_stop()").fetchone()[0], 0)
+
+      # servers stop when their connection closes
+      addr, = db_file.execute("select http_serve('127.0.0.1:0', ?)", [routes]).fetchone()
+      db_file.close()
+      with self.assertRaises(sqlite3.OperationalError):
+        db.execute("select http_get_body('http://' || ? || '/users')", [addr]).fetchone()
+
+  # runs without a local httpbin, against the built-in test server
+  def test_http_test_server(self):
+    base, = db.execute("select http_test_server_start()").fetchone()
+    self.assertRegex(base, r"^http://127\.0\.0\.1:\d+$")
+    port = int(base.rsplit(":", 1)[1])
+    try:
+      body = json.loads(db.execute("select http_get_body(? || '/get?a=1&a=2&b=3')", [base]).fetchone()[0])
+      self.assertEqual(body["args"], {"a": ["1", "2"], "b": "3"})
+      self.assertEqual(body["url"], base + "/get?a=1&a=2&b=3")
+
+      body = json.loads(db.execute("select http_post_body(? || '/post', http_headers('Content-Type', 'application/json'), '{\"x\": 1}')", [base]).fetchone()[0])
+      self.assertEqual((body["data"], body["json"]), ('{"x": 1}', {"x": 1}))
+
+      d = db.execute("select response_status_code from http_get(? || '/status/418')", [base]).fetchone()
+      self.assertEqual(d[0], 418)
+
+      d = db.execute("select response_status_code, request_url from http_get(? || '/redirect/2')", [base]).fetchone()
+      self.assertEqual(tuple(d), (200, base + "/redirect/2"))
+
+      body = json.loads(db.execute("select http_get_body(? || '/cookies', null, http_cookies('name', 'alex'))", [base]).fetchone()[0])
+      self.assertEqual(body, {"cookies": {"name": "alex"}})
+
+      body = json.loads(db.execute("select http_get_body(? || '/headers', http_headers('X-Test', 'yes'))", [base]).fetchone()[0])
+      self.assertEqual(body["headers"]["X-Test"], "yes")
+
+      lines = db.execute("select http_get_body(? || '/stream/3')", [base]).fetchone()[0].splitlines()
+      self.assertEqual([json.loads(line)["id"] for line in lines], [0, 1, 2])
+
+      body = json.loads(db.execute("select http_get_body(? || '/delay/0.01')", [base]).fetchone()[0])
+      self.assertEqual(body["url"], base + "/delay/0.01")
+
+      with self.assertRaisesRegex(sqlite3.OperationalError, "already running"):
+        db.execute("select http_test_server_start(?)", [port]).fetchone()
+    finally:
+      self.assertEqual(db.execute("select http_test_server_stop(?)", [port]).fetchone()[0], 1)
+    self.assertEqual(db.execute("select http_test_server_stop(?)", [port]).fetchone()[0], 0)
+    with self.assertRaises(sqlite3.OperationalError):
+      db.execute("select http_get_body(? || '/get')", [base]).fetchone()
+
+    # closing the connection that started a server stops it
+    db_other = connect(EXT_PATH)
+    base, = db_other.execute("select http_test_server_start()").fetchone()
+    self.assertEqual(db.execute("select response_status_code from http_get(? || '/status/200')", [base]).fetchone()[0], 200)
+    db_other.close()
+    with self.assertRaises(sqlite3.OperationalError):
+      db.execute("select http_get_body(? || '/get')", [base]).fetchone()
+
+  # runs without a local httpbin, all requests are answered by mocks
+  def test_http_request_async(self):
+    try:
+      db.execute("select http_mock('GET', 'http://async.test/slow', 200, null, 'slow', 100)")
+      db.execute("select http_mock('GET', 'http://async.test/fast', 200, http_headers('X-A', 'b'), 'fast')")
+      db.execute("select http_mock_strict(1)")
+      db.execute("select http_results_clear()")
+
+      started = time.time()
+      handles = [db.execute("select http_request_async('GET', 'http://async.test/slow')").fetchone()[0] for _ in range(5)]
+      self.assertLess(time.time() - started, 0.1)
+      fast, = db.execute("select http_request_async('GET', 'http://async.test/fast')").fetchone()
+      missing, = db.execute("select http_request_async('GET', 'http://async.test/missing')").fetchone()
+
+      # requests overlap, so awaiting all of them takes about as long as one
+      bodies = [db.execute("select http_await(?)", [h]).fetchone()[0] for h in handles]
+      self.assertEqual(bodies, [b"slow"] * 5)
+      self.assertLess(time.time() - started, 0.4)
+      self.assertEqual(db.execute("select http_await(?, 1)", [fast]).fetchone()[0], b"fast")
+      with self.assertRaisesRegex(sqlite3.OperationalError, "no mock matches GET http://async.test/missing"):
+        db.execute("select http_await(?, 1)", [missing]).fetchone()
+      with self.assertRaisesRegex(sqlite3.OperationalError, "no request with handle"):
+        db.execute("select http_await(-1)").fetchone()
+
+      # awaited requests are forgotten, unless kept
+      with self.assertRaisesRegex(sqlite3.OperationalError, "no request with handle"):
+        db.execute("select http_await(?)", [handles[0]]).fetchone()
+      self.assertEqual(db.execute("select count(*) from http_results where handle < ?", [fast]).fetchone()[0], 0)
+
+      rows = db.execute("""
+        select handle, request_url, status, response_status_code, response_headers, response_body, error is not null
+        from http_results
+        where handle >= ?
+      """, [fast]).fetchall()
+      self.assertEqual(list(map(lambda x: tuple(x), rows)), [
+        (fast, "http://async.test/fast", "done", 200, "X-A: b\r\n", b"fast", 0),
+        (missing, "http://async.test/missing", "error", None, None, None, 1),
+      ])
+      self.assertEqual(db.execute("select http_results_clear()").fetchone()[0], 2)
+      self.assertEqual(db.execute("select count(*) from http_results").fetchone()[0], 0)
+
+      # with a single request at a time, they no longer overlap
+      self.assertEqual(db.execute("select http_concurrency_set(1)").fetchone()[0], 1)
+      started = time.time()
+      handles = [db.execute("select http_request_async('GET', 'http://async.test/slow')").fetchone()[0] for _ in range(3)]
+      for handle in handles:
+        db.execute("select http_await(?)", [handle]).fetchone()
+      self.assertGreaterEqual(time.time() - started, 0.3)
+      with self.assertRaisesRegex(sqlite3.OperationalError, "positive number"):
+        db.execute("select http_concurrency_set(0)").fetchone()
+      self.assertEqual(db.execute("select http_concurrency_set(64)").fetchone()[0], 64)
+
+      # awaiting gives up after timeout_ms, and the request can be awaited again
+      slow, = db.execute("select http_request_async('GET', 'http://async.test/slow')").fetchone()
+      with self.assertRaisesRegex(sqlite3.OperationalError, "still running after 10ms"):
+        db.execute("select http_await(?, 0, 10)", [slow]).fetchone()
+      self.assertEqual(db.execute("select http_await(?, 0, 1000)", [slow]).fetchone()[0], b"slow")
+
+      # handles belong to the connection that started the request
+      other = connect(EXT_PATH)
+      try:
+        slow, = db.execute("select http_request_async('GET', 'http://async.test/slow')").fetchone()
+        with self.assertRaisesRegex(sqlite3.OperationalError, "no request with handle"):
+          other.execute("select http_await(?)", [slow]).fetchone()
+        self.assertEqual(other.execute("select count(*) from http_results").fetchone()[0], 0)
+        self.assertEqual(db.execute("select http_await(?)", [slow]).fetchone()[0], b"slow")
+      finally:
+        other.close()
+    finally:
+      db.execute("select http_concurrency_set(64)")
+      db.execute("select http_mock_reset()")
+
   @skip_do
   def test_http_timeout_set(self):
     d, = db.execute("select http_timeout_set(100)").fetchone()
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.riyazali.net/sqlite"
+)
+
+// A running test server, started with http_test_server_start
+type testServer struct {
+	port   int
+	server *http.Server
+	// removes the hook stopping the server along with its connection
+	removeHook func()
+}
+
+// Running test servers, by port
+var testServers = map[int]*testServer{}
+var testServersMu sync.Mutex
+
+// Stop the server, returning false if it already was
+func (s *testServer) stop() bool {
+	testServersMu.Lock()
+	running := testServers[s.port] == s
+	if running {
+		delete(testServers, s.port)
+	}
+	removeHook := s.removeHook
+	testServersMu.Unlock()
+	if !running {
+		return false
+	}
+	if removeHook != nil {
+		removeHook()
+	}
+	s.server.Close()
+	return true
+}
+
+// Returns a single value if there's only one, otherwise the list of values, like httpbin does
+func httpbinValues(values map[string][]string) map[string]interface{} {
+	result := map[string]interface{}{}
+	for key, v := range values {
+		if len(v) == 1 {
+			result[key] = v[0]
+		} else {
+			result[key] = v
+		}
+	}
+	return result
+}
+
+func httpbinHeaders(r *http.Request) map[string]interface{} {
+	headers := map[string]interface{}{"Host": r.Host}
+	for key, values := range r.Header {
+		headers[key] = strings.Join(values, ",")
+	}
+	return headers
+}
+
+func httpbinOrigin(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func httpbinUrl(r *http.Request) string {
+	return "http://" + r.Host + r.RequestURI
+}
+
+// The common fields of a httpbin response describing the request
+func httpbinRequest(r *http.Request) map[string]interface{} {
+	return map[string]interface{}{
+		"args":    httpbinValues(r.URL.Query()),
+		"headers": httpbinHeaders(r),
+		"origin":  httpbinOrigin(r),
+		"url":     httpbinUrl(r),
+	}
+}
+
+// Like httpbinRequest, with the request body as data, form, files, and json fields
+func httpbinRequestWithBody(r *http.Request) map[string]interface{} {
+	result := httpbinRequest(r)
+	body, _ := io.ReadAll(r.Body)
+	form := map[string][]string{}
+	files := map[string][]string{}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		if values, err := url.ParseQuery(string(body)); err == nil {
+			form = values
+		}
+		body = nil
+	case "multipart/form-data":
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if err := r.ParseMultipartForm(32 << 20); err == nil {
+			form = r.MultipartForm.Value
+			for name, headers := range r.MultipartForm.File {
+				for _, header := range headers {
+					if file, err := header.Open(); err == nil {
+						content, _ := io.ReadAll(file)
+						file.Close()
+						files[name] = append(files[name], string(content))
+					}
+				}
+			}
+		}
+		body = nil
+	}
+
+	var parsed interface{}
+	if json.Unmarshal(body, &parsed) != nil {
+		parsed = nil
+	}
+	result["data"] = string(body)
+	result["form"] = httpbinValues(form)
+	result["files"] = httpbinValues(files)
+	result["json"] = parsed
+	return result
+}
+
+func writeHttpbinJson(w http.ResponseWriter, status int, value interface{}) {
+	buf := new(bytes.Buffer)
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// The sample document served by /json
+var httpbinSlideshow = map[string]interface{}{
+	"slideshow": map[string]interface{}{
+		"author": "Yours Truly",
+		"date":   "date of publication",
+		"slides": []interface{}{
+			map[string]interface{}{"title": "Wake up to WonderWidgets!", "type": "all"},
+			map[string]interface{}{
+				"items": []string{"Why <em>WonderWidgets</em> are great", "Who <em>buys</em> WonderWidgets"},
+				"title": "Overview",
+				"type":  "all",
+			},
+		},
+		"title": "Sample Slide Show",
+	},
+}
+
+const httpbinUtf8Sample = `<h1>Unicode Demo</h1>
+
+<p>Mathematics and sciences: ∮ E⋅da = Q, n → ∞, ∑ f(i) = ∏ g(i)</p>
+<p>Greek: Σὲ γνωρίζω ἀπὸ τὴν κόψη</p>
+<p>Russian: Зарегистрируйтесь сейчас на Десятую Международную Конференцию</p>
+<p>Japanese: いろはにほへとちりぬるを</p>
+<p>Runes: ᚻᛖ ᚳᚹᚫᚦ ᚦᚫᛏ ᚻᛖ ᛒᚢᛞᛖ ᚩᚾ ᚦᚫᛗ</p>
+<p>Braille: ⡌⠁⠧⠑ ⠼⠁⠒  ⡍⠜⠇⠑⠹⠰⠎ ⡣⠕⠌</p>
+`
+
+// Returns a http.Handler implementing a subset of httpbin's endpoints
+func newHttpbinHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /get", func(w http.ResponseWriter, r *http.Request) {
+		writeHttpbinJson(w, http.StatusOK, httpbinRequest(r))
+	})
+	for _, method := range []string{"POST", "PUT", "PATCH", "DELETE"} {
+		mux.HandleFunc(method+" /"+strings.ToLower(method), func(w http.ResponseWriter, r *http.Request) {
+			writeHttpbinJson(w, http.StatusOK, httpbinRequestWithBody(r))
+		})
+	}
+	anything := func(w http.ResponseWriter, r *http.Request) {
+		result := httpbinRequestWithBody(r)
+		result["method"] = r.Method
+		writeHttpbinJson(w, http.StatusOK, result)
+	}
+	mux.HandleFunc("/anything", anything)
+	mux.HandleFunc("/anything/", anything)
+
+	mux.HandleFunc("/status/{codes}", func(w http.ResponseWriter, r *http.Request) {
+		codes := strings.Split(r.PathValue("codes"), ",")
+		code, err := strconv.Atoi(strings.TrimSpace(codes[rand.Intn(len(codes))]))
+		if err != nil || code < 100 || code > 999 {
+			http.Error(w, "Invalid status code", http.StatusBadRequest)
+			return
+		}
+		if code >= 300 && code < 400 && code != 304 {
+			w.Header().Set("Location", "/redirect/1")
+		}
+		w.WriteHeader(code)
+	})
+	mux.HandleFunc("/delay/{n}", func(w http.ResponseWriter, r *http.Request) {
+		seconds, err := strconv.ParseFloat(r.PathValue("n"), 64)
+		if err != nil {
+			http.Error(w, "Invalid delay", http.StatusBadRequest)
+			return
+		}
+		delay := time.Duration(min(seconds, 10) * float64(time.Second))
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		writeHttpbinJson(w, http.StatusOK, httpbinRequestWithBody(r))
+	})
+	mux.HandleFunc("GET /headers", func(w http.ResponseWriter, r *http.Request) {
+		writeHttpbinJson(w, http.StatusOK, map[string]interface{}{"headers": httpbinHeaders(r)})
+	})
+
+	mux.HandleFunc("GET /cookies", func(w http.ResponseWriter, r *http.Request) {
+		cookies := map[string]string{}
+		for _, cookie := range r.Cookies() {
+			cookies[cookie.Name] = cookie.Value
+		}
+		writeHttpbinJson(w, http.StatusOK, map[string]interface{}{"cookies": cookies})
+	})
+	mux.HandleFunc("GET /cookies/set", func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range r.URL.Query() {
+			http.SetCookie(w, &http.Cookie{Name: name, Value: values[0], Path: "/"})
+		}
+		http.Redirect(w, r, "/cookies", http.StatusFound)
+	})
+	mux.HandleFunc("GET /cookies/set/{name}/{value}", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: r.PathValue("name"), Value: r.PathValue("value"), Path: "/"})
+		http.Redirect(w, r, "/cookies", http.StatusFound)
+	})
+	mux.HandleFunc("GET /cookies/delete", func(w http.ResponseWriter, r *http.Request) {
+		for name := range r.URL.Query() {
+			http.SetCookie(w, &http.Cookie{Name: name, Path: "/", MaxAge: -1})
+		}
+		http.Redirect(w, r, "/cookies", http.StatusFound)
+	})
+
+	mux.HandleFunc("GET /redirect/{n}", func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(r.PathValue("n"))
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid redirect count", http.StatusBadRequest)
+			return
+		}
+		if n == 1 {
+			http.Redirect(w, r, "/get", http.StatusFound)
+		} else {
+			http.Redirect(w, r, fmt.Sprintf("/redirect/%d", n-1), http.StatusFound)
+		}
+	})
+
+	mux.HandleFunc("GET /stream/{n}", func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(r.PathValue("n"))
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid stream count", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		flusher, _ := w.(http.Flusher)
+		for i := 0; i < min(n, 100); i++ {
+			line := httpbinRequest(r)
+			line["id"] = i
+			data, _ := json.Marshal(line)
+			w.Write(append(data, '\n'))
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	})
+
+	// Not part of httpbin: an event stream of n events that then stays open
+	// until the client disconnects, resuming after Last-Event-ID if given.
+	// /sse/open returns how many of these streams are still connected.
+	var openStreams atomic.Int64
+	mux.HandleFunc("GET /sse/open", func(w http.ResponseWriter, r *http.Request) {
+		writeHttpbinJson(w, http.StatusOK, map[string]interface{}{"open": openStreams.Load()})
+	})
+	mux.HandleFunc("GET /sse/{n}", func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(r.PathValue("n"))
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid event count", http.StatusBadRequest)
+			return
+		}
+		openStreams.Add(1)
+		defer openStreams.Add(-1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		last, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+		for i := last + 1; i <= min(n, 100); i++ {
+			fmt.Fprintf(w, "id: %d\ndata: event %d\n\n", i, i)
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		<-r.Context().Done()
+	})
+
+	// Not part of httpbin: a WebSocket endpoint that sends every message back
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	mux.HandleFunc("GET /websocket/echo", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			messageType, payload, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(messageType, payload); err != nil {
+				return
+			}
+		}
+	})
+
+	mux.HandleFunc("/response-headers", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		for name, values := range query {
+			for _, value := range values {
+				w.Header().Add(name, value)
+			}
+		}
+		result := httpbinValues(query)
+		result["Content-Type"] = "application/json"
+		writeHttpbinJson(w, http.StatusOK, result)
+	})
+	mux.HandleFunc("GET /base64/{value}", func(w http.ResponseWriter, r *http.Request) {
+		value := r.PathValue("value")
+		decoded, err := base64.URLEncoding.DecodeString(value)
+		if err != nil {
+			decoded, err = base64.StdEncoding.DecodeString(value)
+		}
+		if err != nil {
+			decoded = []byte("Incorrect Base64 data try: SFRUUEJJTiBpcyBhd2Vzb21l")
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(decoded)
+	})
+	mux.HandleFunc("GET /json", func(w http.ResponseWriter, r *http.Request) {
+		writeHttpbinJson(w, http.StatusOK, httpbinSlideshow)
+	})
+	mux.HandleFunc("GET /encoding/utf8", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, httpbinUtf8Sample)
+	})
+	for encoding, field := range map[string]string{"gzip": "gzipped", "deflate": "deflated", "br": "brotli"} {
+		path := "GET /" + encoding
+		if encoding == "br" {
+			path = "GET /brotli"
+		}
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			data, _ := json.MarshalIndent(map[string]interface{}{
+				field:     true,
+				"headers": httpbinHeaders(r),
+				"method":  r.Method,
+				"origin":  httpbinOrigin(r),
+			}, "", "  ")
+			encoded, err := encodeBytes(data, []string{encoding})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Encoding", encoding)
+			w.Write(encoded)
+		})
+	}
+
+	return mux
+}
+
+/* http_test_server_start([port])
+* Start a local httpbin compatible test server on the given port of 127.0.0.1,
+* or a random free port if 0 or omitted, until stopped or the connection closes.
+* Returns the base URL of the server.
+ */
+type HttpTestServerStartFunc struct {
+	connection *connection
+}
+
+func (*HttpTestServerStartFunc) Deterministic() bool { return false }
+func (*HttpTestServerStartFunc) Args() int           { return -1 }
+func (f *HttpTestServerStartFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	if len(values) > 1 {
+		c.ResultError(fmt.Errorf("usage: http_test_server_start([port])"))
+		return
+	}
+	port := 0
+	if len(values) > 0 {
+		port = values[0].Int()
+	}
+
+	testServersMu.Lock()
+	if _, ok := testServers[port]; ok && port != 0 {
+		testServersMu.Unlock()
+		c.ResultError(fmt.Errorf("a test server is already running on port %d", port))
+		return
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		testServersMu.Unlock()
+		c.ResultError(fmt.Errorf("error starting test server: %s", err))
+		return
+	}
+	port = listener.Addr().(*net.TCPAddr).Port
+	running := &testServer{port: port, server: &http.Server{Handler: newHttpbinHandler()}}
+	testServers[port] = running
+	testServersMu.Unlock()
+	go running.server.Serve(listener)
+	removeHook := f.connection.onClose(func() { running.stop() })
+	testServersMu.Lock()
+	running.removeHook = removeHook
+	testServersMu.Unlock()
+
+	c.ResultText("http://" + listener.Addr().String())
+}
+
+/* http_test_server_stop(port)
+* Stop the test server running on the given port. Returns 1 if one was running, 0 otherwise.
+ */
+type HttpTestServerStopFunc struct{}
+
+func (*HttpTestServerStopFunc) Deterministic() bool { return false }
+func (*HttpTestServerStopFunc) Args() int           { return 1 }
+func (*HttpTestServerStopFunc) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	testServersMu.Lock()
+	running, ok := testServers[values[0].Int()]
+	testServersMu.Unlock()
+	if ok && running.stop() {
+		c.ResultInt(1)
+	} else {
+		c.ResultInt(0)
+	}
+}
+
+func RegisterTestServer(api *sqlite.ExtensionApi, connection *connection) error {
+	if err := api.CreateFunction("http_test_server_start", &HttpTestServerStartFunc{connection: connection}); err != nil {
+		return err
+	}
+	if err := api.CreateFunction("http_test_server_stop", &HttpTestServerStopFunc{}); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// Number of bytes at the start of a HTML document to search for a <meta> charset,
+// same as the WHATWG encoding sniffing algorithm
+const metaCharsetSniffLength = 1024
+
+var metaCharsetPattern = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?\s*([a-zA-Z0-9_:.\-]+)`)
+
+// Returns the charset declared by a byte order mark at the start of body, and the BOM length
+func sniffBOM(body []byte) (string, int) {
+	switch {
+	case bytes.HasPrefix(body, []byte{0xEF, 0xBB, 0xBF}):
+		return "utf-8", 3
+	case bytes.HasPrefix(body, []byte{0xFE, 0xFF}):
+		return "utf-16be", 2
+	case bytes.HasPrefix(body, []byte{0xFF, 0xFE}):
+		return "utf-16le", 2
+	}
+	return "", 0
+}
+
+// Returns the charset declared in a <meta> tag near the start of a HTML body, if any
+func sniffMetaCharset(body []byte) string {
+	if len(body) > metaCharsetSniffLength {
+		body = body[:metaCharsetSniffLength]
+	}
+	match := metaCharsetPattern.FindSubmatch(body)
+	if match == nil {
+		return ""
+	}
+	return string(match[1])
+}
+
+// Returns the encoding of the response body with the given Content-Type, in order of
+// the override charset, the Content-Type charset parameter, a BOM, then a <meta> charset.
+// Defaults to UTF-8.
+func detectTextEncoding(body []byte, contentType string, override string) (encoding.Encoding, error) {
+	if override != "" {
+		enc, err := htmlindex.Get(override)
+		if err != nil {
+			return nil, fmt.Errorf("unknown charset: %s", override)
+		}
+		return enc, nil
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	candidates := []string{params["charset"]}
+	if bom, _ := sniffBOM(body); bom != "" {
+		candidates = append(candidates, bom)
+	}
+	if mediaType == "" || mediaType == "text/html" || mediaType == "application/xhtml+xml" {
+		candidates = append(candidates, sniffMetaCharset(body))
+	}
+
+	// unknown or misspelled labels fall through to the next candidate
+	for _, label := range candidates {
+		if label == "" {
+			continue
+		}
+		if enc, err := htmlindex.Get(label); err == nil {
+			return enc, nil
+		}
+	}
+	return unicode.UTF8, nil
+}
+
+// Decode the given response body into UTF-8 text, based on the Content-Type header,
+// or the override charset if given. Invalid sequences are replaced with U+FFFD.
+func decodeText(body []byte, contentType string, override string) (string, error) {
+	enc, err := detectTextEncoding(body, contentType, override)
+	if err != nil {
+		return "", err
+	}
+
+	// a BOM matching the encoding shouldn't be part of the text
+	if bom, length := sniffBOM(body); bom != "" {
+		if bomEncoding, _ := htmlindex.Get(bom); bomEncoding == enc {
+			body = body[length:]
+		}
+	}
+
+	if enc == unicode.UTF8 {
+		if utf8.Valid(body) {
+			return string(body), nil
+		}
+		return strings.ToValidUTF8(string(body), "�"), nil
+	}
+	decoded, err := enc.NewDecoder().Bytes(body)
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.riyazali.net/sqlite"
+)
+
+// WARC file that every HTTP response is archived into, nil when disabled. Configurable with http_warc_to
+var DoWarc *warcWriter
+var doWarcMu sync.Mutex
+
+// The WARC file responses are archived into, nil if none
+func warcWriterInUse() *warcWriter {
+	doWarcMu.Lock()
+	defer doWarcMu.Unlock()
+	return DoWarc
+}
+
+// Maximum number of bytes read from a response closed before its end, to
+// archive it whole. Longer responses are archived truncated.
+const warcDrainLimit = 64 << 20
+
+type warcWriter struct {
+	path string
+	file *os.File
+	// true to compress each record as its own gzip member, for .warc.gz files
+	compress bool
+	closed   bool
+	// responses still being read to their end after they were closed
+	draining sync.WaitGroup
+	mu       sync.Mutex
+}
+
+// Open the WARC file at the given path for appending, writing a warcinfo record if it's new
+func openWarcWriter(path string) (*warcWriter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := &warcWriter{path: path, file: file, compress: strings.HasSuffix(path, ".gz")}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.Size() == 0 {
+		fields := fmt.Sprintf("software: sqlite-http/%s\r\nformat: WARC File Format 1.1\r\nconformsTo: http://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/\r\n", Version)
+		record := newWarcRecord("warcinfo", "application/warc-fields", []byte(fields))
+		record.headers = append(record.headers, [2]string{"WARC-Filename", path})
+		if err := w.write(record); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Close the file once responses closed early are done being read. Responses
+// still being read by SQLite aren't archived.
+func (w *warcWriter) close() error {
+	w.draining.Wait()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	return w.file.Close()
+}
+
+// Append the given records to the file, one after the other
+func (w *warcWriter) write(records ...*warcRecord) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	out := bufio.NewWriter(w.file)
+	for _, record := range records {
+		if !w.compress {
+			if err := record.writeTo(out); err != nil {
+				return err
+			}
+			continue
+		}
+		gz := gzip.NewWriter(out)
+		if err := record.writeTo(gz); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// A single WARC record, with named header fields in order
+type warcRecord struct {
+	id      string
+	headers [][2]string
+	block   []byte
+	// the rest of the block after block, stored in a file, and its size
+	rest     *os.File
+	restSize int64
+	// digest of the whole block
+	digest string
+}
+
+// Returns a new random "urn:uuid:" WARC record ID
+func newWarcRecordId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// Returns the "sha1:" base32 digest of the given hash, as used in WARC digest fields
+func warcDigestOf(h hash.Hash) string {
+	return "sha1:" + base32.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Returns the "sha1:" base32 digest of data
+func warcDigest(data []byte) string {
+	h := sha1.New()
+	h.Write(data)
+	return warcDigestOf(h)
+}
+
+func newWarcRecord(warcType string, contentType string, block []byte) *warcRecord {
+	id := newWarcRecordId()
+	return &warcRecord{
+		id: id,
+		headers: [][2]string{
+			{"WARC-Type", warcType},
+			{"WARC-Record-ID", id},
+			{"WARC-Date", time.Now().UTC().Format("2006-01-02T15:04:05.000000Z")},
+			{"Content-Type", contentType},
+		},
+		block:  block,
+		digest: warcDigest(block),
+	}
+}
+
+func (r *warcRecord) writeTo(w io.Writer) error {
+	buf := new(bytes.Buffer)
+	buf.WriteString("WARC/1.1\r\n")
+	for _, header := range r.headers {
+		fmt.Fprintf(buf, "%s: %s\r\n", header[0], header[1])
+	}
+	fmt.Fprintf(buf, "WARC-Block-Digest: %s\r\n", r.digest)
+	fmt.Fprintf(buf, "Content-Length: %d\r\n\r\n", int64(len(r.block))+r.restSize)
+	buf.Write(r.block)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if r.rest != nil {
+		if _, err := r.rest.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r.rest, r.restSize); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "\r\n\r\n")
+	return err
+}
+
+// Serialize the given request in wire format, without consuming its body, with
+// the HTTP version it was actually sent with, as given by its response
+func warcRequestBlock(request *http.Request, response *http.Response) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "%s %s HTTP/%d.%d\r\n", request.Method, request.URL.RequestURI(), response.ProtoMajor, response.ProtoMinor)
+	host := request.Host
+	if host == "" {
+		host = request.URL.Host
+	}
+	fmt.Fprintf(buf, "Host: %s\r\n", host)
+	request.Header.Write(buf)
+	buf.WriteString("\r\n")
+	if request.GetBody != nil {
+		if body, err := request.GetBody(); err == nil {
+			io.Copy(buf, body)
+			body.Close()
+		}
+	}
+	return buf.Bytes()
+}
+
+// Serialize the status line and headers of the given response in wire format,
+// what comes before the body in the response record
+func warcResponseHead(response *http.Response) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "HTTP/%d.%d %s\r\n", response.ProtoMajor, response.ProtoMinor, response.Status)
+	response.Header.Write(buf)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// A response body that streams everything read into a temporary file while
+// hashing it, then writes the exchange into the WARC file once fully read or
+// closed. Chunked transfer encoding has already been removed from the body.
+type warcBody struct {
+	body       io.ReadCloser
+	writer     *warcWriter
+	request    *http.Request
+	response   *http.Response
+	remoteAddr string
+	started    time.Time
+	// true for responses read as a stream, which are archived truncated when
+	// closed early instead of being read to their end
+	streaming bool
+
+	head        []byte
+	payload     *os.File
+	size        int64
+	payloadHash hash.Hash
+	blockHash   hash.Hash
+	// the first error writing the payload file, which fails archiving
+	payloadErr error
+	done       bool
+	mu         sync.Mutex
+}
+
+func newWarcBody(writer *warcWriter, request *http.Request, response *http.Response, remoteAddr string, started time.Time, streaming bool) (*warcBody, error) {
+	payload, err := os.CreateTemp("", "sqlite-http-warc-*")
+	if err != nil {
+		return nil, err
+	}
+	b := &warcBody{
+		body:        response.Body,
+		writer:      writer,
+		request:     request,
+		response:    response,
+		remoteAddr:  remoteAddr,
+		started:     started,
+		streaming:   streaming,
+		head:        warcResponseHead(response),
+		payload:     payload,
+		payloadHash: sha1.New(),
+		blockHash:   sha1.New(),
+	}
+	b.blockHash.Write(b.head)
+	return b, nil
+}
+
+// Record the given bytes read from the body
+func (b *warcBody) record(p []byte) {
+	if len(p) == 0 || b.payloadErr != nil {
+		return
+	}
+	if _, err := b.payload.Write(p); err != nil {
+		b.payloadErr = err
+		return
+	}
+	b.size += int64(len(p))
+	b.payloadHash.Write(p)
+	b.blockHash.Write(p)
+}
+
+func (b *warcBody) finish(truncated bool) error {
+	if b.done {
+		return nil
+	}
+	b.done = true
+	defer func() {
+		b.payload.Close()
+		os.Remove(b.payload.Name())
+	}()
+	if b.payloadErr != nil {
+		return fmt.Errorf("error archiving response into WARC file %s: %s", b.writer.path, b.payloadErr)
+	}
+
+	url := b.request.URL.String()
+	response := newWarcRecord("response", "application/http;msgtype=response", b.head)
+	response.rest, response.restSize, response.digest = b.payload, b.size, warcDigestOf(b.blockHash)
+	response.headers = append(response.headers,
+		[2]string{"WARC-Target-URI", url},
+		[2]string{"WARC-Payload-Digest", warcDigestOf(b.payloadHash)},
+	)
+	if host, _, err := net.SplitHostPort(b.remoteAddr); err == nil {
+		response.headers = append(response.headers, [2]string{"WARC-IP-Address", host})
+	}
+	if truncated {
+		response.headers = append(response.headers, [2]string{"WARC-Truncated", "unspecified"})
+	}
+
+	request := newWarcRecord("request", "application/http;msgtype=request", warcRequestBlock(b.request, b.response))
+	request.headers = append(request.headers,
+		[2]string{"WARC-Target-URI", url},
+		[2]string{"WARC-Concurrent-To", response.id},
+	)
+
+	fields := fmt.Sprintf("fetchTimeMs: %d\r\n", time.Since(b.started).Milliseconds())
+	metadata := newWarcRecord("metadata", "application/warc-fields", []byte(fields))
+	metadata.headers = append(metadata.headers,
+		[2]string{"WARC-Target-URI", url},
+		[2]string{"WARC-Refers-To", response.id},
+	)
+
+	if err := b.writer.write(response, request, metadata); err != nil {
+		return fmt.Errorf("error writing WARC file %s: %s", b.writer.path, err)
+	}
+	return nil
+}
+
+func (b *warcBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done {
+		return n, err
+	}
+	b.record(p[:n])
+	if err == io.EOF {
+		if warcErr := b.finish(false); warcErr != nil {
+			return n, warcErr
+		}
+	} else if err != nil {
+		b.finish(true)
+	}
+	return n, err
+}
+
+// Close the body. A response that isn't a stream is still read to its end in
+// the background, up to warcDrainLimit bytes, so it's archived whole.
+func (b *warcBody) Close() error {
+	b.mu.Lock()
+	if b.done || b.streaming {
+		defer b.mu.Unlock()
+		err := b.body.Close()
+		if warcErr := b.finish(true); warcErr != nil {
+			return warcErr
+		}
+		return err
+	}
+	b.mu.Unlock()
+
+	b.writer.draining.Add(1)
+	go func() {
+		defer b.writer.draining.Done()
+		buf := make([]byte, 32*1024)
+		var drained int64
+		var err error
+		for err == nil && drained < warcDrainLimit {
+			var n int
+			n, err = b.body.Read(buf)
+			drained += int64(n)
+			b.mu.Lock()
+			b.record(buf[:n])
+			b.mu.Unlock()
+		}
+		b.body.Close()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.finish(err != io.EOF)
+	}()
+	return nil
+}
+
+// A http.RoundTripper that archives every response made through it into a WARC file,
+// along with the request and a metadata record
+type warcTransport struct {
+	base      http.RoundTripper
+	writer    *warcWriter
+	streaming bool
+}
+
+func (t *warcTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	started := time.Now()
+	var remoteAddr string
+	trace := &httptrace.ClientTrace{
+		GotConn: func(g httptrace.GotConnInfo) {
+			remoteAddr = g.Conn.RemoteAddr().String()
+		},
+	}
+	response, err := t.base.RoundTrip(request.WithContext(httptrace.WithClientTrace(request.Context(), trace)))
+	if err != nil {
+		return nil, err
+	}
+	// event streams never end, whoever reads them
+	streaming := t.streaming || strings.HasPrefix(response.Header.Get("Content-Type"), "text/event-stream")
+	body, err := newWarcBody(t.writer, request, response, remoteAddr, started, streaming)
+	if err != nil {
+		response.Body.Close()
+		return nil, fmt.Errorf("error archiving response into WARC file %s: %s", t.writer.path, err)
+	}
+	response.Body = body
+	return response, nil
+}
+
+/* http_warc_to(path)
+* Archive every HTTP response made by sqlite-http into the WARC 1.1 file at the
+* given path, appending if it exists. Paths ending in ".gz" are gzip compressed
+* per record. NULL closes the file and disables archiving.
+ */
+type HttpWarcTo struct{}
+
+func (*HttpWarcTo) Deterministic() bool { return false }
+func (*HttpWarcTo) Args() int           { return 1 }
+func (*HttpWarcTo) Apply(c *sqlite.Context, values ...sqlite.Value) {
+	doWarcMu.Lock()
+	defer doWarcMu.Unlock()
+	if DoWarc != nil {
+		DoWarc.close()
+		DoWarc = nil
+	}
+	if values[0].Type() == sqlite.SQLITE_NULL || values[0].Text() == "" {
+		c.ResultNull()
+		return
+	}
+	writer, err := openWarcWriter(values[0].Text())
+	if err != nil {
+		c.ResultError(fmt.Errorf("error opening WARC file: %s", err))
+		return
+	}
+	DoWarc = writer
+	c.ResultText(writer.path)
+}
+
+func RegisterWarc(api *sqlite.ExtensionApi) error {
+	if err := api.CreateFunction("http_warc_to", &HttpWarcTo{}); err != nil {
+		return err
+	}
+	return nil
+}
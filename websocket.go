@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/asg017/sqlite-http/internal/vtab"
+	"github.com/gorilla/websocket"
+	"go.riyazali.net/sqlite"
+)
+
+// Headers that are generated by the WebSocket handshake itself, and can't be overridden
+var websocketHandshakeHeaders = []string{
+	"Upgrade",
+	"Connection",
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+	"Sec-Websocket-Extensions",
+}
+
+// Returns the ws:// or wss:// equivalent of the given http:// or https:// URL
+func websocketScheme(scheme string) string {
+	switch scheme {
+	case "http":
+		return "ws"
+	case "https":
+		return "wss"
+	}
+	return scheme
+}
+
+// Parse the initial messages to send, a JSON array where strings are sent as
+// is and any other value is sent as its JSON text
+func parseWebsocketMessages(messagesJson string) ([][]byte, error) {
+	if messagesJson == "" {
+		return nil, nil
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal([]byte(messagesJson), &raw); err != nil {
+		return nil, fmt.Errorf("send_messages_json must be a JSON array: %s", err)
+	}
+	messages := make([][]byte, 0, len(raw))
+	for _, message := range raw {
+		var s string
+		if err := json.Unmarshal(message, &s); err == nil {
+			messages = append(messages, []byte(s))
+		} else {
+			messages = append(messages, message)
+		}
+	}
+	return messages, nil
+}
+
+/** select type, payload, received_at from http_websocket(url, headers, send_messages_json, max_messages, timeout_ms)
+ * A table function that connects to a WebSocket, sends the given initial messages,
+ * then yields one row per received message until max_messages or timeout_ms is reached,
+ * or the server closes the connection.
+ */
+var WebsocketColumns = []vtab.Column{
+	{Name: "url", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "headers", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "send_messages_json", Type: sqlite.SQLITE_TEXT.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "max_messages", Type: sqlite.SQLITE_INTEGER.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "timeout_ms", Type: sqlite.SQLITE_INTEGER.String(), NotNull: true, Hidden: true, Filters: []*vtab.ColumnFilter{{Op: sqlite.INDEX_CONSTRAINT_EQ, OmitCheck: true}}},
+	{Name: "type", Type: sqlite.SQLITE_TEXT.String()},
+	{Name: "payload", Type: ""},
+	{Name: "received_at", Type: sqlite.SQLITE_TEXT.String()},
+}
+
+type WebsocketCursor struct {
+	conn        *websocket.Conn
+	response    *http.Response
+	maxMessages int
+	// how long to wait for each message, when timeout_ms wasn't given
+	idleTimeout time.Duration
+	// removes the hook closing the connection along with the database connection
+	removeHook func()
+
+	count       int
+	messageType int
+	payload     []byte
+	receivedAt  time.Time
+}
+
+func (cur *WebsocketCursor) Column(ctx vtab.Context, c int) error {
+	col := WebsocketColumns[c]
+
+	switch col.Name {
+	case "type":
+		if cur.messageType == websocket.BinaryMessage {
+			ctx.ResultText("binary")
+		} else {
+			ctx.ResultText("text")
+		}
+	case "payload":
+		if cur.messageType == websocket.BinaryMessage {
+			ctx.ResultBlob(cur.payload)
+		} else {
+			ctx.ResultText(string(cur.payload))
+		}
+	case "received_at":
+		ctx.ResultText(*formatSqliteDatetime(&cur.receivedAt))
+	}
+	return nil
+}
+
+// Close the connection through the handshake response, so every transport
+// wrapping it sees it end. Also called when SQLite stops reading rows early
+func (cur *WebsocketCursor) Close() error {
+	if cur.response == nil {
+		return nil
+	}
+	cur.removeHook()
+	err := cur.response.Body.Close()
+	cur.response = nil
+	cur.conn = nil
+	return err
+}
+
+func (cur *WebsocketCursor) Next() (vtab.Row, error) {
+	if cur.conn == nil || (cur.maxMessages > 0 && cur.count >= cur.maxMessages) {
+		cur.Close()
+		return nil, io.EOF
+	}
+
+	if cur.idleTimeout > 0 {
+		cur.conn.SetReadDeadline(time.Now().Add(cur.idleTimeout))
+	}
+	messageType, payload, err := cur.conn.ReadMessage()
+	if err != nil {
+		cur.Close()
+		// reaching a timeout or a clean close from the server ends the stream without an error
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, io.EOF
+		}
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+
+	cur.count += 1
+	cur.messageType = messageType
+	cur.payload = payload
+	cur.receivedAt = time.Now()
+	return cur, nil
+}
+
+// The http.RoundTripper at the bottom of a WebSocket handshake's transports,
+// in place of http.DefaultTransport. It dials the connection, then answers with
+// the 101 Switching Protocols response, whose body closes the connection.
+// Transports above it see the handshake like any other request, so mocks,
+// faults, logs, and archives apply to it too.
+type websocketTransport struct {
+	// set once the handshake succeeds
+	conn *websocket.Conn
+}
+
+func (t *websocketTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	target := *request.URL
+	target.Scheme = websocketScheme(target.Scheme)
+	header := request.Header.Clone()
+	for _, name := range websocketHandshakeHeaders {
+		header.Del(name)
+	}
+	dialer := websocket.Dialer{
+		Proxy:             http.ProxyFromEnvironment,
+		HandshakeTimeout:  DoTimeout,
+		EnableCompression: true,
+	}
+	conn, response, err := dialer.DialContext(request.Context(), target.String(), header)
+	if err != nil {
+		// a refused handshake is still a response
+		if response != nil {
+			response.Request = request
+			return response, nil
+		}
+		return nil, err
+	}
+	t.conn = conn
+	response.Body = &websocketBody{conn: conn}
+	response.Request = request
+	return response, nil
+}
+
+// The body of a successful handshake response. Messages are read from the
+// connection directly, closing it sends a close frame and closes the connection
+type websocketBody struct {
+	conn *websocket.Conn
+	once sync.Once
+}
+
+func (b *websocketBody) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (b *websocketBody) Close() error {
+	var err error
+	b.once.Do(func() {
+		message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		b.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+		err = b.conn.Close()
+	})
+	return err
+}
+
+func WebsocketIterator(connection *connection, constraints []*vtab.Constraint, order []*sqlite.OrderBy) (vtab.Iterator, error) {
+	var url string
+	var headers string
+	var sendMessages string
+	var maxMessages int
+	var timeout time.Duration
+
+	for _, constraint := range constraints {
+		if constraint.Op == sqlite.INDEX_CONSTRAINT_EQ {
+			column := WebsocketColumns[constraint.ColIndex]
+			switch column.Name {
+			case "url":
+				url = constraint.Value.Text()
+			case "headers":
+				headers = constraint.Value.Text()
+			case "send_messages_json":
+				sendMessages = constraint.Value.Text()
+			case "max_messages":
+				maxMessages = constraint.Value.Int()
+			case "timeout_ms":
+				timeout = time.Duration(constraint.Value.Int64()) * time.Millisecond
+			}
+		}
+	}
+
+	messages, err := parseWebsocketMessages(sendMessages)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &websocketTransport{}
+	client, request, err := prepareRequest(&PrepareRequestParams{method: "GET", url: url, headers: headers, body: nil, cookies: "", connection: connection, base: transport, streaming: true})
+	if err != nil {
+		return nil, fmt.Errorf("error preparing request: %s", err)
+	}
+	for _, header := range websocketHandshakeHeaders {
+		request.Header.Del(header)
+	}
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("error on websocket handshake: %s", err)
+	}
+	// answered without a connection, like by a mock, a fault, or a server that doesn't upgrade
+	if transport.conn == nil || response.StatusCode != http.StatusSwitchingProtocols {
+		response.Body.Close()
+		return nil, fmt.Errorf("error on websocket handshake: expected 101 Switching Protocols, got %s", response.Status)
+	}
+
+	cursor := WebsocketCursor{
+		conn:        transport.conn,
+		response:    response,
+		maxMessages: maxMessages,
+	}
+	if timeout > 0 {
+		deadline := time.Now().Add(timeout)
+		cursor.conn.SetReadDeadline(deadline)
+		cursor.conn.SetWriteDeadline(deadline)
+	} else {
+		cursor.idleTimeout = DoTimeout
+	}
+	// a read blocked on a quiet server ends once the database connection closes
+	body := response.Body
+	cursor.removeHook = connection.onClose(func() { body.Close() })
+
+	for _, message := range messages {
+		if err := cursor.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+			cursor.Close()
+			return nil, fmt.Errorf("error sending websocket message: %s", err)
+		}
+	}
+
+	return &cursor, nil
+}
+
+func RegisterWebsocket(api *sqlite.ExtensionApi, connection *connection) error {
+	iterator := func(constraints []*vtab.Constraint, order []*sqlite.OrderBy) (vtab.Iterator, error) {
+		return WebsocketIterator(connection, constraints, order)
+	}
+	if err := api.CreateModule("http_websocket", vtab.NewTableFunc("http_websocket", WebsocketColumns, iterator)); err != nil {
+		return err
+	}
+	return nil
+}